@@ -0,0 +1,219 @@
+package gorabbit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dimonrus/porterr"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Admin routes
+const (
+	// AdminPathConsumers consumers status and actions
+	AdminPathConsumers = "/consumers"
+	// AdminPathPools publish pools statistics
+	AdminPathPools = "/pools"
+	// AdminPathLive liveness probe
+	AdminPathLive = "/healthz/live"
+	// AdminPathReady readiness probe
+	AdminPathReady = "/healthz/ready"
+	// AdminPathMetrics metrics exposition when metrics collector implements http.Handler
+	AdminPathMetrics = "/metrics"
+)
+
+// Admin error response
+type adminError struct {
+	// Error code
+	Code string `json:"code"`
+	// Error message
+	Error string `json:"error"`
+}
+
+// Admin probe response
+type adminProbe struct {
+	// ok or fail
+	Status string `json:"status"`
+	// Consumers that are not ready
+	NotReady []ConsumerStatus `json:"notReady,omitempty"`
+}
+
+// Admin count request body
+type adminCount struct {
+	// Subscribers count
+	Count *int `json:"count"`
+}
+
+// AdminHandler HTTP admin handler
+// GET  /consumers                    - status of all consumers
+// GET  /consumers/{name}             - status of consumer
+// POST /consumers/{name|all}/start   - start subscribers
+// POST /consumers/{name|all}/stop    - stop subscribers
+// POST /consumers/{name|all}/restart - restart subscribers
+// POST /consumers/{name|all}/pause   - cancel subscribers keeping connection
+// POST /consumers/{name|all}/resume  - subscribe paused consumer
+// POST /consumers/{name}/count       - set subscribers count. Count is passed as ?value=N or {"count": N}
+// GET  /pools                        - publish pools statistics
+// GET  /healthz/live                 - liveness probe
+// GET  /healthz/ready                - readiness probe. 503 until every running consumer is connected and subscribed
+func (a *Application) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPathConsumers, a.adminConsumers)
+	mux.HandleFunc(AdminPathConsumers+"/", a.adminConsumers)
+	mux.HandleFunc(AdminPathPools, func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, a.sp.Stats())
+	})
+	mux.HandleFunc(AdminPathLive, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, adminProbe{Status: "ok"})
+	})
+	mux.HandleFunc(AdminPathReady, func(w http.ResponseWriter, r *http.Request) {
+		probe := adminProbe{Status: "ok"}
+		for _, status := range a.ConsumersStatus() {
+			if !status.Ready {
+				probe.NotReady = append(probe.NotReady, status)
+			}
+		}
+		if len(probe.NotReady) > 0 {
+			probe.Status = "fail"
+			writeAdminJSON(w, http.StatusServiceUnavailable, probe)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, probe)
+	})
+	if h, ok := a.metrics.(http.Handler); ok {
+		mux.Handle(AdminPathMetrics, h)
+	}
+	return mux
+}
+
+// ServeAdmin Start HTTP admin server. Blocks until server is closed
+func (a *Application) ServeAdmin(addr string) porterr.IError {
+	err := http.ListenAndServe(addr, a.AdminHandler())
+	if err != nil && err != http.ErrServerClosed {
+		return porterr.NewF(porterr.PortErrorSystem, "Admin server error: %s", err.Error())
+	}
+	return nil
+}
+
+// Consumers routes
+func (a *Application) adminConsumers(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, AdminPathConsumers), "/")
+	if path == "" {
+		if adminMethod(w, r, http.MethodGet) {
+			writeAdminJSON(w, http.StatusOK, a.ConsumersStatus())
+		}
+		return
+	}
+	parts := strings.Split(path, "/")
+	name := parts[0]
+	if len(parts) == 1 {
+		if !adminMethod(w, r, http.MethodGet) {
+			return
+		}
+		status, e := a.ConsumerStatus(name)
+		if e != nil {
+			writeAdminError(w, e)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, status)
+		return
+	}
+	if len(parts) != 2 {
+		writeAdminError(w, porterr.NewF(porterr.PortErrorArgument, "Unknown path %s", r.URL.Path))
+		return
+	}
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	}
+	var action func(name string) porterr.IError
+	switch parts[1] {
+	case CommandStart:
+		action = a.StartConsumer
+	case CommandStop:
+		action = a.StopConsumer
+	case CommandRestart:
+		action = a.RestartConsumer
+	case CommandPause:
+		action = a.PauseConsumer
+	case CommandResume:
+		action = a.ResumeConsumer
+	case CommandKeyWordCount:
+		count, e := adminCountValue(r)
+		if e != nil {
+			writeAdminError(w, e)
+			return
+		}
+		action = func(name string) porterr.IError {
+			return a.SetConsumerCount(name, count)
+		}
+	default:
+		writeAdminError(w, porterr.NewF(porterr.PortErrorArgument, "Unknown action '%s'", parts[1]))
+		return
+	}
+	if name != CommandKeyWordAll {
+		if e := action(name); e != nil {
+			writeAdminError(w, e)
+			return
+		}
+		status, _ := a.ConsumerStatus(name)
+		writeAdminJSON(w, http.StatusAccepted, status)
+		return
+	}
+	// Apply action to all consumers. Consumers already in requested state are skipped
+	for _, status := range a.ConsumersStatus() {
+		if e := action(status.Name); e != nil && !isConsumerStateError(e) {
+			writeAdminError(w, e)
+			return
+		}
+	}
+	writeAdminJSON(w, http.StatusAccepted, a.ConsumersStatus())
+}
+
+// Read count from query or body
+func adminCountValue(r *http.Request) (int, porterr.IError) {
+	if value := r.URL.Query().Get("value"); value != "" {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, porterr.NewF(porterr.PortErrorParam, "Wrong count value: %s", value)
+		}
+		return count, nil
+	}
+	body := adminCount{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Count == nil {
+		return 0, porterr.New(porterr.PortErrorParam, "Count must be passed as ?value=N or {\"count\": N}")
+	}
+	return *body.Count, nil
+}
+
+// Check request method
+func adminMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{Code: "METHOD_NOT_ALLOWED", Error: "Method " + r.Method + " is not allowed"})
+		return false
+	}
+	return true
+}
+
+// Write error with status by code
+func writeAdminError(w http.ResponseWriter, e porterr.IError) {
+	status := http.StatusBadRequest
+	switch {
+	case e.GetCode() == ConsumerErrorNotFound:
+		status = http.StatusNotFound
+	case isConsumerStateError(e):
+		status = http.StatusConflict
+	}
+	writeAdminJSON(w, status, adminError{Code: fmt.Sprint(e.GetCode()), Error: e.Error()})
+}
+
+// Write json response
+func writeAdminJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
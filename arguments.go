@@ -0,0 +1,172 @@
+package gorabbit
+
+import (
+	"fmt"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// QueueTypeClassic Value of x-queue-type argument of classic queue
+	QueueTypeClassic = "classic"
+	// QueueTypeQuorum Value of x-queue-type argument of quorum queue
+	QueueTypeQuorum = "quorum"
+	// QueueTypeStream Value of x-queue-type argument of stream queue
+	QueueTypeStream = "stream"
+
+	// DeadLetterAtMostOnce Dead-lettered messages may be lost
+	DeadLetterAtMostOnce = "at-most-once"
+	// DeadLetterAtLeastOnce Dead-lettered messages are confirmed by target queues. Requires OverflowRejectPublish
+	DeadLetterAtLeastOnce = "at-least-once"
+
+	// OverflowDropHead Oldest messages are dropped or dead-lettered when queue is full
+	OverflowDropHead = "drop-head"
+	// OverflowRejectPublish New messages are rejected when queue is full
+	OverflowRejectPublish = "reject-publish"
+	// OverflowRejectPublishDLX New messages are rejected and dead-lettered when queue is full. Classic queues only
+	OverflowRejectPublishDLX = "reject-publish-dlx"
+
+	// LeaderLocatorClientLocal Leader of queue is placed on node of declaring client
+	LeaderLocatorClientLocal = "client-local"
+	// LeaderLocatorBalanced Leader of queue is placed on node with the least leaders
+	LeaderLocatorBalanced = "balanced"
+
+	// HeaderDeliveryCount Header with count of previous failed deliveries of message of quorum queue
+	HeaderDeliveryCount = "x-delivery-count"
+)
+
+// QueueArguments Arguments of queue declaration
+// Typed options are converted to x- arguments and validated with queue type.
+// Custom Arguments must not conflict with typed options
+func (q *RabbitQueue) QueueArguments() (amqp.Table, porterr.IError) {
+	args := make(amqp.Table, len(q.Arguments)+8)
+	for k, v := range q.Arguments {
+		args[k] = v
+	}
+	if e := q.validateOptions(); e != nil {
+		return nil, e
+	}
+	options := amqp.Table{}
+	if q.QueueType != "" {
+		options["x-queue-type"] = q.QueueType
+	}
+	if q.DeliveryLimit > 0 {
+		options["x-delivery-limit"] = q.DeliveryLimit
+	}
+	if q.DeadLetterStrategy != "" {
+		options["x-dead-letter-strategy"] = q.DeadLetterStrategy
+	}
+	if q.MaxLength > 0 {
+		options["x-max-length"] = q.MaxLength
+	}
+	if q.Overflow != "" {
+		options["x-overflow"] = q.Overflow
+	}
+	if q.MessageTTL > 0 {
+		options["x-message-ttl"] = q.MessageTTL.Milliseconds()
+	}
+	if q.SingleActiveConsumer {
+		options["x-single-active-consumer"] = true
+	}
+	if q.LeaderLocator != "" {
+		options["x-queue-leader-locator"] = q.LeaderLocator
+	}
+	for k, v := range options {
+		if custom, ok := args[k]; ok && fmt.Sprint(custom) != fmt.Sprint(v) {
+			return nil, porterr.NewF(porterr.PortErrorParam, "Argument %s=%v of queue '%s' conflicts with option value %v", k, custom, q.Name, v)
+		}
+		args[k] = v
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return args, nil
+}
+
+// Type of queue from option or x-queue-type argument. Empty means classic
+func (q *RabbitQueue) queueType() string {
+	if q.QueueType != "" {
+		return q.QueueType
+	}
+	if t, ok := q.Arguments["x-queue-type"]; ok {
+		return fmt.Sprint(t)
+	}
+	return QueueTypeClassic
+}
+
+// Validate typed options with queue type
+func (q *RabbitQueue) validateOptions() porterr.IError {
+	queueType := q.queueType()
+	invalid := func(format string, args ...interface{}) porterr.IError {
+		return porterr.NewF(porterr.PortErrorParam, "Queue '%s': "+format, append([]interface{}{q.Name}, args...)...)
+	}
+	switch queueType {
+	case QueueTypeClassic:
+	case QueueTypeQuorum, QueueTypeStream:
+		if !q.Durable || q.Exclusive || q.AutoDelete {
+			return invalid("%s queue must be durable, not exclusive and not auto-deleted", queueType)
+		}
+	default:
+		return invalid("unknown queue type '%s'", queueType)
+	}
+	if q.DeliveryLimit < 0 || q.MaxLength < 0 || q.MessageTTL < 0 {
+		return invalid("delivery limit, max length and message ttl must not be negative")
+	}
+	if q.DeliveryLimit > 0 && queueType != QueueTypeQuorum {
+		return invalid("delivery limit requires quorum queue")
+	}
+	switch q.DeadLetterStrategy {
+	case "":
+	case DeadLetterAtMostOnce, DeadLetterAtLeastOnce:
+		if queueType != QueueTypeQuorum {
+			return invalid("dead letter strategy requires quorum queue")
+		}
+		if q.DeadLetterStrategy == DeadLetterAtLeastOnce && q.Overflow != OverflowRejectPublish {
+			return invalid("dead letter strategy %s requires overflow %s", DeadLetterAtLeastOnce, OverflowRejectPublish)
+		}
+	default:
+		return invalid("unknown dead letter strategy '%s'", q.DeadLetterStrategy)
+	}
+	switch q.Overflow {
+	case "":
+	case OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX:
+		if queueType == QueueTypeStream {
+			return invalid("overflow is not supported by stream queue")
+		}
+		if q.Overflow == OverflowRejectPublishDLX && queueType == QueueTypeQuorum {
+			return invalid("overflow %s is not supported by quorum queue", OverflowRejectPublishDLX)
+		}
+	default:
+		return invalid("unknown overflow '%s'", q.Overflow)
+	}
+	if q.MessageTTL > 0 && queueType == QueueTypeStream {
+		return invalid("message ttl is not supported by stream queue, use max age argument")
+	}
+	if q.SingleActiveConsumer && queueType == QueueTypeStream {
+		return invalid("single active consumer is not supported by stream queue")
+	}
+	switch q.LeaderLocator {
+	case "":
+	case LeaderLocatorClientLocal, LeaderLocatorBalanced:
+		if queueType == QueueTypeClassic {
+			return invalid("leader locator requires quorum or stream queue")
+		}
+	default:
+		return invalid("unknown leader locator '%s'", q.LeaderLocator)
+	}
+	return nil
+}
+
+// DeliveryCount Get count of previous failed deliveries of message of quorum queue
+// Zero for first delivery and for queues of other types
+func DeliveryCount(d amqp.Delivery) int64 {
+	switch v := d.Headers[HeaderDeliveryCount].(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	}
+	return 0
+}
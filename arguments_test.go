@@ -0,0 +1,67 @@
+package gorabbit
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRabbitQueue_QueueArguments(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		queue RabbitQueue
+		args  amqp.Table
+		fail  bool
+	}{
+		{name: "empty", queue: RabbitQueue{}},
+		{name: "custom", queue: RabbitQueue{Arguments: map[string]interface{}{"x-max-priority": 10}},
+			args: amqp.Table{"x-max-priority": 10}},
+		{name: "classic", queue: RabbitQueue{MaxLength: 100, Overflow: OverflowRejectPublishDLX, MessageTTL: time.Minute, SingleActiveConsumer: true},
+			args: amqp.Table{"x-max-length": int64(100), "x-overflow": OverflowRejectPublishDLX, "x-message-ttl": int64(60000), "x-single-active-consumer": true}},
+		{name: "quorum", queue: RabbitQueue{Durable: true, QueueType: QueueTypeQuorum, DeliveryLimit: 3, DeadLetterStrategy: DeadLetterAtLeastOnce,
+			Overflow: OverflowRejectPublish, LeaderLocator: LeaderLocatorBalanced},
+			args: amqp.Table{"x-queue-type": QueueTypeQuorum, "x-delivery-limit": int64(3), "x-dead-letter-strategy": DeadLetterAtLeastOnce,
+				"x-overflow": OverflowRejectPublish, "x-queue-leader-locator": LeaderLocatorBalanced}},
+		{name: "quorum argument", queue: RabbitQueue{Durable: true, DeliveryLimit: 1, Arguments: map[string]interface{}{"x-queue-type": QueueTypeQuorum}},
+			args: amqp.Table{"x-queue-type": QueueTypeQuorum, "x-delivery-limit": int64(1)}},
+		{name: "same value", queue: RabbitQueue{MaxLength: 5, Arguments: map[string]interface{}{"x-max-length": 5}},
+			args: amqp.Table{"x-max-length": int64(5)}},
+		{name: "conflict", queue: RabbitQueue{MaxLength: 5, Arguments: map[string]interface{}{"x-max-length": 6}}, fail: true},
+		{name: "unknown type", queue: RabbitQueue{QueueType: "lazy"}, fail: true},
+		{name: "not durable quorum", queue: RabbitQueue{QueueType: QueueTypeQuorum}, fail: true},
+		{name: "exclusive stream", queue: RabbitQueue{Durable: true, Exclusive: true, QueueType: QueueTypeStream}, fail: true},
+		{name: "negative", queue: RabbitQueue{MaxLength: -1}, fail: true},
+		{name: "classic delivery limit", queue: RabbitQueue{DeliveryLimit: 1}, fail: true},
+		{name: "classic strategy", queue: RabbitQueue{DeadLetterStrategy: DeadLetterAtMostOnce}, fail: true},
+		{name: "at least once overflow", queue: RabbitQueue{Durable: true, QueueType: QueueTypeQuorum, DeadLetterStrategy: DeadLetterAtLeastOnce}, fail: true},
+		{name: "quorum dlx overflow", queue: RabbitQueue{Durable: true, QueueType: QueueTypeQuorum, Overflow: OverflowRejectPublishDLX}, fail: true},
+		{name: "stream overflow", queue: RabbitQueue{Durable: true, QueueType: QueueTypeStream, Overflow: OverflowDropHead}, fail: true},
+		{name: "stream ttl", queue: RabbitQueue{Durable: true, QueueType: QueueTypeStream, MessageTTL: time.Second}, fail: true},
+		{name: "stream sac", queue: RabbitQueue{Durable: true, QueueType: QueueTypeStream, SingleActiveConsumer: true}, fail: true},
+		{name: "classic locator", queue: RabbitQueue{LeaderLocator: LeaderLocatorClientLocal}, fail: true},
+		{name: "unknown overflow", queue: RabbitQueue{Overflow: "drop-tail"}, fail: true},
+	} {
+		args, e := c.queue.QueueArguments()
+		if (e != nil) != c.fail {
+			t.Fatalf("%s: unexpected error %v", c.name, e)
+		}
+		if len(args) != len(c.args) {
+			t.Fatalf("%s: wrong arguments %v", c.name, args)
+		}
+		for k, v := range c.args {
+			if args[k] != v {
+				t.Fatalf("%s: wrong argument %s=%v", c.name, k, args[k])
+			}
+		}
+	}
+}
+
+func TestDeliveryCount(t *testing.T) {
+	if DeliveryCount(amqp.Delivery{}) != 0 {
+		t.Fatal("first delivery count must be zero")
+	}
+	if DeliveryCount(amqp.Delivery{Headers: amqp.Table{HeaderDeliveryCount: int32(2)}}) != 2 {
+		t.Fatal("wrong delivery count")
+	}
+}
@@ -0,0 +1,239 @@
+package gorabbit
+
+import (
+	"context"
+	"fmt"
+	"github.com/dimonrus/gocli"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HandlerErrorBatch Handler error code. Some deliveries of batch are failed
+	// Failures are details of error named by index of delivery in batch
+	HandlerErrorBatch = "GORABBIT_HANDLER_BATCH"
+
+	// DefaultBatchWait Default max time of waiting for full batch
+	DefaultBatchWait = time.Second
+)
+
+// BatchHandler Handler of batch of deliveries
+// Batch is acked with multiple=true on nil error. Failed deliveries of BatchError are nacked with requeue
+// or rejected without requeue on HandlerErrorReject code, other deliveries of batch are acked
+// Whole batch is nacked with requeue on any other error
+type BatchHandler func(ctx context.Context, deliveries []amqp.Delivery) porterr.IError
+
+// BatchError Create error of batch with failures of deliveries by index in batch
+func BatchError(failures map[int]porterr.IError) porterr.IError {
+	e := porterr.NewF(HandlerErrorBatch, "%d deliveries of batch are failed", len(failures))
+	for i, failure := range failures {
+		e = e.PushDetail(failure.GetCode(), strconv.Itoa(i), failure.Error())
+	}
+	return e
+}
+
+// Listen messages of subscriber and process them in batches until stop
+// Collected batch is processed on stop and on cancel of subscriber because channel stays open
+// Deliveries of collected batch are dropped on channel close because server requeues them
+func (c *Consumer) listenBatch(logger gocli.Logger, s *subscriber, messages <-chan amqp.Delivery) {
+	wait := c.BatchWait
+	if wait <= 0 {
+		wait = DefaultBatchWait
+	}
+	batch := make([]amqp.Delivery, 0, c.BatchSize)
+	timer := time.NewTimer(wait)
+	defer close(s.done)
+	defer c.closeSubscriber(s)
+	defer timer.Stop()
+	// Stop timer and drain fired value to not flush next batch early
+	stopTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+	stopTimer()
+	flush := func() {
+		stopTimer()
+		if len(batch) > 0 {
+			c.processBatch(logger, s.name, batch)
+			batch = make([]amqp.Delivery, 0, c.BatchSize)
+		}
+	}
+	for {
+		select {
+		case d, ok := <-messages:
+			if !ok {
+				if c.isCancelled(s) {
+					flush()
+				} else {
+					stopTimer()
+					batch = batch[:0]
+				}
+				if c.Isolation == IsolationShared || c.isCancelled(s) {
+					// Channel closed or subscriber cancelled. Wait for stop
+					<-s.stop
+					logger.Warnf("Stop: %v \n", s.name)
+					return
+				}
+				if messages = c.resubscribe(logger, s); messages == nil {
+					logger.Warnf("Stop: %v \n", s.name)
+					return
+				}
+				continue
+			}
+			batch = append(batch, d)
+			if len(batch) == 1 {
+				timer.Reset(wait)
+			}
+			if len(batch) >= c.BatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		case <-s.stop:
+			flush()
+			logger.Warnf("Stop: %v \n", s.name)
+			return
+		}
+	}
+}
+
+// ProcessBatch Process batch of deliveries with batch handler
+// Batch is acked with multiple=true on success. Failed deliveries of BatchError are nacked or rejected individually
+// Batch is nacked with requeue on other errors and on handler panic
+func (c *Consumer) ProcessBatch(logger gocli.Logger, name string, batch []amqp.Delivery) {
+	if len(batch) == 0 {
+		return
+	}
+	c.processBatch(logger, name, batch)
+}
+
+// Process batch with batch handler and acknowledge deliveries
+func (c *Consumer) processBatch(logger gocli.Logger, name string, batch []amqp.Delivery) {
+	log := c.getLogger(logger)
+	last := batch[len(batch)-1]
+	fields := []Field{
+		F(FieldConsumer, c.name),
+		F(FieldQueue, c.Queue),
+		F(FieldSubscriber, name),
+		F(FieldDeliveryTag, last.DeliveryTag),
+	}
+	switch c.LogMode {
+	case LogModeMetadata:
+		log.Log(LogLevelDebug, fmt.Sprintf("received a batch of %d messages", len(batch)), fields...)
+	case LogModeBody:
+		log.Log(LogLevelInfo, fmt.Sprintf("received a batch of %d messages", len(batch)), fields...)
+	}
+	ctx, span := c.getTracer().Start(context.Background(), c.Queue+" process batch", SpanKindConsumer)
+	defer span.End()
+	span.SetAttribute(AttributeMessagingSystem, "rabbitmq")
+	span.SetAttribute(AttributeDestination, c.Queue)
+	span.SetAttribute(AttributeConsumer, c.name)
+	ctx = ContextWithConsumerInfo(ctx, ConsumerInfo{Name: c.name, Queue: c.Queue, Server: c.Server, Subscriber: name})
+	metrics, labels := c.getMetrics(), c.labels()
+	for range batch {
+		metrics.DeliveryReceived(labels)
+	}
+	metrics.InFlight(labels, len(batch))
+	atomic.AddInt64(&c.inFlight, int64(len(batch)))
+	start := time.Now()
+	e := c.handleBatch(ctx, batch)
+	metrics.HandlerDuration(labels, time.Since(start))
+	metrics.InFlight(labels, -len(batch))
+	atomic.AddInt64(&c.inFlight, -int64(len(batch)))
+	if e != nil {
+		c.setLastError(e.Error())
+		span.RecordError(e)
+	}
+	var err error
+	switch {
+	case e == nil:
+		for range batch {
+			metrics.DeliveryAcked(labels)
+		}
+		err = last.Ack(true)
+	case e.GetCode() == HandlerErrorBatch:
+		log.Log(LogLevelError, "batch processing error", append(fields, F(FieldError, e.Error()))...)
+		err = c.settleBatch(batch, e, metrics, labels)
+	default:
+		if e.GetCode() == HandlerErrorPanic {
+			metrics.HandlerPanic(labels)
+			log.Log(LogLevelError, "recovered in error", append(fields, F(FieldError, e.Error()))...)
+		} else {
+			log.Log(LogLevelError, "batch processing error", append(fields, F(FieldError, e.Error()))...)
+		}
+		for range batch {
+			metrics.DeliveryNacked(labels)
+		}
+		err = last.Nack(true, true)
+	}
+	if err != nil {
+		log.Log(LogLevelError, "ack message error", append(fields, F(FieldError, err.Error()))...)
+	}
+}
+
+// Call batch handler. Panic is recovered and returned as HandlerErrorPanic after RecoverDelay
+func (c *Consumer) handleBatch(ctx context.Context, batch []amqp.Delivery) (e porterr.IError) {
+	defer func() {
+		if r := recover(); r != nil {
+			e = porterr.NewF(HandlerErrorPanic, "%v \n %s", r, debug.Stack())
+			delay := c.RecoverDelay
+			if delay == 0 {
+				delay = DefaultRecoverDelay
+			}
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+		}
+	}()
+	return c.BatchHandler(ctx, batch)
+}
+
+// Nack or reject failed deliveries of batch and ack others with multiple=true
+func (c *Consumer) settleBatch(batch []amqp.Delivery, e porterr.IError, metrics Metrics, labels Labels) error {
+	failures := make(map[int]interface{})
+	for _, detail := range e.GetDetails() {
+		if i, err := strconv.Atoi(detail.Origin().Name); err == nil {
+			failures[i] = detail.GetCode()
+		}
+	}
+	var lastAcked, acked int
+	var result error
+	for i, d := range batch {
+		code, failed := failures[i]
+		if !failed {
+			lastAcked = i + 1
+			acked++
+			continue
+		}
+		var err error
+		if code == HandlerErrorReject {
+			metrics.DeliveryRejected(labels)
+			err = d.Reject(false)
+		} else {
+			metrics.DeliveryNacked(labels)
+			err = d.Nack(false, true)
+		}
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	if lastAcked == 0 {
+		return result
+	}
+	for i := 0; i < acked; i++ {
+		metrics.DeliveryAcked(labels)
+	}
+	// Failed deliveries are already settled and not affected by multiple ack
+	if err := batch[lastAcked-1].Ack(true); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
@@ -3,6 +3,7 @@ package gorabbit
 import (
 	"github.com/dimonrus/gocli"
 	"github.com/dimonrus/porterr"
+	"strings"
 )
 
 const (
@@ -12,11 +13,57 @@ const (
 	CommandStatus   = "status"
 	CommandConsumer = "consumer"
 	CommandSet      = "set"
+	CommandPause    = "pause"
+	CommandResume   = "resume"
+	CommandAdd      = "add"
+	CommandRemove   = "remove"
 
 	CommandKeyWordAll   = "all"
 	CommandKeyWordCount = "count"
+	// CommandKeyWordJSON argument of --json flag. gocli strips leading dashes so --json is passed as json
+	CommandKeyWordJSON = "json"
+	// CommandFlagJSON reply in json
+	CommandFlagJSON = "--json"
 )
 
+// ConsumerCommandResult Result of consumer action in json reply
+type ConsumerCommandResult struct {
+	// Consumer name
+	Name string `json:"name"`
+	// Command action
+	Action string `json:"action"`
+	// Error code
+	Code string `json:"code,omitempty"`
+	// Error message
+	Error string `json:"error,omitempty"`
+	// Consumer status after action
+	Status ConsumerStatus `json:"status"`
+}
+
+// ParseOutputFormat Remove argument of --json flag from arguments of command
+// Flag is detected in origin of command because gocli strips leading dashes
+// Bare json argument is kept, so it can be a name of consumer or queue
+func ParseOutputFormat(command *gocli.Command, args []gocli.Argument) ([]gocli.Argument, bool) {
+	var asJSON bool
+	for _, word := range strings.Fields(command.GetOrigin()) {
+		if word == CommandFlagJSON {
+			asJSON = true
+			break
+		}
+	}
+	if !asJSON {
+		return args, false
+	}
+	// Flag follows other arguments
+	for i := len(args) - 1; i >= 0; i-- {
+		if args[i].Name == CommandKeyWordJSON {
+			result := make([]gocli.Argument, 0, len(args)-1)
+			return append(append(result, args[:i]...), args[i+1:]...), true
+		}
+	}
+	return args, true
+}
+
 // ParseCommand parse gocli.Command
 func ParseCommand(command *gocli.Command) (action string, arguments []gocli.Argument, e porterr.IError) {
 	args := command.Arguments()
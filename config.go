@@ -2,6 +2,7 @@ package gorabbit
 
 import (
 	"github.com/dimonrus/porterr"
+	"time"
 )
 
 // RabbitQueue Queue configuration
@@ -33,7 +34,29 @@ type RabbitQueue struct {
 	Prefetch Prefetch
 	// List of routing keys for queue
 	RoutingKey []string `yaml:"routingKey"`
-	// Queue custom arguments
+	// Publish as mandatory. Unroutable messages are returned and reported as publish error
+	Mandatory bool
+	// Names of publish interceptors registered with Application.RegisterPublishInterceptor
+	Interceptors []string
+	// Strategy of PublishDelayed. Empty means DelayPlugin
+	Delay DelayStrategy
+	// Type of queue: classic, quorum or stream. Empty means x-queue-type argument or classic
+	QueueType string `yaml:"queueType"`
+	// Max count of failed deliveries before message is dropped or dead-lettered. Quorum queues only
+	DeliveryLimit int64 `yaml:"deliveryLimit"`
+	// Dead letter strategy: at-most-once or at-least-once. Quorum queues only
+	DeadLetterStrategy string `yaml:"deadLetterStrategy"`
+	// Max count of ready messages
+	MaxLength int64 `yaml:"maxLength"`
+	// Behaviour on reach of max length: drop-head, reject-publish or reject-publish-dlx
+	Overflow string
+	// Time of keeping message in queue
+	MessageTTL time.Duration `yaml:"messageTTL"`
+	// Only one consumer receives messages, other consumers are standby
+	SingleActiveConsumer bool `yaml:"singleActiveConsumer"`
+	// Placement of queue leader: client-local or balanced. Quorum and stream queues only
+	LeaderLocator string `yaml:"leaderLocator"`
+	// Queue custom arguments. Must not conflict with typed options
 	Arguments map[string]interface{}
 }
 
@@ -1,12 +1,14 @@
 package gorabbit
 
 import (
+	"context"
 	"fmt"
 	"github.com/dimonrus/gocli"
 	"github.com/dimonrus/gohelp"
 	"github.com/dimonrus/porterr"
 	amqp "github.com/rabbitmq/amqp091-go"
-	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,41 +18,393 @@ type Consumer struct {
 	Queue string
 	// Server name
 	Server string
-	// Delivery process callback
+	// Delivery process callback. Used when Handler is not set
 	Callback func(d amqp.Delivery)
+	// Delivery handler
+	Handler Handler
+	// Handler of request returning reply published to ReplyTo of request. Used instead of Handler and Callback when set
+	ReplyHandler ReplyHandler
+	// Handler of batch of deliveries. Used instead of Handler and Callback when set
+	BatchHandler BatchHandler
+	// Max count of deliveries in batch. Prefetch count must be not less than batch size
+	BatchSize int
+	// Max time of waiting for full batch since first delivery. Zero means DefaultBatchWait
+	BatchWait time.Duration
+	// Consumer middlewares. Applied after global middlewares of application
+	Middleware []Middleware
 	// Subscribers count
-	Count uint8
+	Count uint16
+	// Count of deliveries processed concurrently by every subscriber
+	// Zero or one means sequential processing. Prefetch should be not less than concurrency
+	Concurrency int
+	// Ack successful deliveries in delivery order with multiple=true
+	// Requires single subscriber or isolated subscribers. Failed deliveries are nacked or rejected immediately
+	OrderedAck bool
+	// Pause before requeue of delivery on callback panic
+	// Zero means DefaultRecoverDelay, negative value disables pause
+	RecoverDelay time.Duration
+	// Delivery logging mode
+	LogMode LogMode
+	// Max length of logged body for LogModeBody. Zero means DefaultLogBodyLimit, negative value disables truncation
+	LogBodyLimit int
+	// Redact body for LogModeBody
+	Redact Redactor
+	// Store of processed deliveries. Duplicate delivery is acked without calling handler
+	DedupStore DedupStore
+	// Header with key of delivery for dedup. Empty means MessageId
+	DedupHeader string
+	// Time of keeping key of processed delivery. Zero means DefaultDedupTTL
+	DedupTTL time.Duration
+	// Start position of consumer of stream queue. Zero value means next
+	StreamOffset StreamOffset
+	// Store of processed offsets of stream. Consuming is resumed after stored offset
+	OffsetStore OffsetStore
+	// Isolation of subscribers. Subscribers share channel of consumer by default
+	Isolation Isolation
+	// Prefetch of consumer. Overrides prefetch of queue
+	// Applied to channel of every subscriber when subscribers are isolated
+	Prefetch Prefetch
+	// Structured logger
+	logger Logger
+	// Consumer name in registry
+	name string
+	// Metrics collector
+	metrics Metrics
+	// Tracer for processing spans
+	tracer Tracer
+	// Global middlewares of application
+	middleware []Middleware
+	// Handler chain built on subscribe
+	handler Handler
+	// Publish reply of ReplyHandler
+	reply func(ctx context.Context, request amqp.Delivery, p amqp.Publishing) porterr.IError
+	// Lock for subscribers, connection and runtime state
+	m sync.Mutex
+	// Lock for subscribe, pause and stop of subscribers
+	sm sync.Mutex
+	// Consumption is paused. Subscribers are not started on reconnect until resume
+	paused bool
+	// Consume is waiting for stop
+	active bool
+	// Lifecycle state
+	state ConsumerState
+	// Closed to stop supervisor. Nil for consumer started with Consume
+	quit chan struct{}
+	// Closed when supervisor or unsupervised consume exits
+	done chan struct{}
+	// Deliveries in processing
+	inFlight int64
+	// Last consume or processing error
+	lastError string
+	// Time of last error
+	lastErrorAt time.Time
+	// Time when subscribers were started
+	startedAt time.Time
 	// Stop all consumers
 	stop chan struct{}
 	// Subscribers
 	subscribers []*subscriber
 	// amqp Connection
-	connection *amqp.Connection
+	connection Connection
 	// amqp Channel
-	channel *amqp.Channel
+	channel Channel
 	// amqp Queue
 	queue *amqp.Queue
+	// Open connection to server of consumer
+	dial func() (Connection, error)
+	// Prefetch of subscriber channel
+	prefetch Prefetch
+	// Queue is a stream
+	stream bool
+	// Processed offsets of stream kept in memory when OffsetStore is not set
+	offsets *MemoryOffsetStore
 }
 
+// DefaultRecoverDelay Default pause before requeue of delivery on callback panic
+const DefaultRecoverDelay = time.Second * 10
+
+// Isolation subscribers isolation mode of consumer
+type Isolation uint8
+
+const (
+	// IsolationShared all subscribers share channel of consumer. Default mode
+	IsolationShared Isolation = iota
+	// IsolationChannel every subscriber has own channel on connection of consumer
+	IsolationChannel
+	// IsolationConnection every subscriber has own connection and channel
+	IsolationConnection
+)
+
 // Internal subscriber struct
 type subscriber struct {
 	// Subscriber name
 	name string
 	// chan for stop subscribing
 	stop chan struct{}
+	// Own channel of isolated subscriber
+	channel Channel
+	// Own connection of subscriber with IsolationConnection
+	connection Connection
+	// Subscriber is cancelled on server. Closed deliveries are not a channel failure
+	cancelled bool
+	// Closed when subscriber exits
+	done chan struct{}
 }
 
-// Stop all subscribers
+// Ordered acknowledgement of deliveries received on one channel
+type ackOrder struct {
+	// Lock for tags
+	m sync.Mutex
+	// Not acknowledged delivery tags in delivery order
+	tags []uint64
+	// Processed deliveries. True for successful processing
+	settled map[uint64]bool
+}
+
+// Clone Copy consumer configuration with name in registry
+// Runtime state is not copied
+func (c *Consumer) Clone(name string) *Consumer {
+	return &Consumer{
+		Queue:        c.Queue,
+		Server:       c.Server,
+		Callback:     c.Callback,
+		Handler:      c.Handler,
+		ReplyHandler: c.ReplyHandler,
+		BatchHandler: c.BatchHandler,
+		BatchSize:    c.BatchSize,
+		BatchWait:    c.BatchWait,
+		Middleware:   append([]Middleware(nil), c.Middleware...),
+		Count:        c.count(),
+		Concurrency:  c.Concurrency,
+		OrderedAck:   c.OrderedAck,
+		RecoverDelay: c.RecoverDelay,
+		LogMode:      c.LogMode,
+		LogBodyLimit: c.LogBodyLimit,
+		Redact:       c.Redact,
+		DedupStore:   c.DedupStore,
+		DedupHeader:  c.DedupHeader,
+		DedupTTL:     c.DedupTTL,
+		StreamOffset: c.StreamOffset,
+		OffsetStore:  c.OffsetStore,
+		Isolation:    c.Isolation,
+		Prefetch:     c.Prefetch,
+		name:         name,
+	}
+}
+
+// Name Consumer name in registry
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Stop all subscribers and consume
+// Pause state is kept
 func (c *Consumer) Stop() {
-	for i := range c.subscribers {
-		c.subscribers[i].stop <- struct{}{}
+	c.sm.Lock()
+	defer c.sm.Unlock()
+	c.stopSubscribers(nil)
+	c.m.Lock()
+	active, stop := c.active, c.stop
+	c.active = false
+	c.m.Unlock()
+	if active {
+		stop <- struct{}{}
+	}
+}
+
+// Pause Cancel subscribers on server keeping connection and channel
+// Subscribers are not started on reconnect until resume
+func (c *Consumer) Pause() porterr.IError {
+	c.sm.Lock()
+	defer c.sm.Unlock()
+	c.m.Lock()
+	if c.paused {
+		c.m.Unlock()
+		return porterr.NewF(ConsumerErrorPaused, "Consumer '%s' already paused", c.name)
+	}
+	c.paused = true
+	channel := c.channel
+	c.m.Unlock()
+	return c.stopSubscribers(channel)
+}
+
+// Resume Subscribe paused consumer with the same count of subscribers
+// Subscribers are started on next connect when consumer is not connected
+func (c *Consumer) Resume(logger gocli.Logger) porterr.IError {
+	c.sm.Lock()
+	defer c.sm.Unlock()
+	c.m.Lock()
+	if !c.paused {
+		c.m.Unlock()
+		return porterr.NewF(ConsumerErrorNotPaused, "Consumer '%s' is not paused", c.name)
+	}
+	c.paused = false
+	active := c.active
+	c.m.Unlock()
+	if !active {
+		return nil
 	}
+	return c.Subscribe(logger)
+}
+
+// IsPaused Check consumption is paused
+func (c *Consumer) IsPaused() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.paused
+}
+
+// State Lifecycle state of consumer
+func (c *Consumer) State() ConsumerState {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.state == "" {
+		return ConsumerStateIdle
+	}
+	return c.state
+}
+
+// Set lifecycle state
+func (c *Consumer) setState(state ConsumerState) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.state = state
+}
+
+// Set state of supervised consumer unless consumer is stopping
+// False is returned when consumer is stopping, so stop is not lost by supervisor
+func (c *Consumer) setRetryState(state ConsumerState) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.state == ConsumerStateStopping {
+		return false
+	}
+	c.state = state
+	return true
+}
+
+// Validate processing options with queue and prefetch of channel
+// Ack with multiple=true on shared channel would ack deliveries of other subscribers
+func (c *Consumer) validate(q *RabbitQueue) porterr.IError {
+	if e := q.validateOptions(); e != nil {
+		return e
+	}
+	prefetch := c.channelPrefetch(q)
+	if c.Concurrency < 0 {
+		return porterr.New(porterr.PortErrorParam, "Concurrency of consumer must not be negative")
+	}
+	if c.OrderedAck && c.Isolation == IsolationShared && c.count() > 1 {
+		return porterr.New(porterr.PortErrorParam, "Ordered ack requires single subscriber or isolated subscribers")
+	}
+	if c.BatchHandler != nil {
+		if c.BatchSize < 1 {
+			return porterr.New(porterr.PortErrorParam, "Batch size must be positive")
+		}
+		if prefetch.Count < c.BatchSize {
+			return porterr.NewF(porterr.PortErrorParam, "Prefetch count %d must be not less than batch size %d", prefetch.Count, c.BatchSize)
+		}
+		if c.Isolation == IsolationShared && c.count() > 1 {
+			return porterr.New(porterr.PortErrorParam, "Batch ack requires single subscriber or isolated subscribers")
+		}
+		if c.DedupStore != nil {
+			return porterr.New(porterr.PortErrorParam, "Dedup store is not supported by batch handler")
+		}
+	}
+	return c.validateStream(q, prefetch)
+}
+
+// Prefetch of consumer channel. Prefetch of consumer overrides prefetch of queue
+func (c *Consumer) channelPrefetch(q *RabbitQueue) Prefetch {
+	if !c.Prefetch.IsEmpty() {
+		return c.Prefetch
+	}
+	return q.Prefetch
+}
+
+// Get count of subscribers
+func (c *Consumer) count() uint16 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.Count
+}
+
+// Set count of subscribers
+func (c *Consumer) setCount(count uint16) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.Count = count
+}
+
+// Mark consume as active and subscribe unless consumer is paused
+// Consume is not started when consumer is stopping
+// Done is passed by unsupervised consume and closed when consume returns, so stop waits for it
+func (c *Consumer) start(stop chan struct{}, done chan struct{}, logger gocli.Logger) (bool, porterr.IError) {
+	c.sm.Lock()
+	defer c.sm.Unlock()
+	c.m.Lock()
+	if c.state == ConsumerStateStopping {
+		c.m.Unlock()
+		return false, nil
+	}
+	if done != nil {
+		switch c.state {
+		case "", ConsumerStateIdle:
+		default:
+			c.m.Unlock()
+			return false, porterr.NewF(ConsumerErrorStarted, "Subscribers for '%s' already started", c.name)
+		}
+		c.quit, c.done = nil, done
+	}
+	c.active = true
+	c.stop = stop
+	paused := c.paused
+	c.m.Unlock()
+	if !paused {
+		if e := c.Subscribe(logger); e != nil {
+			c.stopSubscribers(nil)
+			c.m.Lock()
+			c.active = false
+			c.m.Unlock()
+			return false, e
+		}
+	}
+	// Stop requested while subscribing is not lost
+	c.setRetryState(ConsumerStateRunning)
+	return true, nil
+}
+
+// Stop subscribers. Subscribers are cancelled on server when channel is passed
+func (c *Consumer) stopSubscribers(channel Channel) porterr.IError {
+	c.m.Lock()
+	subscribers := c.subscribers
 	c.subscribers = make([]*subscriber, 0)
-	c.stop <- struct{}{}
+	c.m.Unlock()
+	var e porterr.IError
+	for i := range subscribers {
+		ch := channel
+		c.m.Lock()
+		own := subscribers[i].channel
+		subscribers[i].cancelled = ch != nil
+		c.m.Unlock()
+		if ch != nil && own != nil {
+			// Isolated subscriber is cancelled on own channel
+			ch = own
+		}
+		if ch != nil && !ch.IsClosed() {
+			if err := ch.Cancel(subscribers[i].name, false); err != nil && e == nil {
+				e = porterr.NewF(porterr.PortErrorConnection, "Cancel '%s' error: %s", subscribers[i].name, err.Error())
+			}
+		}
+		subscribers[i].stop <- struct{}{}
+		<-subscribers[i].done
+	}
+	return e
 }
 
 // HasSubscribers Check for subscribers
 func (c *Consumer) HasSubscribers() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
 	if len(c.subscribers) > 0 {
 		return true
 	}
@@ -58,8 +412,70 @@ func (c *Consumer) HasSubscribers() bool {
 }
 
 // SubscribersCount Get s subscribers
-func (c *Consumer) SubscribersCount() uint8 {
-	return uint8(len(c.subscribers))
+func (c *Consumer) SubscribersCount() uint16 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return uint16(len(c.subscribers))
+}
+
+// IsConnected Check consumer connection is open
+func (c *Consumer) IsConnected() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.connection != nil && !c.connection.IsClosed()
+}
+
+// InFlight Count of deliveries in processing
+func (c *Consumer) InFlight() int64 {
+	return atomic.LoadInt64(&c.inFlight)
+}
+
+// LastError Last consume or processing error and its time
+func (c *Consumer) LastError() (string, time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.lastError, c.lastErrorAt
+}
+
+// Uptime Duration since subscribers were started. Zero if consumer is not running
+func (c *Consumer) Uptime() time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.startedAt.IsZero() {
+		return 0
+	}
+	return time.Since(c.startedAt)
+}
+
+// Set last error
+func (c *Consumer) setLastError(err string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.lastError = err
+	c.lastErrorAt = time.Now()
+}
+
+// Set start time. Zero time means consumer is not running
+func (c *Consumer) setStartedAt(t time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.startedAt = t
+}
+
+// Set connection and channel
+func (c *Consumer) setConnection(conn Connection, channel Channel) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.connection = conn
+	c.channel = channel
+}
+
+// Set dial function and prefetch for isolated subscribers
+func (c *Consumer) setIsolation(dial func() (Connection, error), prefetch Prefetch) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.dial = dial
+	c.prefetch = prefetch
 }
 
 // NewSubscriber New subscribers
@@ -67,12 +483,14 @@ func (c *Consumer) NewSubscriber(name string) *subscriber {
 	return &subscriber{
 		name: name,
 		stop: make(chan struct{}),
+		done: make(chan struct{}),
 	}
 }
 
 // Subscribe for queue
 func (c *Consumer) Subscribe(logger gocli.Logger) porterr.IError {
-	for num := uint8(0); num < c.Count; num++ {
+	count := c.count()
+	for num := uint16(0); num < count; num++ {
 		logger.Infof(`Subscribe '%s' queue on server '%s'`, c.Queue, c.Server)
 		// If consumer isn't created
 		if c == nil || c.queue == nil || c.connection == nil || c.channel == nil {
@@ -80,47 +498,359 @@ func (c *Consumer) Subscribe(logger gocli.Logger) porterr.IError {
 		}
 		// Subscriber name
 		name := fmt.Sprintf("Subscriber: %s-%s", c.queue.Name, gohelp.RandString(5))
+		s := c.NewSubscriber(name)
 		// Consume messages
-		messages, err := c.channel.Consume(c.queue.Name, name, false, false, false, false, nil)
-		if err != nil {
-			return porterr.NewF(porterr.PortErrorParam, "Consume '%s' error: %s", c.Queue, err.Error())
+		messages, e := c.consumeMessages(s)
+		if e != nil {
+			return e
 		}
-		s := c.NewSubscriber(name)
+		c.m.Lock()
 		c.subscribers = append(c.subscribers, s)
+		c.m.Unlock()
 		// Listen queue messages
-		go func() {
-			for {
-				select {
-				case d := <-messages:
-					if d.Acknowledger == nil {
-						break
-					}
-					logger.Infof("%s - received a message: \n %s", name, d.Body)
-					func() {
-						defer func() {
-							if r := recover(); r != nil {
-								logger.Errorf("%s - recovered in error: \n %s \n %s", name, r, debug.Stack())
-								// Reject and requeue after 10 second pause
-								time.Sleep(time.Second * 10)
-								err := d.Reject(true)
-								if err != nil {
-									logger.Errorf("Reject message error: %s\n", err.Error())
-								}
-							}
-						}()
-						c.Callback(d)
-						err := d.Ack(false)
-						if err != nil {
-							logger.Errorf("Ack message error: %s\n", err.Error())
-							return
-						}
-					}()
-				case <-s.stop:
-					logger.Warnf("Stop: %v \n", name)
+		if c.BatchHandler != nil {
+			go c.listenBatch(logger, s, messages)
+		} else {
+			go c.listen(logger, s, messages)
+		}
+	}
+	return nil
+}
+
+// Listen messages of subscriber until stop
+// Closed channel of isolated subscriber is opened again without restart of other subscribers
+// Deliveries are processed by pool of Concurrency workers. Channel of subscriber is closed
+// and subscriber exits only when all workers are finished
+func (c *Consumer) listen(logger gocli.Logger, s *subscriber, messages <-chan amqp.Delivery) {
+	var workers sync.WaitGroup
+	var pool chan struct{}
+	if c.Concurrency > 1 {
+		pool = make(chan struct{}, c.Concurrency)
+	}
+	var order *ackOrder
+	if c.OrderedAck {
+		order = newAckOrder()
+	}
+	defer close(s.done)
+	defer c.closeSubscriber(s)
+	defer workers.Wait()
+	for {
+		select {
+		case d, ok := <-messages:
+			if !ok {
+				if c.Isolation == IsolationShared || c.isCancelled(s) {
+					// Channel closed or subscriber cancelled. Wait for stop
+					<-s.stop
+					logger.Warnf("Stop: %v \n", s.name)
+					return
+				}
+				// Deliveries of workers are settled before channel is closed
+				workers.Wait()
+				if messages = c.resubscribe(logger, s); messages == nil {
+					logger.Warnf("Stop: %v \n", s.name)
 					return
 				}
+				// Delivery tags of new channel start from one
+				if order != nil {
+					order = newAckOrder()
+				}
+				continue
+			}
+			if order != nil {
+				order.add(d.DeliveryTag)
+			}
+			if pool == nil {
+				c.process(logger, s.name, d, order)
+				continue
 			}
-		}()
+			pool <- struct{}{}
+			workers.Add(1)
+			go func(d amqp.Delivery, order *ackOrder) {
+				defer workers.Done()
+				c.process(logger, s.name, d, order)
+				<-pool
+			}(d, order)
+		case <-s.stop:
+			logger.Warnf("Stop: %v \n", s.name)
+			return
+		}
 	}
-	return nil
+}
+
+// Check if subscriber is cancelled by pause
+func (c *Consumer) isCancelled(s *subscriber) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return s.cancelled
+}
+
+// Open channel of isolated subscriber again after DefaultRetryDelay until success
+// Nil is returned when subscriber is stopped
+func (c *Consumer) resubscribe(logger gocli.Logger, s *subscriber) <-chan amqp.Delivery {
+	c.closeSubscriber(s)
+	c.setLastError(fmt.Sprintf("Channel of '%s' is closed", s.name))
+	for {
+		if c.metrics != nil {
+			c.metrics.Reconnect(c.labels())
+		}
+		logger.Warnf("Channel of '%s' is closed. Resubscribe in %v", s.name, DefaultRetryDelay)
+		select {
+		case <-s.stop:
+			return nil
+		case <-time.After(DefaultRetryDelay):
+		}
+		messages, e := c.consumeMessages(s)
+		if e == nil {
+			return messages
+		}
+		c.setLastError(e.Error())
+	}
+}
+
+// Start consume for subscriber. Own channel and connection are opened for isolated subscriber
+func (c *Consumer) consumeMessages(s *subscriber) (<-chan amqp.Delivery, porterr.IError) {
+	c.m.Lock()
+	channel, conn, dial, prefetch := c.channel, c.connection, c.dial, c.prefetch
+	c.m.Unlock()
+	if c.Isolation != IsolationShared {
+		var own Connection
+		var err error
+		if c.Isolation == IsolationConnection {
+			if dial == nil {
+				return nil, porterr.NewF(porterr.PortErrorParam, "Init consumer first")
+			}
+			if own, err = dial(); err != nil {
+				return nil, porterr.NewF(porterr.PortErrorConnection, "Subscriber '%s' connection error: %s", s.name, err.Error())
+			}
+			conn = own
+		}
+		if channel, err = conn.Channel(); err != nil {
+			if own != nil {
+				_ = own.Close()
+			}
+			return nil, porterr.NewF(porterr.PortErrorConnection, "Subscriber '%s' channel error: %s", s.name, err.Error())
+		}
+		c.m.Lock()
+		s.channel, s.connection = channel, own
+		c.m.Unlock()
+		if !prefetch.IsEmpty() {
+			if err = channel.Qos(prefetch.Count, prefetch.Size, false); err != nil {
+				c.closeSubscriber(s)
+				return nil, porterr.NewF(porterr.PortErrorParam, "Prefetch error: %s", err.Error())
+			}
+		}
+	}
+	args, e := c.consumeArgs()
+	if e != nil {
+		c.closeSubscriber(s)
+		return nil, e
+	}
+	messages, err := channel.Consume(c.queue.Name, s.name, false, false, false, false, args)
+	if err != nil {
+		c.closeSubscriber(s)
+		return nil, porterr.NewF(porterr.PortErrorParam, "Consume '%s' error: %s", c.Queue, err.Error())
+	}
+	return messages, nil
+}
+
+// Close own channel and connection of isolated subscriber
+func (c *Consumer) closeSubscriber(s *subscriber) {
+	c.m.Lock()
+	channel, conn := s.channel, s.connection
+	s.channel, s.connection = nil, nil
+	c.m.Unlock()
+	if channel != nil {
+		_ = channel.Close()
+	}
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// Create ordered acknowledgement
+func newAckOrder() *ackOrder {
+	return &ackOrder{settled: make(map[uint64]bool)}
+}
+
+// Add received delivery tag
+func (o *ackOrder) add(tag uint64) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.tags = append(o.tags, tag)
+}
+
+// Mark delivery as processed and ack successful deliveries of processed prefix with multiple=true
+// Failed delivery must be nacked or rejected before
+func (o *ackOrder) settle(d amqp.Delivery, success bool) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.settled[d.DeliveryTag] = success
+	var last uint64
+	for len(o.tags) > 0 {
+		ok, settled := o.settled[o.tags[0]]
+		if !settled {
+			break
+		}
+		if ok {
+			last = o.tags[0]
+		}
+		delete(o.settled, o.tags[0])
+		o.tags = o.tags[1:]
+	}
+	if last == 0 {
+		return nil
+	}
+	return d.Acknowledger.Ack(last, true)
+}
+
+// Process delivery with handler chain
+// Delivery is acked on success, rejected with requeue on handler panic,
+// rejected without requeue on HandlerErrorReject and nacked with requeue on other errors
+// Structured logger of application is used when set, otherwise logger is used if it implements Logger or wrapped
+func (c *Consumer) Process(logger gocli.Logger, name string, d amqp.Delivery) {
+	c.process(logger, name, d, nil)
+}
+
+// Process delivery. Successful delivery is acked in delivery order when order is passed
+func (c *Consumer) process(logger gocli.Logger, name string, d amqp.Delivery, order *ackOrder) {
+	log := c.getLogger(logger)
+	fields := []Field{
+		F(FieldConsumer, c.name),
+		F(FieldQueue, c.Queue),
+		F(FieldSubscriber, name),
+		F(FieldDeliveryTag, d.DeliveryTag),
+		F(FieldMessageId, d.MessageId),
+	}
+	switch c.LogMode {
+	case LogModeMetadata:
+		log.Log(LogLevelDebug, "received a message", append(fields, F(FieldRoutingKey, d.RoutingKey), F(FieldRedelivered, d.Redelivered))...)
+	case LogModeBody:
+		body := d.Body
+		if c.Redact != nil {
+			body = c.Redact(body)
+		}
+		limit := c.LogBodyLimit
+		if limit == 0 {
+			limit = DefaultLogBodyLimit
+		}
+		log.Log(LogLevelInfo, "received a message", append(fields, F(FieldRoutingKey, d.RoutingKey), F(FieldRedelivered, d.Redelivered), F(FieldBody, TruncateBody(body, limit)))...)
+	}
+	// Continue trace of publisher
+	ctx := context.Background()
+	if sc, ok := ExtractTraceContext(d.Headers); ok {
+		ctx = ContextWithSpanContext(ctx, sc)
+	}
+	ctx, span := c.getTracer().Start(ctx, c.Queue+" process", SpanKindConsumer)
+	defer span.End()
+	span.SetAttribute(AttributeMessagingSystem, "rabbitmq")
+	span.SetAttribute(AttributeDestination, c.Queue)
+	span.SetAttribute(AttributeRoutingKey, d.RoutingKey)
+	span.SetAttribute(AttributeConsumer, c.name)
+	if d.MessageId != "" {
+		span.SetAttribute(AttributeMessageId, d.MessageId)
+	}
+	ctx = ContextWithConsumerInfo(ctx, ConsumerInfo{Name: c.name, Queue: c.Queue, Server: c.Server, Subscriber: name,
+		DeliveryCount: DeliveryCount(d)})
+	handler := c.handler
+	if handler == nil {
+		handler = c.chain()
+	}
+	atomic.AddInt64(&c.inFlight, 1)
+	e := handler(ctx, d)
+	atomic.AddInt64(&c.inFlight, -1)
+	if e != nil {
+		c.setLastError(e.Error())
+	}
+	var err error
+	switch {
+	case e == nil && order != nil:
+		err = order.settle(d, true)
+	case e == nil:
+		err = d.Ack(false)
+	case e.GetCode() == HandlerErrorPanic:
+		span.RecordError(e)
+		log.Log(LogLevelError, "recovered in error", append(fields, F(FieldError, e.Error()))...)
+		err = d.Reject(true)
+	case e.GetCode() == HandlerErrorReject:
+		span.RecordError(e)
+		log.Log(LogLevelError, "rejected", append(fields, F(FieldError, e.Error()))...)
+		err = d.Reject(false)
+	default:
+		span.RecordError(e)
+		log.Log(LogLevelError, "processing error", append(fields, F(FieldError, e.Error()))...)
+		err = d.Nack(false, true)
+	}
+	if e != nil && order != nil {
+		if settleErr := order.settle(d, false); settleErr != nil && err == nil {
+			err = settleErr
+		}
+	}
+	if err != nil {
+		log.Log(LogLevelError, "ack message error", append(fields, F(FieldError, err.Error()))...)
+	}
+}
+
+// Build handler chain
+// Metrics and panic recovery wrap global and consumer middlewares
+// Offset save and dedup wrap metrics, so duplicates acked without processing are counted
+// only as duplicates and offset of stream is saved for duplicates too
+func (c *Consumer) chain() Handler {
+	h := c.Handler
+	if c.ReplyHandler != nil {
+		h = replyHandler(c.ReplyHandler, c.reply)
+	}
+	if h == nil {
+		callback := c.Callback
+		h = func(ctx context.Context, d amqp.Delivery) porterr.IError {
+			callback(d)
+			return nil
+		}
+	}
+	delay := c.RecoverDelay
+	if delay == 0 {
+		delay = DefaultRecoverDelay
+	}
+	middlewares := make([]Middleware, 0, len(c.middleware)+len(c.Middleware)+4)
+	if store := c.offsetStore(); store != nil {
+		middlewares = append(middlewares, OffsetMiddleware(store, c.logger))
+	}
+	if c.DedupStore != nil {
+		middlewares = append(middlewares, DedupMiddleware(c.DedupStore, c.DedupHeader, c.DedupTTL, c.getMetrics()))
+	}
+	middlewares = append(middlewares, MetricsMiddleware(c.getMetrics()), RecoverMiddleware(delay))
+	middlewares = append(middlewares, c.middleware...)
+	middlewares = append(middlewares, c.Middleware...)
+	return Chain(h, middlewares...)
+}
+
+// Get structured logger. Logger is used if it implements Logger or wrapped
+func (c *Consumer) getLogger(logger gocli.Logger) Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+	if l, ok := logger.(Logger); ok {
+		return l
+	}
+	return NewGocliLogger(logger, LogLevelInfo)
+}
+
+// Get metrics collector
+func (c *Consumer) getMetrics() Metrics {
+	if c.metrics == nil {
+		return NopMetrics{}
+	}
+	return c.metrics
+}
+
+// Get tracer
+func (c *Consumer) getTracer() Tracer {
+	if c.tracer == nil {
+		return NopTracer{}
+	}
+	return c.tracer
+}
+
+// Metric labels of consumer
+func (c *Consumer) labels() Labels {
+	return Labels{Server: c.Server, Queue: c.Queue, Consumer: c.name}
 }
@@ -0,0 +1,307 @@
+package gorabbit
+
+import (
+	"github.com/dimonrus/porterr"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// ConsumerErrorNotFound Consumer error code. Consumer is not registered
+	ConsumerErrorNotFound = "GORABBIT_CONSUMER_NOT_FOUND"
+	// ConsumerErrorStarted Consumer error code. Subscribers are already started
+	ConsumerErrorStarted = "GORABBIT_CONSUMER_STARTED"
+	// ConsumerErrorStopped Consumer error code. Subscribers are already stopped
+	ConsumerErrorStopped = "GORABBIT_CONSUMER_STOPPED"
+	// ConsumerErrorPaused Consumer error code. Consumer is already paused
+	ConsumerErrorPaused = "GORABBIT_CONSUMER_PAUSED"
+	// ConsumerErrorNotPaused Consumer error code. Consumer is not paused
+	ConsumerErrorNotPaused = "GORABBIT_CONSUMER_NOT_PAUSED"
+
+	// ConsumerErrorStopping Consumer error code. Consumer is stopping
+	ConsumerErrorStopping = "GORABBIT_CONSUMER_STOPPING"
+
+	// ConnectionStateOpen consumer connection is open
+	ConnectionStateOpen = "open"
+	// ConnectionStateClosed consumer connection is closed or not created
+	ConnectionStateClosed = "closed"
+)
+
+// DefaultRetryDelay Pause before next start of failed consumer
+const DefaultRetryDelay = time.Second
+
+// ConsumerState Lifecycle state of consumer
+type ConsumerState string
+
+const (
+	// ConsumerStateIdle consumer is not started
+	ConsumerStateIdle ConsumerState = "idle"
+	// ConsumerStateStarting consumer is connecting and subscribing
+	ConsumerStateStarting ConsumerState = "starting"
+	// ConsumerStateRunning consumer is subscribed or paused on open connection
+	ConsumerStateRunning ConsumerState = "running"
+	// ConsumerStateStopping consumer is stopping
+	ConsumerStateStopping ConsumerState = "stopping"
+	// ConsumerStateFailed consume failed. Start is retried by supervisor after DefaultRetryDelay
+	ConsumerStateFailed ConsumerState = "failed"
+)
+
+// ConsumerStatus Consumer status
+type ConsumerStatus struct {
+	// Consumer name in registry
+	Name string `json:"name"`
+	// Queue name from config
+	Queue string `json:"queue"`
+	// Server name from config
+	Server string `json:"server"`
+	// Lifecycle state
+	State ConsumerState `json:"state"`
+	// Desired count of subscribers
+	Desired int `json:"desired"`
+	// Running subscribers
+	Subscribers int `json:"subscribers"`
+	// Connection is open
+	Connected bool `json:"connected"`
+	// Connection state: open or closed
+	Connection string `json:"connection"`
+	// Consumption is paused
+	Paused bool `json:"paused"`
+	// Deliveries in processing
+	InFlight int64 `json:"inFlight"`
+	// Last consume or processing error
+	LastError string `json:"lastError,omitempty"`
+	// Time of last error
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	// Seconds since subscribers were started
+	Uptime float64 `json:"uptime"`
+	// All subscribers are running on open connection. Consumer with zero desired count is always ready
+	// Consumer that is not supposed to run because it is stopped, not started or paused is always ready
+	Ready bool `json:"ready"`
+}
+
+// Get consumer from registry
+func (a *Application) getConsumer(name string) (*Consumer, porterr.IError) {
+	a.rm.RLock()
+	defer a.rm.RUnlock()
+	consumer, ok := a.registry[name]
+	if !ok {
+		return nil, porterr.NewF(ConsumerErrorNotFound, "Consumer '%s' not found in registry", name)
+	}
+	return consumer, nil
+}
+
+// Names of registered consumers ordered by name
+func (a *Application) consumerNames() []string {
+	a.rm.RLock()
+	defer a.rm.RUnlock()
+	names := make([]string, 0, len(a.registry))
+	for name := range a.registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ConsumerStatus Get status of consumer
+func (a *Application) ConsumerStatus(name string) (ConsumerStatus, porterr.IError) {
+	consumer, e := a.getConsumer(name)
+	if e != nil {
+		return ConsumerStatus{}, e
+	}
+	status := ConsumerStatus{
+		Name:        name,
+		Queue:       consumer.Queue,
+		Server:      consumer.Server,
+		State:       consumer.State(),
+		Desired:     int(consumer.count()),
+		Subscribers: int(consumer.SubscribersCount()),
+		Connected:   consumer.IsConnected(),
+		Connection:  ConnectionStateClosed,
+		Paused:      consumer.IsPaused(),
+		InFlight:    consumer.InFlight(),
+		Uptime:      consumer.Uptime().Seconds(),
+	}
+	if status.Connected {
+		status.Connection = ConnectionStateOpen
+	}
+	if err, at := consumer.LastError(); err != "" {
+		status.LastError = err
+		status.LastErrorAt = &at
+	}
+	switch {
+	case status.State == "" || status.State == ConsumerStateIdle || status.State == ConsumerStateStopping || status.Paused:
+		// Consumer is not supposed to run
+		status.Ready = true
+	default:
+		status.Ready = status.Subscribers == status.Desired && (status.Desired == 0 || status.Connected)
+	}
+	return status, nil
+}
+
+// ConsumersStatus Get status of all consumers ordered by name
+func (a *Application) ConsumersStatus() []ConsumerStatus {
+	names := a.consumerNames()
+	statuses := make([]ConsumerStatus, 0, len(names))
+	for _, name := range names {
+		status, e := a.ConsumerStatus(name)
+		if e == nil {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// IsReady Check all consumers supposed to run are connected and subscribed
+func (a *Application) IsReady() bool {
+	for _, status := range a.ConsumersStatus() {
+		if !status.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// StartConsumer Start subscribers of consumer in background
+// Consumer is supervised until stop. Failed consume is retried after DefaultRetryDelay
+// Paused consumer is connected without subscribers
+func (a *Application) StartConsumer(name string) porterr.IError {
+	consumer, e := a.getConsumer(name)
+	if e != nil {
+		return e
+	}
+	consumer.m.Lock()
+	defer consumer.m.Unlock()
+	switch consumer.state {
+	case "", ConsumerStateIdle:
+	case ConsumerStateStopping:
+		return porterr.NewF(ConsumerErrorStopping, "Consumer '%s' is stopping", name)
+	default:
+		return porterr.NewF(ConsumerErrorStarted, "Subscribers for '%s' already started", name)
+	}
+	consumer.state = ConsumerStateStarting
+	consumer.quit = make(chan struct{})
+	consumer.done = make(chan struct{})
+	go a.supervise(name, consumer, consumer.quit, consumer.done)
+	return nil
+}
+
+// Supervise consumer. Consume is retried until quit is closed or consumer is stopped directly
+func (a *Application) supervise(name string, consumer *Consumer, quit chan struct{}, done chan struct{}) {
+	defer close(done)
+	defer consumer.setState(ConsumerStateIdle)
+	for {
+		e := a.consume(name, true)
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		// Consumer is stopped with Consumer.Stop
+		if e == nil {
+			return
+		}
+		if !consumer.setRetryState(ConsumerStateFailed) {
+			return
+		}
+		consumer.setLastError(e.Error())
+		a.FailMessage(e.Error())
+		select {
+		case <-quit:
+			return
+		case <-time.After(DefaultRetryDelay):
+		}
+		// Stop can be requested after retry delay
+		if !consumer.setRetryState(ConsumerStateStarting) {
+			return
+		}
+	}
+}
+
+// StopConsumer Stop subscribers of consumer and wait until supervisor exits
+// Pause state is kept until resume
+func (a *Application) StopConsumer(name string) porterr.IError {
+	consumer, e := a.getConsumer(name)
+	if e != nil {
+		return e
+	}
+	return a.stopConsumer(name, consumer)
+}
+
+// Stop consumer and wait until supervisor or unsupervised consume exits
+func (a *Application) stopConsumer(name string, consumer *Consumer) porterr.IError {
+	consumer.m.Lock()
+	switch consumer.state {
+	case "", ConsumerStateIdle:
+		consumer.m.Unlock()
+		return porterr.NewF(ConsumerErrorStopped, "Subscribers for '%s' already stopped", name)
+	case ConsumerStateStopping:
+		consumer.m.Unlock()
+		return porterr.NewF(ConsumerErrorStopping, "Consumer '%s' is stopping", name)
+	}
+	consumer.state = ConsumerStateStopping
+	quit, done := consumer.quit, consumer.done
+	consumer.m.Unlock()
+	// Consumer started with Consume has no supervisor
+	if quit != nil {
+		close(quit)
+	}
+	consumer.Stop()
+	<-done
+	return nil
+}
+
+// RestartConsumer Stop subscribers of consumer if started and start again
+func (a *Application) RestartConsumer(name string) porterr.IError {
+	if e := a.StopConsumer(name); e != nil && e.GetCode() != ConsumerErrorStopped {
+		return e
+	}
+	return a.StartConsumer(name)
+}
+
+// SetConsumerCount Set count of subscribers and restart consumer
+func (a *Application) SetConsumerCount(name string, count int) porterr.IError {
+	consumer, e := a.getConsumer(name)
+	if e != nil {
+		return e
+	}
+	if count < 0 || count > math.MaxUint16 {
+		return porterr.NewF(porterr.PortErrorParam, "Subscribers count must be between 0 and %d", math.MaxUint16)
+	}
+	if e = a.StopConsumer(name); e != nil && e.GetCode() != ConsumerErrorStopped {
+		return e
+	}
+	consumer.setCount(uint16(count))
+	if count == 0 {
+		return nil
+	}
+	return a.StartConsumer(name)
+}
+
+// PauseConsumer Cancel subscribers of consumer keeping connection and channel
+// Pause is kept on reconnect, stop and restart until resume
+func (a *Application) PauseConsumer(name string) porterr.IError {
+	consumer, e := a.getConsumer(name)
+	if e != nil {
+		return e
+	}
+	return consumer.Pause()
+}
+
+// ResumeConsumer Subscribe paused consumer with the same count of subscribers
+func (a *Application) ResumeConsumer(name string) porterr.IError {
+	consumer, e := a.getConsumer(name)
+	if e != nil {
+		return e
+	}
+	return consumer.Resume(a.GetLogger())
+}
+
+// Check error means consumer is already in requested state
+func isConsumerStateError(e porterr.IError) bool {
+	switch e.GetCode() {
+	case ConsumerErrorStarted, ConsumerErrorStopped, ConsumerErrorStopping, ConsumerErrorPaused, ConsumerErrorNotPaused:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package gorabbit
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDedupTTL Default time of keeping key of processed delivery
+	DefaultDedupTTL = time.Hour * 24
+	// DefaultDedupSize Default max count of keys in memory store
+	DefaultDedupSize = 100000
+	// DefaultDedupTable Default table of sql store
+	DefaultDedupTable = "gorabbit_dedup"
+)
+
+// DedupStore Store of keys of processed deliveries
+type DedupStore interface {
+	// Claim store key for ttl if key is not stored or expired. False is returned when key is stored
+	// Claim must be atomic because duplicates can be processed concurrently
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Release remove claimed key of failed delivery
+	Release(ctx context.Context, key string) error
+}
+
+// DedupMiddleware Ack duplicate delivery without calling handler
+// Delivery is identified by header when header is not empty, otherwise by MessageId
+// Key is scoped by queue of consumer from context, so consumers of different queues process the same message
+// Delivery without key is processed. Key is claimed for ttl before processing and released when handler fails
+// Error of store claim nacks delivery with requeue
+// Key of delivery interrupted by process crash stays claimed until ttl
+// Duplicates are counted when m implements DedupMetrics
+func DedupMiddleware(store DedupStore, header string, ttl time.Duration, m Metrics) Middleware {
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, d amqp.Delivery) porterr.IError {
+			key := DedupKey(d, header)
+			if key == "" {
+				return next(ctx, d)
+			}
+			info := ConsumerInfoFromContext(ctx)
+			key = info.Queue + "/" + key
+			claimed, err := store.Claim(ctx, key, ttl)
+			if err != nil {
+				return porterr.NewF(porterr.PortErrorSystem, "Dedup store error: %s", err.Error())
+			}
+			if !claimed {
+				if dm, ok := m.(DedupMetrics); ok {
+					dm.DeliveryDuplicate(info.Labels())
+				}
+				return nil
+			}
+			var success bool
+			// Key is released on error and on panic
+			defer func() {
+				if !success {
+					_ = store.Release(ctx, key)
+				}
+			}()
+			e := next(ctx, d)
+			success = e == nil
+			return e
+		}
+	}
+}
+
+// DedupKey Get key of delivery from header or MessageId when header is empty
+func DedupKey(d amqp.Delivery, header string) string {
+	if header == "" {
+		return d.MessageId
+	}
+	value, ok := d.Headers[header]
+	if !ok || value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// MemoryDedupStore In-memory store with ttl and eviction of least recently used keys
+type MemoryDedupStore struct {
+	// Lock for keys
+	m sync.Mutex
+	// Max count of keys
+	size int
+	// Keys ordered by usage. Front is most recent
+	order *list.List
+	// Elements of order by key
+	keys map[string]*list.Element
+}
+
+// Item of memory store
+type dedupItem struct {
+	// Delivery key
+	key string
+	// Key is not valid after
+	expires time.Time
+}
+
+// NewMemoryDedupStore Create memory store. Zero size means DefaultDedupSize
+func NewMemoryDedupStore(size int) *MemoryDedupStore {
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+	return &MemoryDedupStore{size: size, order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+// Claim store key for ttl if key is not stored or expired. Least recently used key is evicted when store is full
+func (s *MemoryDedupStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	expires := time.Now().Add(ttl)
+	if el, ok := s.keys[key]; ok {
+		item := el.Value.(*dedupItem)
+		s.order.MoveToFront(el)
+		if time.Now().Before(item.expires) {
+			return false, nil
+		}
+		item.expires = expires
+		return true, nil
+	}
+	s.keys[key] = s.order.PushFront(&dedupItem{key: key, expires: expires})
+	for s.order.Len() > s.size {
+		el := s.order.Back()
+		s.order.Remove(el)
+		delete(s.keys, el.Value.(*dedupItem).key)
+	}
+	return true, nil
+}
+
+// Release remove key
+func (s *MemoryDedupStore) Release(ctx context.Context, key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if el, ok := s.keys[key]; ok {
+		s.order.Remove(el)
+		delete(s.keys, key)
+	}
+	return nil
+}
+
+// Len count of stored keys including expired
+func (s *MemoryDedupStore) Len() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.order.Len()
+}
+
+// SQLDedupStore Store of keys in database table
+// CREATE TABLE gorabbit_dedup (message_key VARCHAR(255) PRIMARY KEY, expires_at TIMESTAMP NOT NULL)
+type SQLDedupStore struct {
+	// Database
+	db *sql.DB
+	// Table name
+	table string
+	// Placeholder of query argument by position started from 1
+	placeholder func(n int) string
+}
+
+// QuestionPlaceholder Placeholder ? of MySQL and SQLite drivers
+func QuestionPlaceholder(n int) string {
+	return "?"
+}
+
+// DollarPlaceholder Placeholder $n of PostgreSQL drivers
+func DollarPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// NewSQLDedupStore Create sql store. Empty table means DefaultDedupTable, nil placeholder means QuestionPlaceholder
+func NewSQLDedupStore(db *sql.DB, table string, placeholder func(n int) string) *SQLDedupStore {
+	if table == "" {
+		table = DefaultDedupTable
+	}
+	if placeholder == nil {
+		placeholder = QuestionPlaceholder
+	}
+	return &SQLDedupStore{db: db, table: table, placeholder: placeholder}
+}
+
+// Claim store key for ttl if key is not stored or expired
+// Expired key is removed and key is inserted only when absent. Concurrent insert of the same key
+// fails on primary key and error nacks delivery with requeue
+func (s *SQLDedupStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	var result sql.Result
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE message_key = %s AND expires_at <= %s", s.table, s.placeholder(1), s.placeholder(2)), key, now)
+	if err == nil {
+		query := fmt.Sprintf("INSERT INTO %s (message_key, expires_at) SELECT %s, %s WHERE NOT EXISTS (SELECT 1 FROM %s WHERE message_key = %s)",
+			s.table, s.placeholder(1), s.placeholder(2), s.table, s.placeholder(3))
+		result, err = tx.ExecContext(ctx, query, key, now.Add(ttl), key)
+	}
+	var n int64
+	if err == nil {
+		n, err = result.RowsAffected()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// Release remove key
+func (s *SQLDedupStore) Release(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE message_key = %s", s.table, s.placeholder(1)), key)
+	return err
+}
+
+// Cleanup remove expired keys
+func (s *SQLDedupStore) Cleanup(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE expires_at <= %s", s.table, s.placeholder(1)), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,272 @@
+package gorabbit
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Metrics counting duplicates
+type duplicateMetrics struct {
+	NopMetrics
+	duplicates int
+}
+
+func (m *duplicateMetrics) DeliveryDuplicate(l Labels) {
+	m.duplicates++
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryDedupStore(2)
+	_, _ = s.Claim(ctx, "a", time.Minute)
+	_, _ = s.Claim(ctx, "b", time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+	if ok, _ := s.Claim(ctx, "b", time.Millisecond); !ok {
+		t.Fatal("expired key must be claimed again")
+	}
+	// a is used and b is evicted as least recently used
+	if ok, _ := s.Claim(ctx, "a", time.Minute); ok {
+		t.Fatal("stored key must not be claimed")
+	}
+	_, _ = s.Claim(ctx, "c", time.Minute)
+	if ok, _ := s.Claim(ctx, "b", time.Minute); !ok || s.Len() != 2 {
+		t.Fatal("least recently used key must be evicted")
+	}
+	_ = s.Release(ctx, "c")
+	if ok, _ := s.Claim(ctx, "c", time.Minute); !ok {
+		t.Fatal("released key must be claimed again")
+	}
+}
+
+func TestDedupMiddleware(t *testing.T) {
+	m := &duplicateMetrics{}
+	calls := 0
+	fail := true
+	h := Chain(func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		calls++
+		if fail {
+			fail = false
+			return porterr.New(porterr.PortErrorSystem, "failed")
+		}
+		return nil
+	}, DedupMiddleware(NewMemoryDedupStore(0), "x-key", 0, m))
+	ctx := ContextWithConsumerInfo(context.Background(), ConsumerInfo{Queue: "a"})
+	d := amqp.Delivery{MessageId: "id", Headers: amqp.Table{"x-key": 1}}
+	if e := h(ctx, d); e == nil {
+		t.Fatal("handler error must be returned")
+	}
+	// Key of failed delivery is released
+	for i := 0; i < 3; i++ {
+		if e := h(ctx, d); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if calls != 2 || m.duplicates != 2 {
+		t.Fatalf("duplicates must not be processed: calls %v, duplicates %v", calls, m.duplicates)
+	}
+	// Key is scoped by queue
+	_ = h(ContextWithConsumerInfo(context.Background(), ConsumerInfo{Queue: "b"}), d)
+	if calls != 3 {
+		t.Fatal("message of other queue must be processed")
+	}
+	// Delivery without key is processed
+	_ = h(ctx, amqp.Delivery{MessageId: "id"})
+	if calls != 4 || DedupKey(d, "") != "id" || DedupKey(d, "x-key") != "1" {
+		t.Fatal("wrong dedup key")
+	}
+}
+
+func TestDedupMiddleware_Concurrent(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	h := Chain(func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	}, DedupMiddleware(NewMemoryDedupStore(0), "", 0, NopMetrics{}))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = h(context.Background(), amqp.Delivery{MessageId: "id"})
+		}()
+	}
+	time.Sleep(time.Millisecond * 20)
+	close(release)
+	wg.Wait()
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("concurrent duplicates must be processed once, got %v", calls)
+	}
+}
+
+// Table of fake sql driver with primary key on message_key
+type dedupTable struct {
+	m    sync.Mutex
+	name string
+	rows map[string]time.Time
+}
+
+// Insert key with expiration unless key is stored
+// Arguments are inserted key, expiration and key checked for absence
+func (t *dedupTable) insert(args []driver.Value) (driver.Result, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("insert expects 3 arguments, got %d", len(args))
+	}
+	key, ok := args[0].(string)
+	if !ok || args[2] != args[0] {
+		return nil, fmt.Errorf("inserted key %v differs from checked key %v", args[0], args[2])
+	}
+	expires, ok := args[1].(time.Time)
+	if !ok || expires.Location() != time.UTC {
+		return nil, fmt.Errorf("expiration must be utc time, got %v", args[1])
+	}
+	if _, ok = t.rows[key]; ok {
+		return driver.RowsAffected(0), nil
+	}
+	t.rows[key] = expires
+	return driver.RowsAffected(1), nil
+}
+
+// Delete rows by key and by expiration. Key goes before expiration in arguments
+func (t *dedupTable) delete(byKey, byExpiration bool, args []driver.Value) (driver.Result, error) {
+	var key string
+	var now time.Time
+	var ok bool
+	if byKey {
+		if key, ok = args[0].(string); !ok {
+			return nil, fmt.Errorf("key must be string, got %v", args[0])
+		}
+	}
+	if byExpiration {
+		if now, ok = args[len(args)-1].(time.Time); !ok || now.Location() != time.UTC {
+			return nil, fmt.Errorf("expiration must be utc time, got %v", args[len(args)-1])
+		}
+	}
+	var n int64
+	for k, expires := range t.rows {
+		if (!byKey || k == key) && (!byExpiration || !expires.After(now)) {
+			delete(t.rows, k)
+			n++
+		}
+	}
+	return driver.RowsAffected(n), nil
+}
+
+// Connector of fake sql driver
+type dedupConnector struct {
+	table *dedupTable
+}
+
+func (c dedupConnector) Connect(ctx context.Context) (driver.Conn, error) { return dedupConn(c), nil }
+func (c dedupConnector) Driver() driver.Driver                            { return dedupDriver(c) }
+
+// Fake sql driver executing statements on table
+type dedupDriver dedupConnector
+
+func (d dedupDriver) Open(name string) (driver.Conn, error) { return dedupConn(d), nil }
+
+type dedupConn dedupConnector
+
+func (c dedupConn) Prepare(query string) (driver.Stmt, error) {
+	return dedupStmt{table: c.table, query: query}, nil
+}
+func (c dedupConn) Close() error              { return nil }
+func (c dedupConn) Begin() (driver.Tx, error) { return c, nil }
+func (c dedupConn) Commit() error             { return nil }
+func (c dedupConn) Rollback() error           { return nil }
+
+type dedupStmt struct {
+	table *dedupTable
+	query string
+}
+
+func (s dedupStmt) Close() error  { return nil }
+func (s dedupStmt) NumInput() int { return -1 }
+
+// Statement is recognized by kind, table and conditions
+func (s dedupStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if n := strings.Count(s.query, "?") + strings.Count(s.query, "$"); n != len(args) {
+		return nil, fmt.Errorf("query has %d placeholders for %d arguments", n, len(args))
+	}
+	s.table.m.Lock()
+	defer s.table.m.Unlock()
+	fields := strings.Fields(s.query)
+	if len(fields) < 3 || fields[2] != s.table.name {
+		return nil, errors.New("unexpected query " + s.query)
+	}
+	switch fields[0] {
+	case "INSERT":
+		return s.table.insert(args)
+	case "DELETE":
+		return s.table.delete(strings.Contains(s.query, "message_key ="), strings.Contains(s.query, "expires_at <="), args)
+	}
+	return nil, errors.New("unexpected query " + s.query)
+}
+
+func (s dedupStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("unexpected query " + s.query)
+}
+
+func TestSQLDedupStore(t *testing.T) {
+	for _, tc := range []struct {
+		table       string
+		placeholder func(n int) string
+	}{
+		{table: "", placeholder: DollarPlaceholder},
+		{table: "events_dedup", placeholder: nil},
+	} {
+		table := &dedupTable{name: tc.table, rows: make(map[string]time.Time)}
+		if table.name == "" {
+			table.name = DefaultDedupTable
+		}
+		db := sql.OpenDB(dedupConnector{table: table})
+		ctx := context.Background()
+		s := NewSQLDedupStore(db, tc.table, tc.placeholder)
+		if ok, err := s.Claim(ctx, "a", time.Minute); !ok || err != nil {
+			t.Fatal("key must be claimed", err)
+		}
+		stored := table.rows["a"]
+		if d := time.Until(stored); d <= 0 || d > time.Minute {
+			t.Fatalf("wrong expiration of key %v", stored)
+		}
+		// Stored key is not overwritten
+		if ok, err := s.Claim(ctx, "a", time.Hour); ok || err != nil {
+			t.Fatal("stored key must not be claimed", err)
+		}
+		if !table.rows["a"].Equal(stored) {
+			t.Fatal("expiration of stored key must not be changed")
+		}
+		if err := s.Release(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := s.Claim(ctx, "a", time.Minute); !ok {
+			t.Fatal("released key must be claimed again")
+		}
+		// Expired key is replaced
+		if ok, err := s.Claim(ctx, "b", -time.Minute); !ok || err != nil {
+			t.Fatal("key must be claimed", err)
+		}
+		if ok, _ := s.Claim(ctx, "b", -time.Minute); !ok {
+			t.Fatal("expired key must be claimed again")
+		}
+		if n, err := s.Cleanup(ctx); n != 1 || err != nil {
+			t.Fatalf("expired key must be removed %v %v", n, err)
+		}
+		if _, ok := table.rows["a"]; !ok || len(table.rows) != 1 {
+			t.Fatal("only expired keys must be removed")
+		}
+		_ = db.Close()
+	}
+}
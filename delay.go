@@ -0,0 +1,149 @@
+package gorabbit
+
+import (
+	"context"
+	"fmt"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"math"
+	"time"
+)
+
+const (
+	// PublishErrorDelay Delay is not supported by strategy or config of queue
+	PublishErrorDelay = "GORABBIT_PUBLISH_DELAY"
+
+	// ExchangeDelayed Type of exchange of x-delayed-message plugin
+	// Routing type of exchange is defined by x-delayed-type argument
+	ExchangeDelayed = "x-delayed-message"
+	// HeaderDelay Header with delay in milliseconds for x-delayed-message plugin
+	HeaderDelay = "x-delay"
+
+	// MaxDelayQueue Max delay of DelayQueue strategy. Limit of x-message-ttl argument
+	MaxDelayQueue = time.Duration(math.MaxUint32) * time.Millisecond
+	// DelayQueueExpires Time of keeping unused delay queue after its delay
+	// Delay queue is declared again when half of this time is passed since last declare
+	DelayQueueExpires = time.Minute
+)
+
+// DelayStrategy Strategy of delayed publishing
+type DelayStrategy string
+
+const (
+	// DelayPlugin Message is published to exchange of x-delayed-message plugin with x-delay header
+	DelayPlugin DelayStrategy = "plugin"
+	// DelayQueue Message waits in delay queue with TTL equal to delay and is dead-lettered to exchange of queue
+	DelayQueue DelayStrategy = "queue"
+)
+
+// PublishDelayed Publish message delivered to queue after delay
+// Strategy is defined by Delay of queue config. Not positive delay publishes message immediately
+// DelayPlugin requires exchange of queue with type x-delayed-message
+// DelayQueue declares delay queues <queue>.delay.<ms>[.<routing key>] with TTL equal to delay
+// and dead-letter exchange of queue. All messages of delay queue have the same TTL,
+// so messages expire in order of publishing without waiting for messages with longer delay
+// Unused delay queue is deleted by server after delay and DelayQueueExpires
+func (a *Application) PublishDelayed(ctx context.Context, p amqp.Publishing, delay time.Duration, queue string, server string, route ...string) porterr.IError {
+	return a.publish(ctx, p, delay, queue, server, route...)
+}
+
+// Strategy of delayed publishing. Empty means DelayPlugin
+func (q *RabbitQueue) delayStrategy() DelayStrategy {
+	if q.Delay == "" {
+		return DelayPlugin
+	}
+	return q.Delay
+}
+
+// Validate delay options of queue and delay
+func (q *RabbitQueue) validateDelay(delay time.Duration) porterr.IError {
+	switch q.delayStrategy() {
+	case DelayPlugin:
+		if q.Type != ExchangeDelayed {
+			return porterr.NewF(PublishErrorDelay, "Exchange type of queue '%s' must be %s for delay plugin", q.Name, ExchangeDelayed)
+		}
+	case DelayQueue:
+		if q.Exchange == "" {
+			return porterr.NewF(PublishErrorDelay, "Exchange of queue '%s' is required for delay queue", q.Name)
+		}
+		if delay > MaxDelayQueue {
+			return porterr.NewF(PublishErrorDelay, "Delay %s of queue '%s' exceeds max delay %s", delay, q.Name, MaxDelayQueue)
+		}
+	default:
+		return porterr.NewF(PublishErrorDelay, "Unknown delay strategy '%s' of queue '%s'", q.Delay, q.Name)
+	}
+	return nil
+}
+
+// Name of delay queue of delay for routing key
+func (q *RabbitQueue) delayQueue(delay time.Duration, key string) string {
+	name := fmt.Sprintf("%s.delay.%d", q.Name, delay.Milliseconds())
+	if key != "" {
+		name += "." + key
+	}
+	return name
+}
+
+// Declare delay queues of delay for routing keys on server
+// Queue is declared again when half of DelayQueueExpires is passed since last declare,
+// so queue is not expired while it keeps published messages
+// Expired messages are dead-lettered to exchange of queue with routing key
+// Declare is done without lock, so publishers of different queues do not wait for each other.
+// Concurrent publishers may declare the same queue twice with the same arguments
+func (a *Application) declareDelayQueues(ctx context.Context, cp *ConnectionPool, server string, q *RabbitQueue, delay time.Duration, route []string) porterr.IError {
+	keys := make([]string, 0, len(route))
+	a.dm.Lock()
+	for _, key := range route {
+		if at, ok := a.delayQueues[server+"/"+q.delayQueue(delay, key)]; !ok || time.Since(at) >= DelayQueueExpires/2 {
+			keys = append(keys, key)
+		}
+	}
+	a.dm.Unlock()
+	if len(keys) == 0 {
+		return nil
+	}
+	conn, e := cp.Acquire(ctx)
+	if e != nil {
+		return e
+	}
+	defer cp.Release(conn)
+	for _, key := range keys {
+		name := q.delayQueue(delay, key)
+		args := amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-expires":                 (delay + DelayQueueExpires).Milliseconds(),
+			"x-dead-letter-exchange":    q.Exchange,
+			"x-dead-letter-routing-key": key,
+		}
+		if _, err := conn.channel.QueueDeclare(name, q.Durable, false, false, false, args); err != nil {
+			return porterr.NewF(porterr.PortErrorProducer, "Failed to declare delay queue '%s': %s", name, err.Error())
+		}
+		a.dm.Lock()
+		if a.delayQueues == nil {
+			a.delayQueues = make(map[string]time.Time)
+		}
+		a.delayQueues[server+"/"+name] = time.Now()
+		a.dm.Unlock()
+	}
+	return nil
+}
+
+// Prepare delayed message and get queue config and routing keys for publishing
+func (a *Application) delayMessage(ctx context.Context, cp *ConnectionPool, server string, q *RabbitQueue, delay time.Duration, m *PublishMessage) (RabbitQueue, []string, porterr.IError) {
+	if q.delayStrategy() == DelayPlugin {
+		m.Publishing.Headers[HeaderDelay] = delay.Milliseconds()
+		return *q, m.Route, nil
+	}
+	if e := a.declareDelayQueues(ctx, cp, server, q, delay, m.Route); e != nil {
+		return *q, nil, e
+	}
+	// Default exchange routes message by name of delay queue
+	target := *q
+	target.Exchange = ""
+	target.Mandatory = false
+	route := make([]string, 0, len(m.Route))
+	for _, key := range m.Route {
+		route = append(route, q.delayQueue(delay, key))
+	}
+	return target, route, nil
+}
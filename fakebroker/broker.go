@@ -0,0 +1,616 @@
+// Package fakebroker In-memory AMQP broker for unit testing consumers and publishers without RabbitMQ server
+package fakebroker
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Broker in-memory broker
+type Broker struct {
+	// Lock for whole broker state
+	m sync.Mutex
+	// Declared exchanges
+	exchanges map[string]*exchange
+	// Declared queues
+	queues map[string]*queue
+	// Open connections
+	connections map[*Connection]struct{}
+	// Sequence for generated names
+	sequence uint64
+	// Negative confirm for all publishing
+	nackPublish bool
+	// Routing keys of next publishing failed with channel close
+	failPublish map[string]bool
+	// Dial error
+	dialErr error
+}
+
+// Exchange
+type exchange struct {
+	// Name of exchange
+	name string
+	// Type of exchange
+	kind string
+	// Exchange arguments
+	args amqp.Table
+	// Queue bindings
+	bindings []*binding
+}
+
+// Binding of queue to exchange
+type binding struct {
+	// Bound queue
+	queue *queue
+	// Routing key
+	key string
+	// Binding arguments. Used by headers exchange
+	args amqp.Table
+}
+
+// Queue
+type queue struct {
+	// Name of queue
+	name string
+	// Queue arguments
+	args amqp.Table
+	// Owner connection of exclusive queue
+	owner *Connection
+	// Ready messages
+	messages []*message
+	// Messages of stream queue. Stream messages are kept after delivery
+	log []*message
+	// Subscribed consumers
+	consumers []*consumer
+	// Round-robin cursor
+	cursor int
+}
+
+// Message in queue
+type message struct {
+	// Exchange message was published to
+	exchange string
+	// Routing key message was published with
+	key string
+	// Message properties and body
+	publishing amqp.Publishing
+	// Message was delivered before
+	redelivered bool
+	// Count of returns of message to quorum queue
+	deliveryCount int64
+	// Offset of message in stream
+	offset int64
+	// Time of appending to stream
+	at time.Time
+}
+
+// New Create broker with predeclared default and amq.* exchanges
+func New() *Broker {
+	b := &Broker{
+		exchanges:   make(map[string]*exchange),
+		queues:      make(map[string]*queue),
+		connections: make(map[*Connection]struct{}),
+	}
+	for name, kind := range map[string]string{
+		"":            amqp.ExchangeDirect,
+		"amq.direct":  amqp.ExchangeDirect,
+		"amq.fanout":  amqp.ExchangeFanout,
+		"amq.topic":   amqp.ExchangeTopic,
+		"amq.headers": amqp.ExchangeHeaders,
+		"amq.match":   amqp.ExchangeHeaders,
+	} {
+		b.exchanges[name] = &exchange{name: name, kind: kind}
+	}
+	return b
+}
+
+// Dial Open connection to broker. Implements gorabbit.Dialer
+func (b *Broker) Dial(url string) (gorabbit.Connection, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.dialErr != nil {
+		return nil, b.dialErr
+	}
+	c := &Connection{
+		broker:   b,
+		channels: make(map[*Channel]struct{}),
+	}
+	b.connections[c] = struct{}{}
+	return c, nil
+}
+
+// FailDial All next dials return err. Nil restores dialing
+func (b *Broker) FailDial(err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.dialErr = err
+}
+
+// NackPublishes Confirm all next publishing negatively
+func (b *Broker) NackPublishes(nack bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.nackPublish = nack
+}
+
+// FailPublish Close channel with internal error on next publishing with routing key
+func (b *Broker) FailPublish(key string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.failPublish == nil {
+		b.failPublish = make(map[string]bool)
+	}
+	b.failPublish[key] = true
+}
+
+// CloseConnections Close all connections as server does on forced shutdown
+func (b *Broker) CloseConnections(reason string) {
+	b.m.Lock()
+	var notify []func()
+	for c := range b.connections {
+		notify = append(notify, c.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: reason, Server: true}))
+	}
+	b.m.Unlock()
+	for _, n := range notify {
+		n()
+	}
+}
+
+// Connections count of open connections
+func (b *Broker) Connections() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return len(b.connections)
+}
+
+// Publish message to exchange as an external publisher
+func (b *Broker) Publish(exchange, key string, msg amqp.Publishing) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	queues, e := b.route(exchange, key, msg.Headers)
+	if e != nil {
+		return e
+	}
+	if b.delay(exchange, key, msg) {
+		return nil
+	}
+	for _, q := range queues {
+		b.enqueue(q, &message{exchange: exchange, key: key, publishing: msg})
+	}
+	return nil
+}
+
+// QueueLength count of ready messages in queue. Count of all messages for stream queue
+func (b *Broker) QueueLength(name string) int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if q, ok := b.queues[name]; ok {
+		if q.isStream() {
+			return len(q.log)
+		}
+		return len(q.messages)
+	}
+	return 0
+}
+
+// Unacked count of delivered but not acknowledged messages of queue
+func (b *Broker) Unacked(name string) (n int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for c := range b.connections {
+		for ch := range c.channels {
+			for _, d := range ch.unacked {
+				if d.queue.name == name {
+					n++
+				}
+			}
+		}
+	}
+	return
+}
+
+// Consumers count of consumers subscribed to queue
+func (b *Broker) Consumers(name string) int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if q, ok := b.queues[name]; ok {
+		return len(q.consumers)
+	}
+	return 0
+}
+
+// ConsumerTags tags of consumers subscribed to queue
+func (b *Broker) ConsumerTags(name string) []string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return nil
+	}
+	tags := make([]string, 0, len(q.consumers))
+	for _, c := range q.consumers {
+		tags = append(tags, c.tag)
+	}
+	return tags
+}
+
+// CloseChannel Close channel of consumer with tag as server does on channel error
+// Returns false when consumer is not found
+func (b *Broker) CloseChannel(consumerTag string, reason string) bool {
+	b.m.Lock()
+	for _, q := range b.queues {
+		for _, c := range q.consumers {
+			if c.tag == consumerTag {
+				notify := c.channel.shutdown(&amqp.Error{Code: amqp.PreconditionFailed, Reason: reason, Server: true})
+				b.m.Unlock()
+				notify()
+				return true
+			}
+		}
+	}
+	b.m.Unlock()
+	return false
+}
+
+// Generate unique name. Must be called under lock
+func (b *Broker) generateName(prefix string) string {
+	b.sequence++
+	return fmt.Sprintf("%s-%d", prefix, b.sequence)
+}
+
+// Find queues for message. Must be called under lock
+func (b *Broker) route(exchangeName, key string, headers amqp.Table) ([]*queue, *amqp.Error) {
+	ex, ok := b.exchanges[exchangeName]
+	if !ok {
+		return nil, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchangeName), Server: true}
+	}
+	// Default exchange routes by queue name
+	if ex.name == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*queue{q}, nil
+		}
+		return nil, nil
+	}
+	var result []*queue
+	var seen = make(map[*queue]struct{})
+	for _, bd := range ex.bindings {
+		if _, ok := seen[bd.queue]; ok {
+			continue
+		}
+		if match(ex.routingKind(), bd, key, headers) {
+			seen[bd.queue] = struct{}{}
+			result = append(result, bd.queue)
+		}
+	}
+	return result, nil
+}
+
+// Routing type of exchange. Delayed message exchange routes by x-delayed-type argument
+func (ex *exchange) routingKind() string {
+	if ex.kind == gorabbit.ExchangeDelayed {
+		kind, _ := ex.args["x-delayed-type"].(string)
+		return kind
+	}
+	return ex.kind
+}
+
+// Route message of delayed message exchange with positive x-delay header after delay. Must be called under lock
+func (b *Broker) delay(exchangeName, key string, msg amqp.Publishing) bool {
+	ex, ok := b.exchanges[exchangeName]
+	if !ok || ex.kind != gorabbit.ExchangeDelayed {
+		return false
+	}
+	delay, ok := millis(msg.Headers[gorabbit.HeaderDelay])
+	if !ok || delay <= 0 {
+		return false
+	}
+	time.AfterFunc(delay, func() {
+		b.m.Lock()
+		defer b.m.Unlock()
+		queues, _ := b.route(exchangeName, key, msg.Headers)
+		for _, q := range queues {
+			b.enqueue(q, &message{exchange: exchangeName, key: key, publishing: msg})
+		}
+	})
+	return true
+}
+
+// Convert numeric argument or header to integer
+func number(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// Convert number of milliseconds from argument, header or expiration to duration
+func millis(v interface{}) (time.Duration, bool) {
+	ms, ok := number(v)
+	if s, isString := v.(string); isString {
+		var err error
+		ms, err = strconv.ParseInt(s, 10, 64)
+		ok = err == nil
+	}
+	return time.Duration(ms) * time.Millisecond, ok
+}
+
+// Check if binding match routing key or headers
+func match(kind string, bd *binding, key string, headers amqp.Table) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return matchTopic(strings.Split(bd.key, "."), strings.Split(key, "."))
+	case amqp.ExchangeHeaders:
+		return matchHeaders(bd.args, headers)
+	default:
+		return bd.key == key
+	}
+}
+
+// Match topic pattern words with routing key words
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchTopic(pattern[1:], words[1:])
+	}
+}
+
+// Match binding arguments with message headers
+func matchHeaders(args amqp.Table, headers amqp.Table) bool {
+	matchAny := args["x-match"] == "any"
+	var matched, total int
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		total++
+		if hv, ok := headers[k]; ok && reflect.DeepEqual(hv, v) {
+			matched++
+		}
+	}
+	if matchAny {
+		return matched > 0
+	}
+	return matched == total
+}
+
+// Put message into queue and dispatch. Must be called under lock
+func (b *Broker) enqueue(q *queue, msg *message) {
+	if q.isStream() {
+		msg.offset, msg.at = int64(len(q.log)), time.Now()
+		q.log = append(q.log, msg)
+		b.dispatch(q)
+		return
+	}
+	q.messages = append(q.messages, msg)
+	b.expire(q, msg)
+	b.dispatch(q)
+}
+
+// Dead-letter ready message after x-message-ttl of queue or expiration of message. Must be called under lock
+func (b *Broker) expire(q *queue, msg *message) {
+	ttl, ok := millis(q.args["x-message-ttl"])
+	if expiration, set := millis(msg.publishing.Expiration); set && (!ok || expiration < ttl) {
+		ttl, ok = expiration, true
+	}
+	if !ok {
+		return
+	}
+	time.AfterFunc(ttl, func() {
+		b.m.Lock()
+		defer b.m.Unlock()
+		if b.queues[q.name] != q {
+			return
+		}
+		for i, m := range q.messages {
+			if m == msg {
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				b.deadLetter(q, msg, "expired")
+				return
+			}
+		}
+	})
+}
+
+// Put messages back to head of queue. Must be called under lock
+// Stream messages are not removed on delivery and never requeued
+// Quorum queue counts returns and dead-letters message when count exceeds x-delivery-limit
+func (b *Broker) requeue(q *queue, msgs ...*message) {
+	if q.isStream() {
+		b.dispatch(q)
+		return
+	}
+	limit, limited := number(q.args["x-delivery-limit"])
+	returned := make([]*message, 0, len(msgs))
+	for _, msg := range msgs {
+		msg.redelivered = true
+		if q.isQuorum() {
+			msg.deliveryCount++
+			if limited && msg.deliveryCount > limit {
+				b.deadLetter(q, msg, "delivery_limit")
+				continue
+			}
+		}
+		returned = append(returned, msg)
+	}
+	q.messages = append(returned, q.messages...)
+	b.dispatch(q)
+}
+
+// Route rejected message to dead letter exchange. Must be called under lock
+func (b *Broker) deadLetter(q *queue, msg *message, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok || q.isStream() {
+		return
+	}
+	key := msg.key
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+	p := msg.publishing
+	headers := make(amqp.Table, len(p.Headers)+1)
+	for k, v := range p.Headers {
+		headers[k] = v
+	}
+	death := amqp.Table{
+		"queue":        q.name,
+		"reason":       reason,
+		"count":        int64(1),
+		"exchange":     msg.exchange,
+		"routing-keys": []interface{}{msg.key},
+		"time":         time.Now(),
+	}
+	if history, ok := headers["x-death"].([]interface{}); ok {
+		headers["x-death"] = append([]interface{}{death}, history...)
+	} else {
+		headers["x-death"] = []interface{}{death}
+	}
+	p.Headers = headers
+	// Expiration is removed on dead-lettering
+	p.Expiration = ""
+	queues, _ := b.route(dlx, key, p.Headers)
+	for _, target := range queues {
+		b.enqueue(target, &message{exchange: dlx, key: key, publishing: p})
+	}
+}
+
+// Deliver ready messages to consumers with free capacity. Must be called under lock
+// Every consumer of stream receives all messages from own offset
+func (b *Broker) dispatch(q *queue) {
+	if q.isStream() {
+		for _, c := range q.consumers {
+			for c.offset < len(q.log) && c.hasCapacity() {
+				c.offset++
+				c.deliver(q.log[c.offset-1])
+			}
+		}
+		return
+	}
+	for len(q.messages) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		c.deliver(msg)
+	}
+}
+
+// Check if queue is declared as stream
+func (q *queue) isStream() bool {
+	return q.args["x-queue-type"] == gorabbit.QueueTypeStream
+}
+
+// Check if queue is declared as quorum
+func (q *queue) isQuorum() bool {
+	return q.args["x-queue-type"] == gorabbit.QueueTypeQuorum
+}
+
+// Index of first stream message at x-stream-offset consumer argument. Must be called under lock
+func (q *queue) streamStart(arg interface{}) (int, bool) {
+	switch v := arg.(type) {
+	case nil:
+		return len(q.log), true
+	case string:
+		switch v {
+		case "first":
+			return 0, true
+		case "last":
+			if len(q.log) > 0 {
+				return len(q.log) - 1, true
+			}
+			return 0, true
+		case "next":
+			return len(q.log), true
+		}
+	case time.Time:
+		for i, msg := range q.log {
+			if !msg.at.Before(v) {
+				return i, true
+			}
+		}
+		return len(q.log), true
+	default:
+		if offset, ok := number(v); ok {
+			n := int(offset)
+			if n < 0 {
+				n = 0
+			}
+			if n > len(q.log) {
+				n = len(q.log)
+			}
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// Next consumer using round-robin. Must be called under lock
+func (q *queue) nextConsumer() *consumer {
+	for i := 0; i < len(q.consumers); i++ {
+		q.cursor = (q.cursor + 1) % len(q.consumers)
+		c := q.consumers[q.cursor]
+		if c.hasCapacity() {
+			return c
+		}
+	}
+	return nil
+}
+
+// Remove consumer from queue. Must be called under lock
+func (q *queue) removeConsumer(c *consumer) {
+	for i := range q.consumers {
+		if q.consumers[i] == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Delete queue and its bindings. Must be called under lock
+func (b *Broker) deleteQueue(q *queue) {
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, bd := range ex.bindings {
+			if bd.queue != q {
+				bindings = append(bindings, bd)
+			}
+		}
+		ex.bindings = bindings
+	}
+	for _, c := range q.consumers {
+		c.cancel()
+	}
+	q.consumers = nil
+}
@@ -0,0 +1,410 @@
+package fakebroker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func testChannel(t *testing.T, b *Broker) gorabbit.Channel {
+	conn, err := b.Dial("amqp://fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func declare(t *testing.T, ch gorabbit.Channel, queue, exchange, key string, args amqp.Table) {
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind(queue, key, exchange, false, args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("delivery timeout")
+	}
+	return amqp.Delivery{}
+}
+
+func TestBroker_Routing(t *testing.T) {
+	b := New()
+	ch := testChannel(t, b)
+	if err := ch.ExchangeDeclare("events", amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	declare(t, ch, "direct", "amq.direct", "key", nil)
+	declare(t, ch, "fanout", "amq.fanout", "", nil)
+	declare(t, ch, "topic.star", "events", "order.*", nil)
+	declare(t, ch, "topic.hash", "events", "#.created", nil)
+	declare(t, ch, "headers.all", "amq.headers", "", amqp.Table{"x-match": "all", "type": "a", "tenant": "t1"})
+	declare(t, ch, "headers.any", "amq.headers", "", amqp.Table{"x-match": "any", "type": "a", "tenant": "t1"})
+
+	publish := func(exchange, key string, headers amqp.Table) {
+		if err := ch.Publish(exchange, key, false, false, amqp.Publishing{Headers: headers}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("amq.direct", "key", nil)
+	publish("amq.direct", "other", nil)
+	publish("amq.fanout", "any", nil)
+	publish("events", "order.created", nil)
+	publish("events", "order.item.created", nil)
+	publish("events", "order.deleted", nil)
+	publish("amq.headers", "", amqp.Table{"type": "a", "tenant": "t1"})
+	publish("amq.headers", "", amqp.Table{"type": "a", "tenant": "t2"})
+	publish("", "direct", nil)
+
+	for name, expected := range map[string]int{
+		"direct":      2,
+		"fanout":      1,
+		"topic.star":  2,
+		"topic.hash":  2,
+		"headers.all": 1,
+		"headers.any": 2,
+	} {
+		if l := b.QueueLength(name); l != expected {
+			t.Errorf("queue %s has %v messages, expected %v", name, l, expected)
+		}
+	}
+}
+
+func TestBroker_AckNackPrefetch(t *testing.T) {
+	b := New()
+	ch := testChannel(t, b)
+	declare(t, ch, "q", "amq.direct", "q", nil)
+	for i := 0; i < 3; i++ {
+		_ = b.Publish("amq.direct", "q", amqp.Publishing{Body: []byte{byte(i)}})
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume("q", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, deliveries)
+	if b.Unacked("q") != 1 || b.QueueLength("q") != 2 {
+		t.Fatal("prefetch must limit unacked messages")
+	}
+	if err = d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	d = receive(t, deliveries)
+	if !d.Redelivered || d.Body[0] != 0 {
+		t.Fatal("requeued message must be redelivered first")
+	}
+	if err = d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	d = receive(t, deliveries)
+	if err = d.Reject(false); err != nil {
+		t.Fatal(err)
+	}
+	d = receive(t, deliveries)
+	if err = d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	if b.Unacked("q") != 0 || b.QueueLength("q") != 0 {
+		t.Fatal("queue must be empty")
+	}
+	// Unknown delivery tag closes channel
+	if err = d.Ack(false); err == nil || !ch.IsClosed() {
+		t.Fatal("double ack must close channel")
+	}
+}
+
+func TestBroker_DeadLetter(t *testing.T) {
+	b := New()
+	ch := testChannel(t, b)
+	declare(t, ch, "dead", "amq.direct", "dead", nil)
+	if _, err := ch.QueueDeclare("work", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "amq.direct", "x-dead-letter-routing-key": "dead"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = b.Publish("", "work", amqp.Publishing{Body: []byte("x")})
+	deliveries, _ := ch.Consume("work", "", false, false, false, false, nil)
+	d := receive(t, deliveries)
+	_ = d.Nack(false, false)
+	if b.QueueLength("dead") != 1 {
+		t.Fatal("rejected message must be dead-lettered")
+	}
+}
+
+func TestBroker_GetPurge(t *testing.T) {
+	b := New()
+	ch := testChannel(t, b)
+	declare(t, ch, "q", "amq.direct", "q", nil)
+	for i := 0; i < 3; i++ {
+		_ = b.Publish("amq.direct", "q", amqp.Publishing{Body: []byte{byte(i)}})
+	}
+	if q, err := ch.QueueDeclarePassive("q", true, false, false, false, nil); err != nil || q.Messages != 3 {
+		t.Fatalf("wrong passive declare %v %v", q, err)
+	}
+	first, ok, err := ch.Get("q", false)
+	if err != nil || !ok || first.Body[0] != 0 || first.MessageCount != 2 {
+		t.Fatalf("wrong get %v %v %v", first, ok, err)
+	}
+	second, _, _ := ch.Get("q", false)
+	if b.Unacked("q") != 2 || b.QueueLength("q") != 1 {
+		t.Fatal("got messages must be unacked")
+	}
+	if err = second.Nack(true, true); err != nil {
+		t.Fatal(err)
+	}
+	d, _, _ := ch.Get("q", true)
+	if !d.Redelivered || d.Body[0] != 0 {
+		t.Fatal("requeued messages must keep order")
+	}
+	if n, err := ch.QueuePurge("q", false); err != nil || n != 2 {
+		t.Fatalf("wrong purge %v %v", n, err)
+	}
+	if _, ok, _ = ch.Get("q", false); ok {
+		t.Fatal("queue must be empty")
+	}
+	if _, err = ch.QueueDeclarePassive("unknown", true, false, false, false, nil); err == nil || !ch.IsClosed() {
+		t.Fatal("passive declare of unknown queue must close channel")
+	}
+}
+
+func TestBroker_ConfirmsAndReturns(t *testing.T) {
+	b := New()
+	ch := testChannel(t, b)
+	declare(t, ch, "q", "amq.direct", "q", nil)
+	_ = ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 3))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	if seq := ch.GetNextPublishSeqNo(); seq != 1 {
+		t.Fatalf("next sequence must be 1, got %v", seq)
+	}
+	_ = ch.Publish("amq.direct", "q", true, false, amqp.Publishing{})
+	_ = ch.Publish("amq.direct", "unroutable", true, false, amqp.Publishing{})
+	b.NackPublishes(true)
+	_ = ch.Publish("amq.direct", "q", false, false, amqp.Publishing{})
+	for i, ack := range []bool{true, true, false} {
+		c := <-confirms
+		if c.DeliveryTag != uint64(i+1) || c.Ack != ack {
+			t.Fatalf("wrong confirmation %v", c)
+		}
+	}
+	r := <-returns
+	if r.RoutingKey != "unroutable" || r.ReplyCode != amqp.NoRoute {
+		t.Fatalf("wrong return %v", r)
+	}
+}
+
+func TestBroker_CloseNotification(t *testing.T) {
+	b := New()
+	conn, _ := b.Dial("amqp://fake")
+	ch, _ := conn.Channel()
+	declare(t, ch, "q", "amq.direct", "q", nil)
+	_ = b.Publish("amq.direct", "q", amqp.Publishing{})
+	deliveries, _ := ch.Consume("q", "", false, false, false, false, nil)
+	receive(t, deliveries)
+	connClose := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClose := ch.NotifyClose(make(chan *amqp.Error, 1))
+	b.CloseConnections("test")
+	if err := <-chClose; err == nil || err.Code != amqp.ConnectionForced {
+		t.Fatal("channel must be notified with error")
+	}
+	if err := <-connClose; err == nil || err.Code != amqp.ConnectionForced {
+		t.Fatal("connection must be notified with error")
+	}
+	if _, ok := <-deliveries; ok {
+		t.Fatal("deliveries must be closed")
+	}
+	if b.QueueLength("q") != 1 {
+		t.Fatal("unacked message must be requeued")
+	}
+	if b.Connections() != 0 {
+		t.Fatal("connection must be removed")
+	}
+}
+
+func TestBroker_CloseChannel(t *testing.T) {
+	b := New()
+	conn, _ := b.Dial("amqp://fake")
+	first, _ := conn.Channel()
+	second, _ := conn.Channel()
+	declare(t, first, "q", "amq.direct", "q", nil)
+	_, _ = first.Consume("q", "first", false, false, false, false, nil)
+	_, _ = second.Consume("q", "second", false, false, false, false, nil)
+	if tags := b.ConsumerTags("q"); len(tags) != 2 {
+		t.Fatalf("wrong consumer tags %v", tags)
+	}
+	chClose := first.NotifyClose(make(chan *amqp.Error, 1))
+	if !b.CloseChannel("first", "test") || b.CloseChannel("unknown", "test") {
+		t.Fatal("only channel of known consumer must be closed")
+	}
+	if err := <-chClose; err == nil || err.Code != amqp.PreconditionFailed {
+		t.Fatal("channel must be notified with error")
+	}
+	if second.IsClosed() || conn.IsClosed() || b.Consumers("q") != 1 {
+		t.Fatal("other channel and connection must stay open")
+	}
+}
+
+func TestBroker_DirectReplyTo(t *testing.T) {
+	b := New()
+	client := testChannel(t, b)
+	server := testChannel(t, b)
+	declare(t, server, "q", "amq.direct", "q", nil)
+	if err := client.Publish("amq.direct", "q", false, false, amqp.Publishing{ReplyTo: gorabbit.DirectReplyTo}); err == nil || !client.IsClosed() {
+		t.Fatal("publish without reply consumer must close channel")
+	}
+	client = testChannel(t, b)
+	replies, err := client.Consume(gorabbit.DirectReplyTo, "", true, true, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, _ := server.Consume("q", "", true, false, false, false, nil)
+	_ = client.Publish("amq.direct", "q", false, false, amqp.Publishing{ReplyTo: gorabbit.DirectReplyTo, CorrelationId: "c1"})
+	request := receive(t, requests)
+	if !strings.HasPrefix(request.ReplyTo, gorabbit.DirectReplyTo+".") {
+		t.Fatalf("reply address must be generated, got %v", request.ReplyTo)
+	}
+	_ = server.Publish("", request.ReplyTo, false, false, amqp.Publishing{CorrelationId: request.CorrelationId})
+	if reply := receive(t, replies); reply.CorrelationId != "c1" {
+		t.Fatalf("wrong reply %v", reply)
+	}
+	_ = client.Close()
+	if _, ok := <-replies; ok || b.Consumers(request.ReplyTo) != 0 {
+		t.Fatal("reply queue must be deleted with channel")
+	}
+}
+
+func TestBroker_Expiration(t *testing.T) {
+	b := New()
+	ch := testChannel(t, b)
+	if _, err := ch.QueueDeclare("delay", false, false, false, false, amqp.Table{
+		"x-message-ttl": int64(100), "x-dead-letter-exchange": "amq.direct", "x-dead-letter-routing-key": "target"}); err != nil {
+		t.Fatal(err)
+	}
+	declare(t, ch, "target", "amq.direct", "target", nil)
+	_ = ch.Publish("", "delay", false, false, amqp.Publishing{Body: []byte("ttl")})
+	_ = ch.Publish("", "delay", false, false, amqp.Publishing{Body: []byte("expiration"), Expiration: "20"})
+	deliveries, _ := ch.Consume("target", "", true, false, false, false, nil)
+	if d := receive(t, deliveries); string(d.Body) != "expiration" || d.Expiration != "" {
+		t.Fatalf("message with smaller expiration must be dead-lettered first without expiration, got %s", d.Body)
+	}
+	if d := receive(t, deliveries); string(d.Body) != "ttl" {
+		t.Fatalf("message must be dead-lettered after ttl of queue, got %s", d.Body)
+	}
+}
+
+func TestBroker_DelayedExchange(t *testing.T) {
+	b := New()
+	ch := testChannel(t, b)
+	if err := ch.ExchangeDeclare("delayed", gorabbit.ExchangeDelayed, true, false, false, false, nil); err == nil {
+		t.Fatal("delayed exchange requires x-delayed-type")
+	}
+	ch = testChannel(t, b)
+	if err := ch.ExchangeDeclare("delayed", gorabbit.ExchangeDelayed, true, false, false, false, amqp.Table{"x-delayed-type": amqp.ExchangeDirect}); err != nil {
+		t.Fatal(err)
+	}
+	declare(t, ch, "q", "delayed", "key", nil)
+	start := time.Now()
+	_ = ch.Publish("delayed", "key", true, false, amqp.Publishing{Headers: amqp.Table{gorabbit.HeaderDelay: int64(50)}})
+	if b.QueueLength("q") != 0 {
+		t.Fatal("delayed message must not be routed immediately")
+	}
+	deliveries, _ := ch.Consume("q", "", true, false, false, false, nil)
+	receive(t, deliveries)
+	if time.Since(start) < time.Millisecond*50 {
+		t.Fatal("message must be routed after delay")
+	}
+}
+
+func TestBroker_Stream(t *testing.T) {
+	b := New()
+	ch := testChannel(t, b)
+	declare(t, ch, "s", "amq.direct", "s", nil)
+	if _, err := ch.QueueDeclare("stream", true, false, false, false, amqp.Table{"x-queue-type": gorabbit.QueueTypeStream}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("stream", "s", "amq.direct", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.Consume("stream", "", false, false, false, false, nil); err == nil {
+		t.Fatal("stream consumer requires prefetch")
+	}
+	ch = testChannel(t, b)
+	_ = ch.Qos(10, 0, false)
+	for i := 0; i < 3; i++ {
+		_ = b.Publish("amq.direct", "s", amqp.Publishing{})
+	}
+	since := time.Now()
+	_ = b.Publish("amq.direct", "s", amqp.Publishing{})
+	for _, c := range []struct {
+		offset interface{}
+		first  int64
+		count  int
+	}{
+		{"first", 0, 4},
+		{int64(2), 2, 2},
+		{"last", 3, 1},
+		{since, 3, 1},
+	} {
+		deliveries, err := ch.Consume("stream", "", false, false, false, false, amqp.Table{gorabbit.HeaderStreamOffset: c.offset})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < c.count; i++ {
+			d := receive(t, deliveries)
+			if offset, _ := gorabbit.DeliveryOffset(d); offset != c.first+int64(i) {
+				t.Fatalf("wrong offset %v for start %v", offset, c.offset)
+			}
+			_ = d.Ack(false)
+		}
+	}
+	if b.QueueLength("stream") != 4 || b.QueueLength("s") != 4 {
+		t.Fatal("stream messages must be kept after ack")
+	}
+	next, _ := ch.Consume("stream", "", false, false, false, false, nil)
+	_ = b.Publish("amq.direct", "s", amqp.Publishing{})
+	if offset, _ := gorabbit.DeliveryOffset(receive(t, next)); offset != 4 {
+		t.Fatalf("next consumer must receive only new message, got %v", offset)
+	}
+}
+
+func TestBroker_DeliveryLimit(t *testing.T) {
+	b := New()
+	ch := testChannel(t, b)
+	declare(t, ch, "dead", "amq.direct", "dead", nil)
+	if _, err := ch.QueueDeclare("quorum", true, false, false, false, amqp.Table{
+		"x-queue-type":              gorabbit.QueueTypeQuorum,
+		"x-delivery-limit":          int64(2),
+		"x-dead-letter-exchange":    "amq.direct",
+		"x-dead-letter-routing-key": "dead",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_ = b.Publish("", "quorum", amqp.Publishing{Body: []byte("x")})
+	deliveries, _ := ch.Consume("quorum", "", false, false, false, false, nil)
+	for i := int64(0); i <= 2; i++ {
+		d := receive(t, deliveries)
+		if count := gorabbit.DeliveryCount(d); count != i {
+			t.Fatalf("wrong delivery count %v, expected %v", count, i)
+		}
+		_ = d.Nack(false, true)
+	}
+	if b.QueueLength("quorum") != 0 || b.QueueLength("dead") != 1 {
+		t.Fatal("message must be dead-lettered after delivery limit")
+	}
+	d, _, _ := ch.Get("dead", true)
+	if death, _ := d.Headers["x-death"].([]interface{}); len(death) != 1 || death[0].(amqp.Table)["reason"] != "delivery_limit" {
+		t.Fatalf("wrong x-death %v", d.Headers["x-death"])
+	}
+}
@@ -0,0 +1,766 @@
+package fakebroker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dimonrus/gorabbit"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Channel of in-memory broker. Implements gorabbit.Channel and amqp.Acknowledger
+type Channel struct {
+	// Broker
+	broker *Broker
+	// Owner connection
+	conn *Connection
+	// Channel is closed
+	closed bool
+	// Prefetch count per consumer
+	prefetch int
+	// Confirm mode
+	confirm bool
+	// Sequence number of last publishing
+	publishSeq uint64
+	// Last delivery tag
+	deliveryTag uint64
+	// Delivered but not acknowledged messages
+	unacked map[uint64]*delivery
+	// Consumers by tag
+	consumers map[string]*consumer
+	// Pseudo queue of direct reply-to consumer
+	replyQueue *queue
+	// Close listeners
+	closes []chan *amqp.Error
+	// Confirm listeners
+	publishes []chan amqp.Confirmation
+	// Return listeners
+	returns []chan amqp.Return
+}
+
+// Delivered message waiting for acknowledgement
+type delivery struct {
+	// Message
+	msg *message
+	// Source queue
+	queue *queue
+	// Consumer received the message. Nil for basic.get
+	consumer *consumer
+}
+
+// Release prefetch capacity of consumer. Must be called under lock
+func (d *delivery) release() {
+	if d.consumer != nil {
+		d.consumer.inflight--
+	}
+}
+
+// Consumer subscribed to queue
+type consumer struct {
+	// Consumer tag
+	tag string
+	// Source queue
+	queue *queue
+	// Owner channel
+	channel *Channel
+	// No acknowledgement required
+	autoAck bool
+	// Exclusive consumer
+	exclusive bool
+	// Count of not acknowledged deliveries
+	inflight int
+	// Index of next stream message
+	offset int
+	// Deliveries not yet received by client
+	pending []amqp.Delivery
+	// Channel returned to client
+	deliveries chan amqp.Delivery
+	// Signal about new pending delivery
+	signal chan struct{}
+	// Closed on cancel
+	done chan struct{}
+	// Closed after deliveries are closed
+	exited chan struct{}
+	// Consumer is cancelled
+	cancelled bool
+}
+
+// Check if consumer can receive one more message. Must be called under lock
+func (c *consumer) hasCapacity() bool {
+	if c.cancelled {
+		return false
+	}
+	return c.autoAck || c.channel.prefetch == 0 || c.inflight < c.channel.prefetch
+}
+
+// Assign message to consumer. Must be called under lock
+func (c *consumer) deliver(msg *message) {
+	d := c.channel.delivery(msg, c.tag)
+	if c.queue.isStream() || msg.deliveryCount > 0 {
+		headers := make(amqp.Table, len(d.Headers)+1)
+		for k, v := range d.Headers {
+			headers[k] = v
+		}
+		if c.queue.isStream() {
+			headers[gorabbit.HeaderStreamOffset] = msg.offset
+		} else {
+			headers[gorabbit.HeaderDeliveryCount] = msg.deliveryCount
+		}
+		d.Headers = headers
+	}
+	if !c.autoAck {
+		c.channel.unacked[d.DeliveryTag] = &delivery{msg: msg, queue: c.queue, consumer: c}
+		c.inflight++
+	}
+	c.pending = append(c.pending, d)
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Create delivery of message with next delivery tag. Must be called under lock
+func (ch *Channel) delivery(msg *message, consumerTag string) amqp.Delivery {
+	ch.deliveryTag++
+	p := msg.publishing
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     ch.deliveryTag,
+		Redelivered:     msg.redelivered,
+		Exchange:        msg.exchange,
+		RoutingKey:      msg.key,
+		Body:            p.Body,
+	}
+}
+
+// Pass pending deliveries to client until cancel
+func (c *consumer) run() {
+	b := c.channel.broker
+	defer close(c.exited)
+	defer close(c.deliveries)
+	for {
+		b.m.Lock()
+		if len(c.pending) == 0 {
+			b.m.Unlock()
+			select {
+			case <-c.signal:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		d := c.pending[0]
+		c.pending = c.pending[1:]
+		b.m.Unlock()
+		select {
+		case c.deliveries <- d:
+		case <-c.done:
+			b.m.Lock()
+			c.channel.requeueTag(d.DeliveryTag)
+			b.m.Unlock()
+			return
+		}
+	}
+}
+
+// Cancel consumer and requeue deliveries not received by client. Must be called under lock
+func (c *consumer) cancel() {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	c.queue.removeConsumer(c)
+	delete(c.channel.consumers, c.tag)
+	close(c.done)
+	pending := c.pending
+	c.pending = nil
+	for _, d := range pending {
+		c.channel.requeueTag(d.DeliveryTag)
+	}
+}
+
+// Requeue not acknowledged delivery. Must be called under lock
+func (ch *Channel) requeueTag(tag uint64) {
+	u, ok := ch.unacked[tag]
+	if !ok {
+		return
+	}
+	delete(ch.unacked, tag)
+	u.release()
+	ch.broker.requeue(u.queue, u.msg)
+}
+
+// Close channel with error and release lock. Must be called under lock
+func (ch *Channel) fail(code int, reason string) error {
+	err := &amqp.Error{Code: code, Reason: reason, Server: true}
+	notify := ch.shutdown(err)
+	ch.broker.m.Unlock()
+	notify()
+	return err
+}
+
+// Close channel, cancel consumers and requeue unacknowledged messages. Must be called under lock
+// Returned function sends notifications and must be called without lock
+func (ch *Channel) shutdown(err *amqp.Error) func() {
+	if ch.closed {
+		return func() {}
+	}
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+	for _, c := range ch.consumers {
+		c.cancel()
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		ch.requeueTag(tag)
+	}
+	if ch.replyQueue != nil {
+		ch.broker.deleteQueue(ch.replyQueue)
+	}
+	closes, publishes, returns := ch.closes, ch.publishes, ch.returns
+	ch.closes, ch.publishes, ch.returns = nil, nil, nil
+	return func() {
+		for _, receiver := range closes {
+			if err != nil {
+				receiver <- err
+			}
+			close(receiver)
+		}
+		for _, receiver := range publishes {
+			close(receiver)
+		}
+		for _, receiver := range returns {
+			close(receiver)
+		}
+	}
+}
+
+// Declare pseudo queue of direct reply-to consumer. Queue is deleted with channel. Must be called under lock
+func (ch *Channel) declareReplyQueue() string {
+	ch.replyQueue = &queue{name: ch.broker.generateName(gorabbit.DirectReplyTo + ".g"), owner: ch.conn}
+	ch.broker.queues[ch.replyQueue.name] = ch.replyQueue
+	return ch.replyQueue.name
+}
+
+// Close channel gracefully
+func (ch *Channel) Close() error {
+	ch.broker.m.Lock()
+	notify := ch.shutdown(nil)
+	ch.broker.m.Unlock()
+	notify()
+	return nil
+}
+
+// IsClosed check if channel is closed
+func (ch *Channel) IsClosed() bool {
+	ch.broker.m.Lock()
+	defer ch.broker.m.Unlock()
+	return ch.closed
+}
+
+// NotifyClose register a listener for close events
+func (ch *Channel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	ch.broker.m.Lock()
+	defer ch.broker.m.Unlock()
+	if ch.closed {
+		close(c)
+	} else {
+		ch.closes = append(ch.closes, c)
+	}
+	return c
+}
+
+// NotifyPublish register a listener for publish confirmations
+func (ch *Channel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.broker.m.Lock()
+	defer ch.broker.m.Unlock()
+	if ch.closed {
+		close(confirm)
+	} else {
+		ch.publishes = append(ch.publishes, confirm)
+	}
+	return confirm
+}
+
+// NotifyReturn register a listener for unroutable mandatory messages
+func (ch *Channel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.broker.m.Lock()
+	defer ch.broker.m.Unlock()
+	if ch.closed {
+		close(c)
+	} else {
+		ch.returns = append(ch.returns, c)
+	}
+	return c
+}
+
+// Confirm put channel into confirm mode
+func (ch *Channel) Confirm(noWait bool) error {
+	ch.broker.m.Lock()
+	defer ch.broker.m.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+	return nil
+}
+
+// GetNextPublishSeqNo sequence number of next publishing in confirm mode
+func (ch *Channel) GetNextPublishSeqNo() uint64 {
+	ch.broker.m.Lock()
+	defer ch.broker.m.Unlock()
+	return ch.publishSeq + 1
+}
+
+// Qos set prefetch count per consumer
+func (ch *Channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker
+	b.m.Lock()
+	defer b.m.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	for _, c := range ch.consumers {
+		b.dispatch(c.queue)
+	}
+	return nil
+}
+
+// ExchangeDeclare declare exchange
+func (ch *Channel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return amqp.ErrClosed
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind {
+			return ch.fail(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s'", name))
+		}
+		b.m.Unlock()
+		return nil
+	}
+	if strings.HasPrefix(name, "amq.") {
+		return ch.fail(amqp.AccessRefused, fmt.Sprintf("ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name))
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+	case gorabbit.ExchangeDelayed:
+		if _, ok := args["x-delayed-type"].(string); !ok {
+			return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - Invalid argument, 'x-delayed-type' must be an existing exchange type")
+		}
+	default:
+		return ch.fail(amqp.CommandInvalid, fmt.Sprintf("COMMAND_INVALID - invalid exchange type '%s'", kind))
+	}
+	b.exchanges[name] = &exchange{name: name, kind: kind, args: args}
+	b.m.Unlock()
+	return nil
+}
+
+// QueueDeclare declare queue. Empty name generates unique queue name
+func (ch *Channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = b.generateName("amq.gen")
+	}
+	q, ok := b.queues[name]
+	if ok {
+		if q.owner != nil && q.owner != ch.conn {
+			return amqp.Queue{}, ch.fail(amqp.ResourceLocked, fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name))
+		}
+	} else {
+		q = &queue{name: name, args: args}
+		if exclusive {
+			q.owner = ch.conn
+		}
+		b.queues[name] = q
+	}
+	result := amqp.Queue{Name: q.name, Messages: len(q.messages), Consumers: len(q.consumers)}
+	b.m.Unlock()
+	return result, nil
+}
+
+// QueueDeclarePassive check queue exists. Channel is closed when queue is not found
+func (ch *Channel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", name))
+	}
+	if q.owner != nil && q.owner != ch.conn {
+		return amqp.Queue{}, ch.fail(amqp.ResourceLocked, fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name))
+	}
+	result := amqp.Queue{Name: q.name, Messages: len(q.messages), Consumers: len(q.consumers)}
+	b.m.Unlock()
+	return result, nil
+}
+
+// QueuePurge remove ready messages from queue. Unacknowledged messages are kept
+func (ch *Channel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", name))
+	}
+	count := len(q.messages)
+	q.messages = nil
+	b.m.Unlock()
+	return count, nil
+}
+
+// Get take one message from queue. ok is false when queue is empty
+func (ch *Channel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", queue))
+	}
+	defer b.m.Unlock()
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	d := ch.delivery(msg, "")
+	d.MessageCount = uint32(len(q.messages))
+	if !autoAck {
+		ch.unacked[d.DeliveryTag] = &delivery{msg: msg, queue: q}
+	}
+	return d, true, nil
+}
+
+// QueueBind bind queue to exchange
+func (ch *Channel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", name))
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok || ex.name == "" {
+		return ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange))
+	}
+	for _, bd := range ex.bindings {
+		if bd.queue == q && bd.key == key && tablesEqual(bd.args, args) {
+			b.m.Unlock()
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, &binding{queue: q, key: key, args: args})
+	b.m.Unlock()
+	return nil
+}
+
+// QueueUnbind remove binding of queue to exchange. Missing binding is ignored
+func (ch *Channel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", name))
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok || ex.name == "" {
+		return ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange))
+	}
+	for i, bd := range ex.bindings {
+		if bd.queue == q && bd.key == key && tablesEqual(bd.args, args) {
+			ex.bindings = append(ex.bindings[:i], ex.bindings[i+1:]...)
+			break
+		}
+	}
+	b.m.Unlock()
+	return nil
+}
+
+// Consume start consumer. Empty consumer tag generates unique tag
+// Consumer of direct reply-to receives replies to messages published on channel
+func (ch *Channel) Consume(queue, consumerTag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	if queue == gorabbit.DirectReplyTo {
+		if !autoAck || ch.replyQueue != nil {
+			return nil, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer requires no-ack mode and must be single on channel")
+		}
+		queue = ch.declareReplyQueue()
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", queue))
+	}
+	if consumerTag == "" {
+		consumerTag = b.generateName("ctag")
+	}
+	if _, ok := ch.consumers[consumerTag]; ok {
+		return nil, ch.fail(amqp.NotAllowed, fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumerTag))
+	}
+	if q.owner != nil && q.owner != ch.conn {
+		return nil, ch.fail(amqp.ResourceLocked, fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue))
+	}
+	for _, c := range q.consumers {
+		if exclusive || c.exclusive {
+			return nil, ch.fail(amqp.AccessRefused, fmt.Sprintf("ACCESS_REFUSED - queue '%s' in exclusive use", queue))
+		}
+	}
+	var start int
+	if q.isStream() {
+		if autoAck || ch.prefetch == 0 {
+			return nil, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - stream consumer requires manual ack and prefetch count")
+		}
+		if start, ok = q.streamStart(args[gorabbit.HeaderStreamOffset]); !ok {
+			return nil, ch.fail(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - invalid stream offset %v", args[gorabbit.HeaderStreamOffset]))
+		}
+	}
+	c := &consumer{
+		tag:        consumerTag,
+		queue:      q,
+		channel:    ch,
+		autoAck:    autoAck,
+		exclusive:  exclusive,
+		offset:     start,
+		deliveries: make(chan amqp.Delivery),
+		signal:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		exited:     make(chan struct{}),
+	}
+	ch.consumers[consumerTag] = c
+	q.consumers = append(q.consumers, c)
+	go c.run()
+	b.dispatch(q)
+	b.m.Unlock()
+	return c.deliveries, nil
+}
+
+// Cancel stop consumer
+// Deliveries of consumer are closed on return like in client library
+func (ch *Channel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return amqp.ErrClosed
+	}
+	c, ok := ch.consumers[consumer]
+	if ok {
+		c.cancel()
+	}
+	b.m.Unlock()
+	if ok {
+		<-c.exited
+	}
+	return nil
+}
+
+// Publish message to exchange
+func (ch *Channel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := ch.broker
+	b.m.Lock()
+	if ch.closed {
+		b.m.Unlock()
+		return amqp.ErrClosed
+	}
+	if b.failPublish[key] {
+		delete(b.failPublish, key)
+		return ch.fail(amqp.InternalError, "INTERNAL_ERROR - publish failed")
+	}
+	if msg.ReplyTo == gorabbit.DirectReplyTo {
+		if ch.replyQueue == nil {
+			return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - fast reply consumer does not exist")
+		}
+		msg.ReplyTo = ch.replyQueue.name
+	}
+	queues, err := b.route(exchange, key, msg.Headers)
+	if err != nil {
+		return ch.fail(err.Code, err.Reason)
+	}
+	var confirmation *amqp.Confirmation
+	if ch.confirm {
+		ch.publishSeq++
+		confirmation = &amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: !b.nackPublish}
+	}
+	// Delayed message is routed after delay and never returned
+	delayed := b.delay(exchange, key, msg)
+	if delayed {
+		queues = nil
+	}
+	var returned *amqp.Return
+	if len(queues) == 0 && mandatory && !delayed {
+		returned = &amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+	}
+	for _, q := range queues {
+		b.enqueue(q, &message{exchange: exchange, key: key, publishing: msg})
+	}
+	publishes, returns := ch.publishes, ch.returns
+	b.m.Unlock()
+	// Return is sent before confirmation as server does
+	if returned != nil {
+		for _, receiver := range returns {
+			receiver <- *returned
+		}
+	}
+	if confirmation != nil {
+		for _, receiver := range publishes {
+			receiver <- *confirmation
+		}
+	}
+	return nil
+}
+
+// Ack acknowledge delivery
+func (ch *Channel) Ack(tag uint64, multiple bool) error {
+	b := ch.broker
+	b.m.Lock()
+	list, err := ch.take(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for _, u := range list {
+		b.dispatch(u.queue)
+	}
+	b.m.Unlock()
+	return nil
+}
+
+// Nack negatively acknowledge delivery
+func (ch *Channel) Nack(tag uint64, multiple bool, requeue bool) error {
+	b := ch.broker
+	b.m.Lock()
+	list, err := ch.take(tag, multiple)
+	if err != nil {
+		return err
+	}
+	if requeue {
+		// Keep original order in queue head
+		for i := len(list) - 1; i >= 0; i-- {
+			b.requeue(list[i].queue, list[i].msg)
+		}
+	} else {
+		for _, u := range list {
+			b.deadLetter(u.queue, u.msg, "rejected")
+			b.dispatch(u.queue)
+		}
+	}
+	b.m.Unlock()
+	return nil
+}
+
+// Reject delivery
+func (ch *Channel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// Remove acknowledged deliveries. Must be called under lock. Lock is released on error
+func (ch *Channel) take(tag uint64, multiple bool) ([]*delivery, error) {
+	if ch.closed {
+		ch.broker.m.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	var tags []uint64
+	if multiple {
+		for t := range ch.unacked {
+			if tag == 0 || t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return nil, ch.fail(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag))
+	}
+	list := make([]*delivery, 0, len(tags))
+	for _, t := range tags {
+		u := ch.unacked[t]
+		delete(ch.unacked, t)
+		u.release()
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+// Compare binding arguments
+func tablesEqual(a, b amqp.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if fmt.Sprint(b[k]) != fmt.Sprint(v) {
+			return false
+		}
+	}
+	return true
+}
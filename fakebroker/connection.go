@@ -0,0 +1,100 @@
+package fakebroker
+
+import (
+	"github.com/dimonrus/gorabbit"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Connection to in-memory broker. Implements gorabbit.Connection
+type Connection struct {
+	// Broker
+	broker *Broker
+	// Connection is closed
+	closed bool
+	// Open channels
+	channels map[*Channel]struct{}
+	// Close listeners
+	closes []chan *amqp.Error
+}
+
+// Channel open channel
+func (c *Connection) Channel() (gorabbit.Channel, error) {
+	c.broker.m.Lock()
+	defer c.broker.m.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &Channel{
+		broker:    c.broker,
+		conn:      c,
+		unacked:   make(map[uint64]*delivery),
+		consumers: make(map[string]*consumer),
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+// Close connection gracefully
+func (c *Connection) Close() error {
+	c.broker.m.Lock()
+	if c.closed {
+		c.broker.m.Unlock()
+		return amqp.ErrClosed
+	}
+	notify := c.shutdown(nil)
+	c.broker.m.Unlock()
+	notify()
+	return nil
+}
+
+// IsClosed check if connection is closed
+func (c *Connection) IsClosed() bool {
+	c.broker.m.Lock()
+	defer c.broker.m.Unlock()
+	return c.closed
+}
+
+// NotifyClose register a listener for close events
+func (c *Connection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.m.Lock()
+	defer c.broker.m.Unlock()
+	if c.closed {
+		close(receiver)
+	} else {
+		c.closes = append(c.closes, receiver)
+	}
+	return receiver
+}
+
+// Close connection with all channels. Must be called under lock
+// Returned function sends notifications and must be called without lock
+func (c *Connection) shutdown(err *amqp.Error) func() {
+	if c.closed {
+		return func() {}
+	}
+	c.closed = true
+	delete(c.broker.connections, c)
+	var notify []func()
+	for ch := range c.channels {
+		notify = append(notify, ch.shutdown(err))
+	}
+	// Exclusive queues are deleted with owner connection
+	for _, q := range c.broker.queues {
+		if q.owner == c {
+			c.broker.deleteQueue(q)
+		}
+	}
+	closes := c.closes
+	c.closes = nil
+	return func() {
+		for _, n := range notify {
+			n()
+		}
+		for _, receiver := range closes {
+			if err != nil {
+				receiver <- err
+			}
+			close(receiver)
+		}
+	}
+}
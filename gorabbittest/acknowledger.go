@@ -0,0 +1,105 @@
+package gorabbittest
+
+import (
+	"sync"
+)
+
+const (
+	// OutcomeNone delivery was not acknowledged
+	OutcomeNone = "none"
+	// OutcomeAck delivery was acked
+	OutcomeAck = "ack"
+	// OutcomeNack delivery was nacked
+	OutcomeNack = "nack"
+	// OutcomeReject delivery was rejected
+	OutcomeReject = "reject"
+)
+
+// Acknowledgement recorded call of acknowledger
+type Acknowledgement struct {
+	// One of outcome constants
+	Outcome string
+	// Delivery tag
+	Tag uint64
+	// Multiple flag
+	Multiple bool
+	// Requeue flag
+	Requeue bool
+}
+
+// Acknowledger recording amqp.Acknowledger
+type Acknowledger struct {
+	// Lock for records
+	m sync.Mutex
+	// Recorded calls
+	records []Acknowledgement
+}
+
+// NewAcknowledger Create recording acknowledger
+func NewAcknowledger() *Acknowledger {
+	return &Acknowledger{}
+}
+
+// Ack record ack
+func (a *Acknowledger) Ack(tag uint64, multiple bool) error {
+	a.record(Acknowledgement{Outcome: OutcomeAck, Tag: tag, Multiple: multiple})
+	return nil
+}
+
+// Nack record nack
+func (a *Acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.record(Acknowledgement{Outcome: OutcomeNack, Tag: tag, Multiple: multiple, Requeue: requeue})
+	return nil
+}
+
+// Reject record reject
+func (a *Acknowledger) Reject(tag uint64, requeue bool) error {
+	a.record(Acknowledgement{Outcome: OutcomeReject, Tag: tag, Requeue: requeue})
+	return nil
+}
+
+// Add record
+func (a *Acknowledger) record(r Acknowledgement) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.records = append(a.records, r)
+}
+
+// Records get all recorded calls
+func (a *Acknowledger) Records() []Acknowledgement {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return append([]Acknowledgement(nil), a.records...)
+}
+
+// Last get last recorded call
+func (a *Acknowledger) Last() Acknowledgement {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if len(a.records) == 0 {
+		return Acknowledgement{Outcome: OutcomeNone}
+	}
+	return a.records[len(a.records)-1]
+}
+
+// Outcome get outcome of last call
+func (a *Acknowledger) Outcome() string {
+	return a.Last().Outcome
+}
+
+// Acked check if delivery was acked
+func (a *Acknowledger) Acked() bool {
+	return a.Outcome() == OutcomeAck
+}
+
+// Nacked check if delivery was nacked or rejected
+func (a *Acknowledger) Nacked() bool {
+	o := a.Outcome()
+	return o == OutcomeNack || o == OutcomeReject
+}
+
+// Requeued check if delivery was nacked or rejected with requeue
+func (a *Acknowledger) Requeued() bool {
+	last := a.Last()
+	return (last.Outcome == OutcomeNack || last.Outcome == OutcomeReject) && last.Requeue
+}
@@ -0,0 +1,123 @@
+// Package gorabbittest Helpers for unit testing of consumer callbacks
+package gorabbittest
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeliveryBuilder builder of amqp.Delivery
+type DeliveryBuilder struct {
+	// Delivery in progress
+	delivery amqp.Delivery
+}
+
+// NewDelivery Create delivery builder with body
+func NewDelivery(body []byte) *DeliveryBuilder {
+	return &DeliveryBuilder{
+		delivery: amqp.Delivery{
+			Body:        body,
+			DeliveryTag: 1,
+			Timestamp:   time.Now(),
+		},
+	}
+}
+
+// WithHeader set header value
+func (b *DeliveryBuilder) WithHeader(key string, value interface{}) *DeliveryBuilder {
+	if b.delivery.Headers == nil {
+		b.delivery.Headers = make(amqp.Table)
+	}
+	b.delivery.Headers[key] = value
+	return b
+}
+
+// WithHeaders set multiple headers
+func (b *DeliveryBuilder) WithHeaders(headers amqp.Table) *DeliveryBuilder {
+	for k, v := range headers {
+		b.WithHeader(k, v)
+	}
+	return b
+}
+
+// Redelivered mark delivery as redelivered
+func (b *DeliveryBuilder) Redelivered() *DeliveryBuilder {
+	b.delivery.Redelivered = true
+	return b
+}
+
+// WithDeath append x-death history record as RabbitMQ does on dead-lettering
+// The latest record goes first
+func (b *DeliveryBuilder) WithDeath(queue, reason string, count int64) *DeliveryBuilder {
+	death := amqp.Table{
+		"queue":        queue,
+		"reason":       reason,
+		"count":        count,
+		"exchange":     b.delivery.Exchange,
+		"routing-keys": []interface{}{b.delivery.RoutingKey},
+		"time":         time.Now(),
+	}
+	history, _ := b.delivery.Headers["x-death"].([]interface{})
+	return b.WithHeader("x-death", append([]interface{}{death}, history...))
+}
+
+// WithExchange set exchange
+func (b *DeliveryBuilder) WithExchange(exchange string) *DeliveryBuilder {
+	b.delivery.Exchange = exchange
+	return b
+}
+
+// WithRoutingKey set routing key
+func (b *DeliveryBuilder) WithRoutingKey(key string) *DeliveryBuilder {
+	b.delivery.RoutingKey = key
+	return b
+}
+
+// WithMessageId set message id
+func (b *DeliveryBuilder) WithMessageId(id string) *DeliveryBuilder {
+	b.delivery.MessageId = id
+	return b
+}
+
+// WithCorrelationId set correlation id
+func (b *DeliveryBuilder) WithCorrelationId(id string) *DeliveryBuilder {
+	b.delivery.CorrelationId = id
+	return b
+}
+
+// WithReplyTo set reply to
+func (b *DeliveryBuilder) WithReplyTo(replyTo string) *DeliveryBuilder {
+	b.delivery.ReplyTo = replyTo
+	return b
+}
+
+// WithContentType set content type
+func (b *DeliveryBuilder) WithContentType(contentType string) *DeliveryBuilder {
+	b.delivery.ContentType = contentType
+	return b
+}
+
+// WithDeliveryTag set delivery tag
+func (b *DeliveryBuilder) WithDeliveryTag(tag uint64) *DeliveryBuilder {
+	b.delivery.DeliveryTag = tag
+	return b
+}
+
+// WithAcknowledger set acknowledger
+func (b *DeliveryBuilder) WithAcknowledger(ack amqp.Acknowledger) *DeliveryBuilder {
+	b.delivery.Acknowledger = ack
+	return b
+}
+
+// Build get delivery
+func (b *DeliveryBuilder) Build() amqp.Delivery {
+	d := b.delivery
+	if d.Headers != nil {
+		d.Headers = make(amqp.Table, len(b.delivery.Headers))
+		for k, v := range b.delivery.Headers {
+			d.Headers[k] = v
+		}
+	}
+	return d
+}
@@ -0,0 +1,164 @@
+package gorabbittest
+
+import (
+	"context"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SubscriberName name of subscriber used by harness
+const SubscriberName = "Subscriber: gorabbittest"
+
+// Harness run consumers from registry through real subscriber logic without server
+type Harness struct {
+	// Consumers registry
+	registry gorabbit.Registry
+	// Recording logger
+	logger *Logger
+	// Pause before requeue on panic
+	recoverDelay time.Duration
+	// Global middlewares
+	middleware []gorabbit.Middleware
+}
+
+// Result of delivery processing
+type Result struct {
+	// Acknowledger of processed delivery
+	*Acknowledger
+	// Recovered panic value. Nil when callback did not panic
+	Panic interface{}
+	// Reply of ReplyHandler. Nil when reply is not published because of error or empty ReplyTo
+	Reply *amqp.Publishing
+}
+
+// Panicked check if callback panicked
+func (r *Result) Panicked() bool {
+	return r.Panic != nil
+}
+
+// NewHarness Create harness for registry. Pause before requeue on panic is disabled
+func NewHarness(registry gorabbit.Registry) *Harness {
+	return &Harness{
+		registry:     registry,
+		logger:       NewLogger(),
+		recoverDelay: -1,
+	}
+}
+
+// WithRecoverDelay set pause before requeue on panic
+func (h *Harness) WithRecoverDelay(delay time.Duration) *Harness {
+	h.recoverDelay = delay
+	return h
+}
+
+// Use add global middlewares like gorabbit.Application.Use
+func (h *Harness) Use(m ...gorabbit.Middleware) *Harness {
+	h.middleware = append(h.middleware, m...)
+	return h
+}
+
+// Logger get recording logger
+func (h *Harness) Logger() *Logger {
+	return h.logger
+}
+
+// Deliver process delivery by consumer registered with name
+// Recording acknowledger is attached to delivery unless delivery already has one
+// Reply of ReplyHandler is captured in result instead of publishing
+func (h *Harness) Deliver(name string, d amqp.Delivery) (*Result, porterr.IError) {
+	consumer, ok := h.registry[name]
+	if !ok {
+		return nil, porterr.NewF(porterr.PortErrorParam, "Consumer '%s' not found in registry", name)
+	}
+	if consumer.BatchHandler != nil {
+		return nil, porterr.NewF(porterr.PortErrorParam, "Consumer '%s' has batch handler. Use DeliverBatch", name)
+	}
+	result := &Result{}
+	if ack, ok := d.Acknowledger.(*Acknowledger); ok {
+		result.Acknowledger = ack
+	} else {
+		result.Acknowledger = NewAcknowledger()
+		d.Acknowledger = result.Acknowledger
+	}
+	// Capture panic of handler
+	capture := func(next gorabbit.Handler) gorabbit.Handler {
+		return func(ctx context.Context, d amqp.Delivery) porterr.IError {
+			defer func() {
+				if r := recover(); r != nil {
+					result.Panic = r
+					panic(r)
+				}
+			}()
+			return next(ctx, d)
+		}
+	}
+	middleware := append([]gorabbit.Middleware{}, h.middleware...)
+	middleware = append(middleware, consumer.Middleware...)
+	c := consumer.Clone(name)
+	if c.ReplyHandler != nil {
+		c.Handler, c.ReplyHandler = captureReply(c.ReplyHandler, result), nil
+	}
+	c.Middleware = append(middleware, capture)
+	c.RecoverDelay = h.recoverDelay
+	c.Process(h.logger, SubscriberName, d)
+	return result, nil
+}
+
+// Handler calling reply handler and saving reply to result like reply is published to ReplyTo of request
+func captureReply(h gorabbit.ReplyHandler, result *Result) gorabbit.Handler {
+	return func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		p, e := h(ctx, d)
+		if e == nil && d.ReplyTo != "" {
+			result.Reply = &p
+		}
+		return e
+	}
+}
+
+// DeliverBatch process deliveries as one batch by consumer with batch handler registered with name
+// Recording acknowledger of result is attached to deliveries without one
+// Delivery tag not greater than tag of previous delivery is replaced with next tag
+// like tags of one channel, so multiple ack covers the batch
+func (h *Harness) DeliverBatch(name string, deliveries ...amqp.Delivery) (*Result, porterr.IError) {
+	consumer, ok := h.registry[name]
+	if !ok {
+		return nil, porterr.NewF(porterr.PortErrorParam, "Consumer '%s' not found in registry", name)
+	}
+	if consumer.BatchHandler == nil {
+		return nil, porterr.NewF(porterr.PortErrorParam, "Consumer '%s' has no batch handler. Use Deliver", name)
+	}
+	if len(deliveries) == 0 {
+		return nil, porterr.New(porterr.PortErrorParam, "Batch is empty")
+	}
+	result := &Result{Acknowledger: NewAcknowledger()}
+	batch := make([]amqp.Delivery, len(deliveries))
+	var tag uint64
+	for i, d := range deliveries {
+		if d.Acknowledger == nil {
+			d.Acknowledger = result.Acknowledger
+		}
+		if d.DeliveryTag <= tag {
+			d.DeliveryTag = tag + 1
+		}
+		tag = d.DeliveryTag
+		batch[i] = d
+	}
+	c := consumer.Clone(name)
+	handler := c.BatchHandler
+	// Capture panic of batch handler
+	c.BatchHandler = func(ctx context.Context, deliveries []amqp.Delivery) porterr.IError {
+		defer func() {
+			if r := recover(); r != nil {
+				result.Panic = r
+				panic(r)
+			}
+		}()
+		return handler(ctx, deliveries)
+	}
+	c.RecoverDelay = h.recoverDelay
+	c.ProcessBatch(h.logger, SubscriberName, batch)
+	return result, nil
+}
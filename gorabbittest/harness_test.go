@@ -0,0 +1,222 @@
+package gorabbittest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestHarness_Deliver(t *testing.T) {
+	h := NewHarness(gorabbit.Registry{
+		"orders": {Queue: "orders", Server: "local", Count: 1, Callback: func(d amqp.Delivery) {
+			if d.Headers["type"] == "broken" {
+				panic("broken order")
+			}
+		}},
+	})
+
+	r, e := h.Deliver("orders", NewDelivery([]byte("ok")).WithHeader("type", "order").Build())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !r.Acked() || r.Panicked() {
+		t.Fatal("delivery must be acked")
+	}
+
+	r, e = h.Deliver("orders", NewDelivery([]byte("bad")).WithHeader("type", "broken").Redelivered().Build())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !r.Panicked() || !r.Requeued() || r.Outcome() != OutcomeReject {
+		t.Fatal("delivery must be rejected with requeue on panic")
+	}
+	if !h.Logger().Contains(LevelError, "broken order") {
+		t.Fatal("panic must be logged")
+	}
+
+	if _, e = h.Deliver("unknown", NewDelivery(nil).Build()); e == nil {
+		t.Fatal("unknown consumer must fail")
+	}
+}
+
+func TestDeliveryBuilder_WithDeath(t *testing.T) {
+	d := NewDelivery(nil).
+		WithRoutingKey("key").
+		WithDeath("work", "rejected", 1).
+		WithDeath("retry", "expired", 2).
+		Build()
+	history, ok := d.Headers["x-death"].([]interface{})
+	if !ok || len(history) != 2 {
+		t.Fatal("x-death must contain two records")
+	}
+	if history[0].(amqp.Table)["queue"] != "retry" {
+		t.Fatal("latest death must go first")
+	}
+}
+
+func TestHarness_Middleware(t *testing.T) {
+	var order []string
+	trace := func(name string) gorabbit.Middleware {
+		return func(next gorabbit.Handler) gorabbit.Handler {
+			return func(ctx context.Context, d amqp.Delivery) porterr.IError {
+				order = append(order, name)
+				return next(ctx, d)
+			}
+		}
+	}
+	h := NewHarness(gorabbit.Registry{
+		"orders": {Queue: "orders", Server: "local", Count: 1,
+			Middleware: []gorabbit.Middleware{trace("consumer"), gorabbit.TimeoutMiddleware(time.Millisecond * 10)},
+			Handler: func(ctx context.Context, d amqp.Delivery) porterr.IError {
+				if gorabbit.ConsumerInfoFromContext(ctx).Name != "orders" {
+					return porterr.New(porterr.PortErrorParam, "consumer info is not set")
+				}
+				switch d.Headers["type"] {
+				case "invalid":
+					return gorabbit.RejectError("invalid order")
+				case "slow":
+					<-ctx.Done()
+					return porterr.New(porterr.PortErrorSystem, ctx.Err().Error())
+				}
+				return nil
+			}},
+	}).Use(trace("global"), gorabbit.LoggingMiddleware(NewLogger()))
+
+	r, _ := h.Deliver("orders", NewDelivery(nil).Build())
+	if !r.Acked() || len(order) != 2 || order[0] != "global" || order[1] != "consumer" {
+		t.Fatalf("wrong middleware order %v", order)
+	}
+	r, _ = h.Deliver("orders", NewDelivery(nil).WithHeader("type", "invalid").Build())
+	if r.Outcome() != OutcomeReject || r.Requeued() {
+		t.Fatal("delivery must be rejected without requeue")
+	}
+	r, _ = h.Deliver("orders", NewDelivery(nil).WithHeader("type", "slow").Build())
+	if r.Outcome() != OutcomeNack || !r.Requeued() {
+		t.Fatal("delivery must be nacked with requeue on timeout")
+	}
+	if !h.Logger().Contains(LevelError, "processing timeout") {
+		t.Fatal("timeout must be logged")
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	logger := NewLogger()
+	h := NewHarness(gorabbit.Registry{
+		"orders": {Queue: "orders", Server: "local", Count: 1, Callback: func(d amqp.Delivery) {}},
+	}).Use(gorabbit.LoggingMiddleware(logger))
+	_, _ = h.Deliver("orders", NewDelivery(nil).WithDeliveryTag(7).WithMessageId("m1").Build())
+	if !logger.HasField(LevelInfo, gorabbit.FieldMessageId, "m1") || !logger.HasField(LevelInfo, gorabbit.FieldConsumer, "orders") {
+		t.Fatalf("wrong log entries %v", logger.Entries())
+	}
+}
+
+func TestHarness_LogMode(t *testing.T) {
+	h := NewHarness(gorabbit.Registry{
+		"off":  {Queue: "q", Callback: func(d amqp.Delivery) {}, LogMode: gorabbit.LogModeOff},
+		"meta": {Queue: "q", Callback: func(d amqp.Delivery) {}},
+		"body": {Queue: "q", Callback: func(d amqp.Delivery) {}, LogMode: gorabbit.LogModeBody, LogBodyLimit: 32,
+			Redact: gorabbit.RedactJSONFields("password")},
+	})
+	body := []byte(`{"login":"user","password":"secret","comment":"long long long"}`)
+	_, _ = h.Deliver("off", NewDelivery(body).WithMessageId("off").Build())
+	_, _ = h.Deliver("meta", NewDelivery(body).WithMessageId("meta").Build())
+	_, _ = h.Deliver("body", NewDelivery(body).WithMessageId("body").Build())
+	if h.Logger().HasField("", gorabbit.FieldMessageId, "off") {
+		t.Fatal("delivery must not be logged when logging is off")
+	}
+	if !h.Logger().HasField(LevelDebug, gorabbit.FieldMessageId, "meta") || h.Logger().Contains("", "secret") {
+		t.Fatal("metadata must be logged at debug level without body")
+	}
+	if h.Logger().HasField(LevelInfo, gorabbit.FieldMessageId, "meta") {
+		t.Fatal("metadata must not be logged at info level")
+	}
+	if !h.Logger().HasField(LevelInfo, gorabbit.FieldBody, `{"login":"user","password":"***"...(60 bytes)`) {
+		t.Fatalf("body must be redacted and truncated %v", h.Logger().Entries())
+	}
+}
+
+func TestHarness_DeliverReply(t *testing.T) {
+	h := NewHarness(gorabbit.Registry{
+		"prices": {Queue: "prices", Server: "local", Count: 1,
+			ReplyHandler: func(ctx context.Context, d amqp.Delivery) (amqp.Publishing, porterr.IError) {
+				if string(d.Body) == "unknown" {
+					return amqp.Publishing{}, porterr.New(porterr.PortErrorParam, "unknown product")
+				}
+				return amqp.Publishing{Body: []byte("42")}, nil
+			}},
+	})
+
+	r, e := h.Deliver("prices", NewDelivery([]byte("apple")).WithReplyTo("client").WithCorrelationId("1").Build())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !r.Acked() || r.Reply == nil || string(r.Reply.Body) != "42" {
+		t.Fatal("reply must be captured and request acked")
+	}
+
+	r, _ = h.Deliver("prices", NewDelivery([]byte("apple")).Build())
+	if !r.Acked() || r.Reply != nil {
+		t.Fatal("reply must not be captured without reply address")
+	}
+
+	r, _ = h.Deliver("prices", NewDelivery([]byte("unknown")).WithReplyTo("client").Build())
+	if !r.Requeued() || r.Reply != nil {
+		t.Fatal("reply must not be captured on error")
+	}
+}
+
+func TestHarness_DeliverBatch(t *testing.T) {
+	h := NewHarness(gorabbit.Registry{
+		"events": {Queue: "events", Server: "local", Count: 1, BatchSize: 3,
+			BatchHandler: func(ctx context.Context, deliveries []amqp.Delivery) porterr.IError {
+				failures := make(map[int]porterr.IError)
+				for i, d := range deliveries {
+					switch string(d.Body) {
+					case "broken":
+						panic("broken event")
+					case "invalid":
+						failures[i] = gorabbit.RejectError("invalid event")
+					}
+				}
+				if len(failures) > 0 {
+					return gorabbit.BatchError(failures)
+				}
+				return nil
+			}},
+	})
+
+	r, e := h.DeliverBatch("events", NewDelivery([]byte("a")).Build(), NewDelivery([]byte("b")).Build())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if last := r.Last(); !r.Acked() || last.Tag != 2 || !last.Multiple {
+		t.Fatalf("batch must be acked with multiple %v", r.Records())
+	}
+
+	r, _ = h.DeliverBatch("events", NewDelivery([]byte("a")).Build(), NewDelivery([]byte("invalid")).Build())
+	var rejected bool
+	for _, record := range r.Records() {
+		if record.Outcome == OutcomeReject && record.Tag == 2 && !record.Requeue {
+			rejected = true
+		}
+	}
+	if !rejected {
+		t.Fatalf("failed delivery must be rejected %v", r.Records())
+	}
+
+	r, _ = h.DeliverBatch("events", NewDelivery([]byte("broken")).Build())
+	if !r.Panicked() || !r.Requeued() {
+		t.Fatal("batch must be nacked with requeue on panic")
+	}
+
+	if _, e = h.Deliver("events", NewDelivery(nil).Build()); e == nil {
+		t.Fatal("deliver to batch consumer must fail")
+	}
+	if _, e = h.DeliverBatch("events"); e == nil {
+		t.Fatal("empty batch must fail")
+	}
+}
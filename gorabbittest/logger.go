@@ -0,0 +1,161 @@
+package gorabbittest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dimonrus/gorabbit"
+)
+
+const (
+	// LevelDebug debug level of structured logger
+	LevelDebug = "debug"
+	// LevelPrint print level
+	LevelPrint = "print"
+	// LevelInfo info level
+	LevelInfo = "info"
+	// LevelWarn warning level
+	LevelWarn = "warn"
+	// LevelError error level
+	LevelError = "error"
+)
+
+// LogEntry recorded log message
+type LogEntry struct {
+	// Log level
+	Level string
+	// Message
+	Message string
+	// Fields of structured entry
+	Fields []gorabbit.Field
+}
+
+// Logger recording implementation of gocli.Logger and gorabbit.Logger
+type Logger struct {
+	// Lock for entries
+	m sync.Mutex
+	// Recorded entries
+	entries []LogEntry
+}
+
+// NewLogger Create recording logger
+func NewLogger() *Logger {
+	return &Logger{}
+}
+
+// Add entry
+func (l *Logger) record(level string, message string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.entries = append(l.entries, LogEntry{Level: level, Message: message})
+}
+
+// Log record structured entry. Message contains fields as key=value pairs
+func (l *Logger) Log(level gorabbit.LogLevel, msg string, fields ...gorabbit.Field) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.entries = append(l.entries, LogEntry{
+		Level:   level.String(),
+		Message: gorabbit.FormatFields(msg, fields...),
+		Fields:  append([]gorabbit.Field(nil), fields...),
+	})
+}
+
+// HasField check if any structured entry of level has field with value. Empty level matches all levels
+func (l *Logger) HasField(level string, key string, value interface{}) bool {
+	for _, e := range l.Entries() {
+		if level != "" && e.Level != level {
+			continue
+		}
+		for _, f := range e.Fields {
+			if f.Key == key && f.Value == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Entries get all recorded entries
+func (l *Logger) Entries() []LogEntry {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return append([]LogEntry(nil), l.entries...)
+}
+
+// Contains check if any message of level contains substring. Empty level matches all levels
+func (l *Logger) Contains(level string, substring string) bool {
+	for _, e := range l.Entries() {
+		if (level == "" || e.Level == level) && strings.Contains(e.Message, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// Output record message
+func (l *Logger) Output(callDepth int, message string) error {
+	l.record(LevelPrint, message)
+	return nil
+}
+
+// Print record message
+func (l *Logger) Print(v ...interface{}) {
+	l.record(LevelPrint, fmt.Sprint(v...))
+}
+
+// Println record message
+func (l *Logger) Println(v ...interface{}) {
+	l.record(LevelPrint, fmt.Sprintln(v...))
+}
+
+// Printf record message
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.record(LevelPrint, fmt.Sprintf(format, v...))
+}
+
+// Info record message
+func (l *Logger) Info(v ...interface{}) {
+	l.record(LevelInfo, fmt.Sprint(v...))
+}
+
+// Infoln record message
+func (l *Logger) Infoln(v ...interface{}) {
+	l.record(LevelInfo, fmt.Sprintln(v...))
+}
+
+// Infof record message
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.record(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Warn record message
+func (l *Logger) Warn(v ...interface{}) {
+	l.record(LevelWarn, fmt.Sprint(v...))
+}
+
+// Warnln record message
+func (l *Logger) Warnln(v ...interface{}) {
+	l.record(LevelWarn, fmt.Sprintln(v...))
+}
+
+// Warnf record message
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.record(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Error record message
+func (l *Logger) Error(v ...interface{}) {
+	l.record(LevelError, fmt.Sprint(v...))
+}
+
+// Errorln record message
+func (l *Logger) Errorln(v ...interface{}) {
+	l.record(LevelError, fmt.Sprintln(v...))
+}
+
+// Errorf record message
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.record(LevelError, fmt.Sprintf(format, v...))
+}
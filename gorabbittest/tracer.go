@@ -0,0 +1,141 @@
+package gorabbittest
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+
+	"github.com/dimonrus/gorabbit"
+)
+
+// RecordedSpan span recorded by SpanRecorder
+type RecordedSpan struct {
+	// Span name
+	Name string
+	// Span kind
+	Kind gorabbit.SpanKind
+	// Context of span
+	Context gorabbit.SpanContext
+	// Context of parent span. Zero if span is root
+	Parent gorabbit.SpanContext
+	// Span attributes
+	Attributes map[string]interface{}
+	// Recorded errors
+	Errors []error
+	// Span is ended
+	Ended bool
+}
+
+// SpanRecorder in-memory gorabbit.Tracer
+type SpanRecorder struct {
+	// Lock for spans
+	m sync.Mutex
+	// Started spans
+	spans []*RecordedSpan
+}
+
+// NewSpanRecorder Create in-memory tracer
+func NewSpanRecorder() *SpanRecorder {
+	return &SpanRecorder{}
+}
+
+// Start record new span as child of span in context
+func (r *SpanRecorder) Start(ctx context.Context, name string, kind gorabbit.SpanKind) (context.Context, gorabbit.Span) {
+	parent := gorabbit.SpanContextFromContext(ctx)
+	sc := gorabbit.SpanContext{Flags: 0x01}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Flags = parent.Flags
+		sc.TraceState = parent.TraceState
+	} else {
+		_, _ = rand.Read(sc.TraceID[:])
+	}
+	_, _ = rand.Read(sc.SpanID[:])
+	s := &RecordedSpan{
+		Name:       name,
+		Kind:       kind,
+		Context:    sc,
+		Parent:     parent,
+		Attributes: make(map[string]interface{}),
+	}
+	r.m.Lock()
+	r.spans = append(r.spans, s)
+	r.m.Unlock()
+	return gorabbit.ContextWithSpanContext(ctx, sc), &recordingSpan{recorder: r, span: s}
+}
+
+// Spans get copy of all started spans
+func (r *SpanRecorder) Spans() []RecordedSpan {
+	r.m.Lock()
+	defer r.m.Unlock()
+	spans := make([]RecordedSpan, 0, len(r.spans))
+	for _, s := range r.spans {
+		spans = append(spans, copySpan(s))
+	}
+	return spans
+}
+
+// Ended get copy of ended spans
+func (r *SpanRecorder) Ended() []RecordedSpan {
+	r.m.Lock()
+	defer r.m.Unlock()
+	spans := make([]RecordedSpan, 0, len(r.spans))
+	for _, s := range r.spans {
+		if s.Ended {
+			spans = append(spans, copySpan(s))
+		}
+	}
+	return spans
+}
+
+// Reset remove all recorded spans
+func (r *SpanRecorder) Reset() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.spans = nil
+}
+
+// Copy span with attributes
+func copySpan(s *RecordedSpan) RecordedSpan {
+	c := *s
+	c.Attributes = make(map[string]interface{}, len(s.Attributes))
+	for k, v := range s.Attributes {
+		c.Attributes[k] = v
+	}
+	c.Errors = append([]error(nil), s.Errors...)
+	return c
+}
+
+// Span started by SpanRecorder
+type recordingSpan struct {
+	// Owner of span
+	recorder *SpanRecorder
+	// Recorded data
+	span *RecordedSpan
+}
+
+// SpanContext context of span
+func (s *recordingSpan) SpanContext() gorabbit.SpanContext {
+	return s.span.Context
+}
+
+// SetAttribute record attribute
+func (s *recordingSpan) SetAttribute(key string, value interface{}) {
+	s.recorder.m.Lock()
+	defer s.recorder.m.Unlock()
+	s.span.Attributes[key] = value
+}
+
+// RecordError record error
+func (s *recordingSpan) RecordError(err error) {
+	s.recorder.m.Lock()
+	defer s.recorder.m.Unlock()
+	s.span.Errors = append(s.span.Errors, err)
+}
+
+// End mark span as ended
+func (s *recordingSpan) End() {
+	s.recorder.m.Lock()
+	defer s.recorder.m.Unlock()
+	s.span.Ended = true
+}
@@ -0,0 +1,71 @@
+package gorabbit
+
+import (
+	"context"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// HandlerErrorReject Handler error code. Delivery is rejected without requeue and dead-lettered if configured
+	HandlerErrorReject = "GORABBIT_HANDLER_REJECT"
+	// HandlerErrorPanic Handler error code. Handler panic recovered. Delivery is rejected with requeue
+	HandlerErrorPanic = "GORABBIT_HANDLER_PANIC"
+	// HandlerErrorTimeout Handler error code. Handler exceeded timeout. Delivery is nacked with requeue
+	HandlerErrorTimeout = "GORABBIT_HANDLER_TIMEOUT"
+)
+
+// Handler Delivery handler
+// Delivery is acked on nil error, rejected without requeue on HandlerErrorReject code
+// and nacked with requeue on any other error
+type Handler func(ctx context.Context, d amqp.Delivery) porterr.IError
+
+// Middleware Handler decorator
+type Middleware func(next Handler) Handler
+
+// ConsumerInfo Consumer of processed delivery
+type ConsumerInfo struct {
+	// Consumer name in registry
+	Name string
+	// Queue name from config
+	Queue string
+	// Server name from config
+	Server string
+	// Subscriber name
+	Subscriber string
+	// Count of previous failed deliveries of quorum queue message. Zero for batch
+	DeliveryCount int64
+}
+
+// Labels metric labels of consumer
+func (i ConsumerInfo) Labels() Labels {
+	return Labels{Server: i.Server, Queue: i.Queue, Consumer: i.Name}
+}
+
+// Context key of consumer info
+type consumerInfoKey struct{}
+
+// ContextWithConsumerInfo Put consumer info to context
+func ContextWithConsumerInfo(ctx context.Context, info ConsumerInfo) context.Context {
+	return context.WithValue(ctx, consumerInfoKey{}, info)
+}
+
+// ConsumerInfoFromContext Get consumer info from handler context
+func ConsumerInfoFromContext(ctx context.Context) ConsumerInfo {
+	info, _ := ctx.Value(consumerInfoKey{}).(ConsumerInfo)
+	return info
+}
+
+// RejectError Create error for rejecting delivery without requeue
+func RejectError(message string) porterr.IError {
+	return porterr.New(HandlerErrorReject, message)
+}
+
+// Chain Wrap handler with middlewares
+// First middleware is the outermost
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
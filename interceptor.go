@@ -0,0 +1,218 @@
+package gorabbit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+const (
+	// PublishErrorValidation Publish error code. Message is not valid for queue
+	PublishErrorValidation = "GORABBIT_PUBLISH_VALIDATION"
+	// PublishErrorBodySize Publish error code. Message body exceeds limit
+	PublishErrorBodySize = "GORABBIT_PUBLISH_BODY_SIZE"
+
+	// HeaderTenant Tenant header set by TenantInterceptor
+	HeaderTenant = "x-tenant-id"
+)
+
+// PublishMessage Message on the way to the pool
+type PublishMessage struct {
+	// AMQP message. Headers can be modified by interceptors
+	Publishing amqp.Publishing
+	// Queue name from config
+	Queue string
+	// Server name from config
+	Server string
+	// Routing keys
+	Route []string
+}
+
+// PublishFunc Publish function
+type PublishFunc func(ctx context.Context, m *PublishMessage) porterr.IError
+
+// PublishInterceptor Publish function decorator
+type PublishInterceptor func(next PublishFunc) PublishFunc
+
+// ChainPublish Wrap publish function with interceptors
+// First interceptor is the outermost
+func ChainPublish(f PublishFunc, interceptors ...PublishInterceptor) PublishFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		f = interceptors[i](f)
+	}
+	return f
+}
+
+// UsePublish Add global publish interceptors
+// Global interceptors are applied before interceptors of queue
+func (a *Application) UsePublish(i ...PublishInterceptor) *Application {
+	a.interceptors = append(a.interceptors, i...)
+	return a
+}
+
+// RegisterPublishInterceptor Register interceptor for use in queue config by name
+func (a *Application) RegisterPublishInterceptor(name string, i PublishInterceptor) *Application {
+	if a.namedInterceptors == nil {
+		a.namedInterceptors = make(map[string]PublishInterceptor)
+	}
+	a.namedInterceptors[name] = i
+	return a
+}
+
+// Get interceptors for queue
+func (a *Application) publishInterceptors(q *RabbitQueue) ([]PublishInterceptor, porterr.IError) {
+	if len(q.Interceptors) == 0 {
+		return a.interceptors, nil
+	}
+	interceptors := append([]PublishInterceptor(nil), a.interceptors...)
+	for _, name := range q.Interceptors {
+		i, ok := a.namedInterceptors[name]
+		if !ok {
+			return nil, porterr.NewF(porterr.PortErrorParam, "Publish interceptor '%s' of queue '%s' is not registered", name, q.Name)
+		}
+		interceptors = append(interceptors, i)
+	}
+	return interceptors, nil
+}
+
+// NewMessageId Generate random UUID v4
+func NewMessageId() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	buf := make([]byte, 36)
+	hex.Encode(buf, id[:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], id[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], id[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], id[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], id[10:])
+	return string(buf)
+}
+
+// MessageIdInterceptor Set MessageId if empty. Nil generator means NewMessageId
+func MessageIdInterceptor(generator func() string) PublishInterceptor {
+	if generator == nil {
+		generator = NewMessageId
+	}
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, m *PublishMessage) porterr.IError {
+			if m.Publishing.MessageId == "" {
+				m.Publishing.MessageId = generator()
+			}
+			return next(ctx, m)
+		}
+	}
+}
+
+// TimestampInterceptor Set Timestamp if empty
+func TimestampInterceptor() PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, m *PublishMessage) porterr.IError {
+			if m.Publishing.Timestamp.IsZero() {
+				m.Publishing.Timestamp = time.Now()
+			}
+			return next(ctx, m)
+		}
+	}
+}
+
+// AppIdInterceptor Set AppId if empty
+func AppIdInterceptor(appId string) PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, m *PublishMessage) porterr.IError {
+			if m.Publishing.AppId == "" {
+				m.Publishing.AppId = appId
+			}
+			return next(ctx, m)
+		}
+	}
+}
+
+// Context key of correlation id
+type correlationIdKey struct{}
+
+// ContextWithCorrelationId Put correlation id to context
+func ContextWithCorrelationId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIdKey{}, id)
+}
+
+// CorrelationIdFromContext Get correlation id from context
+func CorrelationIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIdKey{}).(string)
+	return id
+}
+
+// CorrelationIdInterceptor Set CorrelationId from context if empty
+func CorrelationIdInterceptor() PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, m *PublishMessage) porterr.IError {
+			if m.Publishing.CorrelationId == "" {
+				m.Publishing.CorrelationId = CorrelationIdFromContext(ctx)
+			}
+			return next(ctx, m)
+		}
+	}
+}
+
+// Context key of tenant
+type tenantKey struct{}
+
+// ContextWithTenant Put tenant to context
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext Get tenant from context
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// TenantInterceptor Set HeaderTenant from context if not set
+func TenantInterceptor() PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, m *PublishMessage) porterr.IError {
+			if tenant := TenantFromContext(ctx); tenant != "" {
+				if m.Publishing.Headers == nil {
+					m.Publishing.Headers = make(amqp.Table)
+				}
+				if _, ok := m.Publishing.Headers[HeaderTenant]; !ok {
+					m.Publishing.Headers[HeaderTenant] = tenant
+				}
+			}
+			return next(ctx, m)
+		}
+	}
+}
+
+// ValidateInterceptor Reject message with PublishErrorValidation when validator returns error
+func ValidateInterceptor(validator func(m *PublishMessage) error) PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, m *PublishMessage) porterr.IError {
+			if err := validator(m); err != nil {
+				return porterr.NewF(PublishErrorValidation, "Message for queue '%s' is not valid: %s", m.Queue, err.Error())
+			}
+			return next(ctx, m)
+		}
+	}
+}
+
+// MaxBodySizeInterceptor Reject message with PublishErrorBodySize when body exceeds limit in bytes
+func MaxBodySizeInterceptor(limit int) PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, m *PublishMessage) porterr.IError {
+			if len(m.Publishing.Body) > limit {
+				return porterr.NewF(PublishErrorBodySize, "Message body size %d exceeds limit %d for queue '%s'", len(m.Publishing.Body), limit, m.Queue)
+			}
+			return next(ctx, m)
+		}
+	}
+}
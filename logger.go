@@ -0,0 +1,188 @@
+package gorabbit
+
+import (
+	"fmt"
+	"github.com/dimonrus/gocli"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// LogLevel level of log entry
+type LogLevel int
+
+const (
+	// LogLevelDebug debug level
+	LogLevelDebug LogLevel = iota
+	// LogLevelInfo info level
+	LogLevelInfo
+	// LogLevelWarn warning level
+	LogLevelWarn
+	// LogLevelError error level
+	LogLevelError
+)
+
+// String name of level
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Log field keys
+const (
+	// FieldConsumer consumer name from registry
+	FieldConsumer = "consumer"
+	// FieldQueue queue name from config
+	FieldQueue = "queue"
+	// FieldServer server name from config
+	FieldServer = "server"
+	// FieldSubscriber subscriber name
+	FieldSubscriber = "subscriber"
+	// FieldDeliveryTag delivery tag
+	FieldDeliveryTag = "delivery_tag"
+	// FieldMessageId message id
+	FieldMessageId = "message_id"
+	// FieldRoutingKey routing key of delivery
+	FieldRoutingKey = "routing_key"
+	// FieldRedelivered redelivered flag
+	FieldRedelivered = "redelivered"
+	// FieldHeaders message headers
+	FieldHeaders = "headers"
+	// FieldBody message body
+	FieldBody = "body"
+	// FieldDuration processing duration
+	FieldDuration = "duration"
+	// FieldError error message
+	FieldError = "error"
+	// FieldOffset stream offset of delivery
+	FieldOffset = "offset"
+)
+
+// Field structured log field
+type Field struct {
+	// Field name
+	Key string
+	// Field value
+	Value interface{}
+}
+
+// F Create log field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger Structured level-aware logger
+type Logger interface {
+	// Log write entry with fields
+	Log(level LogLevel, msg string, fields ...Field)
+}
+
+// NopLogger Logger that does nothing
+type NopLogger struct{}
+
+// Log do nothing
+func (NopLogger) Log(level LogLevel, msg string, fields ...Field) {}
+
+// Adapter of gocli.Logger
+type gocliLogger struct {
+	// Wrapped logger
+	logger gocli.Logger
+	// Minimal level of entry
+	level LogLevel
+}
+
+// NewGocliLogger Create structured logger on top of gocli.Logger
+// Fields are written as key=value pairs. Entries below level are skipped
+func NewGocliLogger(l gocli.Logger, level LogLevel) Logger {
+	return &gocliLogger{logger: l, level: level}
+}
+
+// Log write entry
+func (g *gocliLogger) Log(level LogLevel, msg string, fields ...Field) {
+	if level < g.level {
+		return
+	}
+	line := FormatFields(msg, fields...)
+	switch level {
+	case LogLevelError:
+		g.logger.Errorln(line)
+	case LogLevelWarn:
+		g.logger.Warnln(line)
+	default:
+		g.logger.Infoln(line)
+	}
+}
+
+// FormatFields Format message with fields as key=value pairs
+func FormatFields(msg string, fields ...Field) string {
+	b := strings.Builder{}
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		value := fmt.Sprint(f.Value)
+		if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+// LogMode delivery logging mode of consumer
+type LogMode uint8
+
+const (
+	// LogModeMetadata log delivery metadata without body at debug level. Default mode
+	LogModeMetadata LogMode = iota
+	// LogModeOff do not log deliveries. Errors are logged
+	LogModeOff
+	// LogModeBody log delivery metadata with truncated and redacted body at info level
+	LogModeBody
+)
+
+// DefaultLogBodyLimit Default max length of logged body in bytes
+const DefaultLogBodyLimit = 1024
+
+// Redactor Replace sensitive data in body before logging
+type Redactor func(body []byte) []byte
+
+// TruncateBody Cut body to limit bytes on valid utf8 boundary
+func TruncateBody(body []byte, limit int) string {
+	if limit <= 0 || len(body) <= limit {
+		return string(body)
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return string(body[:cut]) + "...(" + strconv.Itoa(len(body)) + " bytes)"
+}
+
+// RedactJSONFields Replace values of json fields with ***
+func RedactJSONFields(fields ...string) Redactor {
+	if len(fields) == 0 {
+		return func(body []byte) []byte {
+			return body
+		}
+	}
+	names := make([]string, len(fields))
+	for i := range fields {
+		names[i] = regexp.QuoteMeta(fields[i])
+	}
+	re := regexp.MustCompile(`("(?:` + strings.Join(names, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`)
+	return func(body []byte) []byte {
+		return re.ReplaceAll(body, []byte(`${1}"***"`))
+	}
+}
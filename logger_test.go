@@ -0,0 +1,29 @@
+package gorabbit
+
+import (
+	"testing"
+)
+
+func TestFormatFields(t *testing.T) {
+	line := FormatFields("received", F(FieldConsumer, "orders"), F(FieldSubscriber, "Subscriber: a"), F(FieldMessageId, ""), F(FieldDeliveryTag, uint64(3)))
+	if line != `received consumer=orders subscriber="Subscriber: a" message_id="" delivery_tag=3` {
+		t.Fatalf("wrong line %s", line)
+	}
+}
+
+func TestTruncateBody(t *testing.T) {
+	if TruncateBody([]byte("hello"), 10) != "hello" || TruncateBody([]byte("hello"), -1) != "hello" {
+		t.Fatal("short body must not be truncated")
+	}
+	if v := TruncateBody([]byte("привет"), 3); v != "п...(12 bytes)" {
+		t.Fatalf("body must be truncated on rune boundary, got %s", v)
+	}
+}
+
+func TestRedactJSONFields(t *testing.T) {
+	redact := RedactJSONFields("password", "card")
+	body := redact([]byte(`{"user":"a","password":"p\"x","card": 4111, "nested":{"card":"1"}}`))
+	if string(body) != `{"user":"a","password":"***","card": "***", "nested":{"card":"***"}}` {
+		t.Fatalf("wrong redaction %s", body)
+	}
+}
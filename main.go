@@ -1,21 +1,61 @@
 package gorabbit
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/dimonrus/gocli"
 	"github.com/dimonrus/porterr"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
 	"time"
 )
 
 // Application Rabbit application struct
 type Application struct {
-	// Application configuration
-	config Config
+	// Application configuration. Replaced on reload
+	config *Config
+	// Lock for configuration
+	cm sync.RWMutex
+	// Load configuration for config reload command
+	configLoader ConfigLoader
+	// Lock for config reload. Concurrent reloads are applied one by one
+	lm sync.Mutex
 	// Consumer registry
 	registry Registry
+	// Lock for registry and handlers
+	rm sync.RWMutex
+	// Handlers available for consumers added at runtime
+	handlers map[string]Handler
 	// Publish connection pool
 	sp *ServerPool
+	// Dial function for consumer connections
+	dialer Dialer
+	// Metrics collector
+	metrics Metrics
+	// Tracer for publishing and processing spans
+	tracer Tracer
+	// Global middlewares of consumer handlers
+	middleware []Middleware
+	// Global publish interceptors
+	interceptors []PublishInterceptor
+	// Publish interceptors available for queue config
+	namedInterceptors map[string]PublishInterceptor
+	// Structured logger
+	logger Logger
+	// Lock for purge confirmation tokens
+	m sync.Mutex
+	// Purge confirmation tokens by queue name
+	purgeTokens map[string]purgeToken
+	// Lock for call clients and reply mode
+	rpcm sync.Mutex
+	// Call clients by server name
+	rpc map[string]*rpcClient
+	// Mode of receiving replies of calls
+	replyMode ReplyMode
+	// Lock for declared delay queues
+	dm sync.Mutex
+	// Time of declare of delay queues by server and queue name
+	delayQueues map[string]time.Time
 	// Basic application
 	gocli.Application
 }
@@ -23,42 +63,110 @@ type Application struct {
 // NewApplication New rabbit application
 func NewApplication(config Config, app gocli.Application) *Application {
 	return &Application{
-		config:      config,
+		config:      &config,
 		Application: app,
 		sp:          NewServerPool(app.GetLogger()),
 		registry:    make(Registry),
+		dialer:      DialAMQP,
+		metrics:     NopMetrics{},
+		tracer:      NopTracer{},
 	}
 }
 
+// Use Add global middlewares for all consumer handlers
+// Global middlewares are applied before middlewares of consumer
+func (a *Application) Use(m ...Middleware) *Application {
+	a.middleware = append(a.middleware, m...)
+	return a
+}
+
+// SetStructuredLogger Set structured logger for consumers
+func (a *Application) SetStructuredLogger(l Logger) *Application {
+	a.logger = l
+	return a
+}
+
+// GetStructuredLogger Get structured logger
+// Logger of application is wrapped when structured logger is not set
+func (a *Application) GetStructuredLogger() Logger {
+	if a.logger == nil {
+		return NewGocliLogger(a.GetLogger(), LogLevelInfo)
+	}
+	return a.logger
+}
+
+// SetTracer Set tracer for publishing and processing spans
+func (a *Application) SetTracer(t Tracer) *Application {
+	a.tracer = t
+	return a
+}
+
+// SetMetrics Set metrics collector for consumers and publisher
+func (a *Application) SetMetrics(m Metrics) *Application {
+	a.metrics = m
+	a.sp.SetMetrics(m)
+	return a
+}
+
+// GetMetrics Get metrics collector
+func (a *Application) GetMetrics() Metrics {
+	return a.metrics
+}
+
+// SetDialer Set dialer for consumer and publisher connections
+func (a *Application) SetDialer(d Dialer) *Application {
+	a.dialer = d
+	a.sp.SetDialer(d)
+	return a
+}
+
 // SetRegistry Set registry of subscribers
 func (a *Application) SetRegistry(r Registry) *Application {
+	a.rm.Lock()
+	defer a.rm.Unlock()
 	a.registry = r
 	return a
 }
 
 // GetConfig Get app config
+// Config is replaced on reload. Keep returned pointer to use consistent config
 func (a *Application) GetConfig() *Config {
-	return &a.config
+	a.cm.RLock()
+	defer a.cm.RUnlock()
+	return a.config
 }
 
-// GetRegistry Get registry of subscribers
+// GetRegistry Get copy of registry of subscribers
+// Use RegisterConsumer and UnregisterConsumer to change registry
 func (a *Application) GetRegistry() Registry {
-	return a.registry
+	a.rm.RLock()
+	defer a.rm.RUnlock()
+	registry := make(Registry, len(a.registry))
+	for name, consumer := range a.registry {
+		registry[name] = consumer
+	}
+	return registry
 }
 
-// Consume Create new consumer
+// Consume Create new consumer. Blocks until consumer is stopped or connection is closed
 func (a *Application) Consume(name string) porterr.IError {
-	consumer, ok := a.registry[name]
-	if !ok {
-		return porterr.NewF(porterr.PortErrorParam, "Consumer '%s' not found in registry", name)
+	return a.consume(name, false)
+}
+
+// Consume queue. State of supervised consumer is not reset on return
+func (a *Application) consume(name string, supervised bool) porterr.IError {
+	consumer, e := a.getConsumer(name)
+	if e != nil {
+		return e
 	}
+	config := a.GetConfig()
 	// Get server
-	srv, e := a.GetConfig().GetServer(consumer.Server)
+	srv, e := config.GetServer(consumer.Server)
 	if e != nil {
 		return e
 	}
 	// Get Queue
-	q, e := a.config.GetQueue(consumer.Queue)
+	q, e := config.GetQueue(consumer.Queue)
 	if e != nil {
 		return e
 	}
@@ -66,42 +174,66 @@ func (a *Application) Consume(name string) porterr.IError {
 		e = porterr.New(porterr.PortErrorParam, "exchange is not defined")
 		return e
 	}
-	consumer.stop = make(chan struct{})
-	var err error
+	// Prefetch of consumer overrides prefetch of queue
+	prefetch := consumer.channelPrefetch(q)
+	if e = consumer.validate(q); e != nil {
+		return e
+	}
+	stop := make(chan struct{})
+	var done chan struct{}
+	if !supervised {
+		// Stop of consumer started with Consume waits until connection is closed
+		done = make(chan struct{})
+		defer close(done)
+	}
+	consumer.name = name
+	consumer.metrics = a.metrics
+	consumer.tracer = a.tracer
+	consumer.logger = a.GetStructuredLogger()
+	consumer.middleware = a.middleware
+	consumer.reply = a.Reply
+	consumer.stream = q.isStream()
+	consumer.handler = consumer.chain()
 	// Dial to server
-	consumer.connection, err = amqp.Dial(srv.String())
+	conn, err := a.dialer(srv.String())
 	if err != nil {
 		e = porterr.NewF(porterr.PortErrorConnection, "Failed connect to %s RabbitMQ Server", srv.Host)
 		return e
 	}
 	// Get channel
-	consumer.channel, err = consumer.connection.Channel()
+	channel, err := conn.Channel()
 	if err != nil {
+		_ = conn.Close()
 		e = porterr.NewF(porterr.PortErrorConnection, "RabbitMQ Channel Error")
 		return e
 	}
+	consumer.setConnection(conn, channel)
 	// Close channel and connection on return
 	defer func() {
 		// Close channel
-		err := consumer.channel.Close()
+		err := channel.Close()
 		if err != nil {
 			a.FailMessage("Channel close error: " + err.Error())
 		}
 		// Close connection
-		err = consumer.connection.Close()
+		err = conn.Close()
 		if err != nil {
 			a.FailMessage("Connection close error: " + err.Error())
 		}
 	}()
 	// Init exchange
-	err = consumer.channel.ExchangeDeclare(q.Exchange, q.Type, q.Durable, q.AutoDelete, q.Internal, q.Nowait, q.Arguments)
+	err = channel.ExchangeDeclare(q.Exchange, q.Type, q.Durable, q.AutoDelete, q.Internal, q.Nowait, q.Arguments)
 	if err != nil {
 		e = porterr.NewF(porterr.PortErrorConnection, "Failed to declare exchange: '%s'", q.Name)
 		return e
 	}
-	// Declare queue
+	// Declare queue with typed options converted to arguments
+	args, e := q.QueueArguments()
+	if e != nil {
+		return e
+	}
 	consumer.queue = new(amqp.Queue)
-	*consumer.queue, err = consumer.channel.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, q.Nowait, q.Arguments)
+	*consumer.queue, err = channel.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, q.Nowait, args)
 	if err != nil {
 		e = porterr.NewF(porterr.PortErrorConnection, "Failed to declare a queue: '%s'", q.Name)
 		return e
@@ -113,186 +245,214 @@ func (a *Application) Consume(name string) porterr.IError {
 	// Walk on routing keys
 	for _, key := range q.RoutingKey {
 		// Bind queue for routing key
-		err = consumer.channel.QueueBind(consumer.queue.Name, key, q.Exchange, q.Nowait, q.Arguments)
+		err = channel.QueueBind(consumer.queue.Name, key, q.Exchange, q.Nowait, q.Arguments)
 		if err != nil {
 			e = porterr.NewF(porterr.PortErrorConnection, "Failed to bind a queue: '%s' for key '%s'", q.Name, key)
 			return e
 		}
 	}
-	// If prefetch defined
-	if !q.Prefetch.IsEmpty() {
+	consumer.setIsolation(func() (Connection, error) { return a.dialer(srv.String()) }, prefetch)
+	// If prefetch defined. Isolated subscribers set prefetch on own channels
+	if !prefetch.IsEmpty() && consumer.Isolation == IsolationShared {
 		// Set prefetchCount to allow messages before Acks are returned
-		if err = consumer.channel.Qos(q.Prefetch.Count, q.Prefetch.Size, false); err != nil {
-			return porterr.NewF(porterr.PortErrorParam, "Prefetch error: ", err.Error())
+		if err = channel.Qos(prefetch.Count, prefetch.Size, false); err != nil {
+			return porterr.NewF(porterr.PortErrorParam, "Prefetch error: %s", err.Error())
 		}
 	}
 	ce := make(chan *amqp.Error)
+	failed := make(chan porterr.IError, 1)
+	// Listener is registered before subscribe to not miss close of channel
+	channel.NotifyClose(ce)
 	// Listen unexpected close the channel
 	go func() {
-		consumer.channel.NotifyClose(ce)
 		select {
 		case ae := <-ce:
 			if ae != nil {
 				a.FailMessage("Channel closed: " + ae.Error())
+				consumer.setLastError(ae.Error())
+				a.metrics.Reconnect(consumer.labels())
 				// Exit from child goroutine
-				e = porterr.New(porterr.PortErrorSystem, ae.Error())
+				failed <- porterr.New(porterr.PortErrorSystem, ae.Error())
 				consumer.Stop()
 			}
 		}
 	}()
-	e = consumer.Subscribe(a.GetLogger())
-	if e != nil {
+	started, e := consumer.start(stop, done, a.GetLogger())
+	if e != nil || !started {
 		return e
 	}
-	a.SuccessMessage(fmt.Sprintf("Subscribers for '%s' are started", name))
+	if !supervised {
+		defer consumer.setState(ConsumerStateIdle)
+	}
+	if consumer.IsPaused() {
+		a.AttentionMessage(fmt.Sprintf("Consumer '%s' is connected and paused", name))
+	} else {
+		a.SuccessMessage(fmt.Sprintf("Subscribers for '%s' are started", name))
+	}
+	consumer.setStartedAt(time.Now())
 	// Wait until consumer stop
-	<-consumer.stop
-	a.SuccessMessage("Close consuming for queue: " + consumer.Queue)
+	<-stop
+	consumer.setStartedAt(time.Time{})
+	select {
+	case e = <-failed:
+	default:
+		a.SuccessMessage("Close consuming for queue: " + consumer.Queue)
+	}
 	return e
 }
 
 // ConsumerCommander Consumer command processor
+// Commands started with keyword queue inspect and purge queues from config
+// Command config reload loads configuration with ConfigLoader and applies it
+// Flag --json switches reply to machine-readable format
 func (a *Application) ConsumerCommander(command *gocli.Command) {
 	a.SuccessMessage("Receive command: " + command.String())
+	if args := command.Arguments(); len(args) > 0 && args[0].Name == CommandQueue {
+		a.queueCommander(command)
+		return
+	}
+	if args := command.Arguments(); len(args) > 0 && args[0].Name == CommandConfig {
+		a.configCommander(command)
+		return
+	}
 	action, args, e := ParseCommand(command)
 	if e != nil {
 		a.FatalError(e)
 		return
 	}
+	args, asJSON := ParseOutputFormat(command, args)
+	if len(args) == 0 {
+		a.FailMessage("Consumer command must contain action with argument", command)
+		return
+	}
 	switch action {
-	case CommandStart:
-		for name := range a.GetRegistry() {
-			if args[0].GetString() == CommandKeyWordAll {
-				if a.GetRegistry()[name].HasSubscribers() {
-					a.AttentionMessage(fmt.Sprintf("Subscribers for '%s' already started", name), command)
-					continue
-				}
-				a.SuccessMessage(fmt.Sprintf("Starting subscribe for '%s' consumer", name), command)
-				go func(n string) {
-					e := a.Consume(n)
-					if e != nil {
-						a.FailMessage(e.Error(), command)
-						time.Sleep(time.Second)
-						// Run each consumer if fail all start
-						a.ConsumerCommander(gocli.ParseCommand([]byte(CommandConsumer + " " + CommandStart + " " + n)))
-					}
-				}(name)
-			} else {
-				for _, v := range args {
-					if v.GetString() == name {
-						if a.GetRegistry()[name].HasSubscribers() {
-							a.AttentionMessage(fmt.Sprintf("Subscribers for '%s' already started", name), command)
-							continue
-						}
-						a.SuccessMessage(fmt.Sprintf("Starting subscribe for '%s' consumer", name), command)
-						go func(n string) {
-							e := a.Consume(n)
-							if e != nil {
-								a.FailMessage(e.Error(), command)
-								time.Sleep(time.Second)
-								a.ConsumerCommander(command)
-							}
-						}(name)
-					}
+	case CommandStatus:
+		statuses := make([]ConsumerStatus, 0)
+		for _, name := range a.commandConsumers(args) {
+			status, e := a.ConsumerStatus(name)
+			if e != nil {
+				if !asJSON {
+					a.FailMessage(e.Error(), command)
 				}
+				continue
 			}
-		}
-	case CommandStop:
-		for name := range a.GetRegistry() {
-			if args[0].GetString() == CommandKeyWordAll {
-				if !a.GetRegistry()[name].HasSubscribers() {
-					a.AttentionMessage(fmt.Sprintf("Subscribers for '%s' already stopped", name), command)
-					continue
-				}
-				a.AttentionMessage(fmt.Sprintf("Stopping subscribers for '%s'", name), command)
-				a.GetRegistry()[name].Stop()
-			} else {
-				for _, v := range args {
-					if v.GetString() == name {
-						if !a.GetRegistry()[name].HasSubscribers() {
-							a.AttentionMessage(fmt.Sprintf("Subscribers for '%s' already stopped", name), command)
-							continue
-						}
-						a.AttentionMessage(fmt.Sprintf("Stopping subscribers for '%s'", name), command)
-						a.GetRegistry()[name].Stop()
-					}
-				}
+			statuses = append(statuses, status)
+			if !asJSON {
+				a.SuccessMessage(fmt.Sprintf("Consumer '%s' have a %v subscribers", name, status.Subscribers), command)
 			}
 		}
-	case CommandRestart:
-		for name := range a.GetRegistry() {
-			if args[0].GetString() == CommandKeyWordAll {
-				if a.GetRegistry()[name].HasSubscribers() {
-					a.AttentionMessage(fmt.Sprintf("Stopping subscribers for '%s'", name), command)
-					a.GetRegistry()[name].Stop()
-				}
-				a.SuccessMessage(fmt.Sprintf("Starting subscribe for '%s' consumer", name), command)
-				go func(n string) {
-					e := a.Consume(n)
-					if e != nil {
-						a.FailMessage(e.Error(), command)
-						time.Sleep(time.Second)
-						a.ConsumerCommander(command)
-					}
-				}(name)
-			} else {
-				for _, v := range args {
-					if v.GetString() == name {
-						if a.GetRegistry()[name].HasSubscribers() {
-							a.AttentionMessage(fmt.Sprintf("Stopping subscribers for '%s'", name), command)
-							a.GetRegistry()[name].Stop()
-						}
-						a.SuccessMessage(fmt.Sprintf("Starting subscribe for '%s' consumer", name), command)
-						go func(n string) {
-							e := a.Consume(n)
-							if e != nil {
-								a.FailMessage(e.Error(), command)
-								time.Sleep(time.Second)
-								a.ConsumerCommander(command)
-							}
-						}(name)
-					}
-				}
-			}
+		if asJSON {
+			a.respondJSON(command, statuses)
 		}
-	case CommandStatus:
-		for name := range a.GetRegistry() {
-			if args[0].GetString() == CommandKeyWordAll {
-				a.SuccessMessage(fmt.Sprintf("Consumer '%s' have a %v subscribers", name, a.GetRegistry()[name].SubscribersCount()), command)
-			} else {
-				for _, v := range args {
-					if v.GetString() == name {
-						a.SuccessMessage(fmt.Sprintf("Consumer '%s' have a %v subscribers", name, a.GetRegistry()[name].SubscribersCount()), command)
-					}
-				}
+	case CommandStart, CommandStop, CommandRestart, CommandPause, CommandResume, CommandRemove:
+		results := make([]ConsumerCommandResult, 0)
+		names := a.commandConsumers(args)
+		// Registry must not be cleared by mistake
+		if action == CommandRemove && args[0].GetString() == CommandKeyWordAll {
+			names = nil
+			e := porterr.New(porterr.PortErrorParam, "Keyword all is not allowed for remove. Consumer names are required")
+			results = append(results, a.commandResult(command, CommandKeyWordAll, action, e, !asJSON))
+		}
+		for _, name := range names {
+			var e porterr.IError
+			switch action {
+			case CommandStart:
+				e = a.StartConsumer(name)
+			case CommandStop:
+				e = a.StopConsumer(name)
+			case CommandRestart:
+				e = a.RestartConsumer(name)
+			case CommandPause:
+				e = a.PauseConsumer(name)
+			case CommandResume:
+				e = a.ResumeConsumer(name)
+			case CommandRemove:
+				e = a.UnregisterConsumer(name)
 			}
+			results = append(results, a.commandResult(command, name, action, e, !asJSON))
+		}
+		if asJSON {
+			a.respondJSON(command, results)
+		}
+	case CommandAdd:
+		name, e := a.addConsumer(args)
+		result := a.commandResult(command, name, CommandAdd, e, !asJSON)
+		if asJSON {
+			a.respondJSON(command, []ConsumerCommandResult{result})
 		}
 	case CommandSet:
-		if args[0].GetString() == CommandKeyWordCount {
-			count := args[1].GetInt()
-			for name := range a.GetRegistry() {
-				for _, v := range args[2:] {
-					if v.GetString() == name {
-						if a.GetRegistry()[name].HasSubscribers() {
-							a.GetRegistry()[name].Stop()
-						}
-						a.SuccessMessage(fmt.Sprintf("Consumer '%s' set subscribers count to: %v ", name, count), command)
-						a.GetRegistry()[name].Count = uint8(count)
-						go func(n string) {
-							e := a.Consume(n)
-							if e != nil {
-								a.FailMessage(e.Error(), command)
-								time.Sleep(time.Second)
-								a.ConsumerCommander(command)
-							}
-						}(name)
-					}
-				}
-			}
-		} else {
+		if args[0].GetString() != CommandKeyWordCount || len(args) < 2 {
 			a.AttentionMessage(fmt.Sprintf("Unknown set command: "+command.GetOrigin()), command)
+			return
+		}
+		count := args[1].GetInt()
+		results := make([]ConsumerCommandResult, 0)
+		for _, name := range a.commandConsumers(args[2:]) {
+			e := a.SetConsumerCount(name, int(count))
+			results = append(results, a.commandResult(command, name, CommandSet, e, !asJSON))
+		}
+		if asJSON {
+			a.respondJSON(command, results)
 		}
 	default:
 		a.AttentionMessage(fmt.Sprintf("Unknown command: "+command.GetOrigin()), command)
 	}
 }
+
+// Names of consumers from command arguments. Keyword all means all consumers from registry
+func (a *Application) commandConsumers(args []gocli.Argument) []string {
+	if len(args) > 0 && args[0].GetString() == CommandKeyWordAll {
+		return a.consumerNames()
+	}
+	names := make([]string, 0, len(args))
+	for _, v := range args {
+		names = append(names, v.GetString())
+	}
+	return names
+}
+
+// Create result of consumer action and print message when verbose
+func (a *Application) commandResult(command *gocli.Command, name string, action string, e porterr.IError, verbose bool) ConsumerCommandResult {
+	result := ConsumerCommandResult{Name: name, Action: action}
+	if e != nil {
+		result.Code = fmt.Sprint(e.GetCode())
+		result.Error = e.Error()
+	}
+	result.Status, _ = a.ConsumerStatus(name)
+	if !verbose {
+		return result
+	}
+	switch {
+	case e == nil && action == CommandStop:
+		a.AttentionMessage(fmt.Sprintf("Stopping subscribers for '%s'", name), command)
+	case e == nil && action == CommandPause:
+		a.AttentionMessage(fmt.Sprintf("Consumer '%s' is paused", name), command)
+	case e == nil && action == CommandResume:
+		a.SuccessMessage(fmt.Sprintf("Consumer '%s' is resumed", name), command)
+	case e == nil && action == CommandAdd:
+		a.SuccessMessage(fmt.Sprintf("Consumer '%s' is registered", name), command)
+	case e == nil && action == CommandRemove:
+		a.AttentionMessage(fmt.Sprintf("Consumer '%s' is removed", name), command)
+	case e == nil && action == CommandSet:
+		a.SuccessMessage(fmt.Sprintf("Consumer '%s' set subscribers count to: %v ", name, result.Status.Desired), command)
+	case e == nil:
+		a.SuccessMessage(fmt.Sprintf("Starting subscribe for '%s' consumer", name), command)
+	case isConsumerStateError(e):
+		a.AttentionMessage(e.Error(), command)
+	default:
+		a.FailMessage(e.Error(), command)
+	}
+	return result
+}
+
+// Write json reply to command connection
+func (a *Application) respondJSON(command *gocli.Command, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		a.FailMessage("JSON marshal error: "+err.Error(), command)
+		return
+	}
+	if e := command.Response(append(data, '\n')); e != nil {
+		a.GetLogger().Errorln(e)
+	}
+}
@@ -0,0 +1,107 @@
+package gorabbit
+
+import (
+	"time"
+)
+
+// Labels metric labels
+type Labels struct {
+	// Server name from config
+	Server string
+	// Queue name from config
+	Queue string
+	// Consumer name from registry
+	Consumer string
+}
+
+// Metrics consumer and publisher metrics collector
+// Implementation must be safe for concurrent use
+type Metrics interface {
+	// DeliveryReceived delivery received by subscriber
+	DeliveryReceived(l Labels)
+	// DeliveryAcked delivery acked after processing
+	DeliveryAcked(l Labels)
+	// DeliveryNacked delivery nacked after processing
+	DeliveryNacked(l Labels)
+	// DeliveryRejected delivery rejected after processing
+	DeliveryRejected(l Labels)
+	// HandlerDuration duration of delivery processing
+	HandlerDuration(l Labels, d time.Duration)
+	// HandlerPanic handler panic recovered
+	HandlerPanic(l Labels)
+	// InFlight change count of deliveries in processing
+	InFlight(l Labels, delta int)
+
+	// Published message published and confirmed
+	Published(l Labels)
+	// PublishConfirmDuration time between publish and confirmation
+	PublishConfirmDuration(l Labels, d time.Duration)
+	// PublishNacked message negatively confirmed by server
+	PublishNacked(l Labels)
+	// PublishReturned mandatory message returned as unroutable
+	PublishReturned(l Labels)
+	// PublishRetry publish retried after error
+	PublishRetry(l Labels)
+	// PoolSize count of open connections in publish pool
+	PoolSize(l Labels, size int)
+	// PoolWait time spent on connection acquire
+	PoolWait(l Labels, d time.Duration)
+	// Reconnect connection reopened after failure
+	Reconnect(l Labels)
+}
+
+// DedupMetrics Optional metrics of DedupMiddleware
+// Collected when Metrics collector implements it
+type DedupMetrics interface {
+	// DeliveryDuplicate duplicate delivery acked without processing
+	DeliveryDuplicate(l Labels)
+}
+
+// NopMetrics Metrics collector that does nothing
+// Can be embedded to implement only part of Metrics
+type NopMetrics struct{}
+
+// DeliveryReceived do nothing
+func (NopMetrics) DeliveryReceived(l Labels) {}
+
+// DeliveryAcked do nothing
+func (NopMetrics) DeliveryAcked(l Labels) {}
+
+// DeliveryNacked do nothing
+func (NopMetrics) DeliveryNacked(l Labels) {}
+
+// DeliveryRejected do nothing
+func (NopMetrics) DeliveryRejected(l Labels) {}
+
+// HandlerDuration do nothing
+func (NopMetrics) HandlerDuration(l Labels, d time.Duration) {}
+
+// HandlerPanic do nothing
+func (NopMetrics) HandlerPanic(l Labels) {}
+
+// InFlight do nothing
+func (NopMetrics) InFlight(l Labels, delta int) {}
+
+// Published do nothing
+func (NopMetrics) Published(l Labels) {}
+
+// PublishConfirmDuration do nothing
+func (NopMetrics) PublishConfirmDuration(l Labels, d time.Duration) {}
+
+// PublishNacked do nothing
+func (NopMetrics) PublishNacked(l Labels) {}
+
+// PublishReturned do nothing
+func (NopMetrics) PublishReturned(l Labels) {}
+
+// PublishRetry do nothing
+func (NopMetrics) PublishRetry(l Labels) {}
+
+// PoolSize do nothing
+func (NopMetrics) PoolSize(l Labels, size int) {}
+
+// PoolWait do nothing
+func (NopMetrics) PoolWait(l Labels, d time.Duration) {}
+
+// Reconnect do nothing
+func (NopMetrics) Reconnect(l Labels) {}
@@ -0,0 +1,80 @@
+package gorabbit
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestPrometheusMetrics_WriteTo(t *testing.T) {
+	m := NewPrometheusMetrics([]float64{0.1, 1})
+	l := Labels{Server: "local", Queue: "q", Consumer: "c"}
+	m.DeliveryReceived(l)
+	m.DeliveryReceived(l)
+	m.InFlight(l, 1)
+	m.InFlight(l, -1)
+	m.HandlerDuration(l, time.Millisecond*50)
+	m.HandlerDuration(l, time.Millisecond*500)
+	m.HandlerDuration(l, time.Second*5)
+	m.PoolSize(Labels{Server: "local"}, 3)
+
+	buf := new(bytes.Buffer)
+	n, err := m.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(n) != buf.Len() {
+		t.Fatalf("written %v bytes, reported %v", buf.Len(), n)
+	}
+	for _, line := range []string{
+		`# TYPE gorabbit_consumer_deliveries_received_total counter`,
+		`gorabbit_consumer_deliveries_received_total{server="local",queue="q",consumer="c"} 2`,
+		`gorabbit_consumer_in_flight{server="local",queue="q",consumer="c"} 0`,
+		`# TYPE gorabbit_consumer_handler_duration_seconds histogram`,
+		`gorabbit_consumer_handler_duration_seconds_bucket{server="local",queue="q",consumer="c",le="0.1"} 1`,
+		`gorabbit_consumer_handler_duration_seconds_bucket{server="local",queue="q",consumer="c",le="1"} 2`,
+		`gorabbit_consumer_handler_duration_seconds_bucket{server="local",queue="q",consumer="c",le="+Inf"} 3`,
+		`gorabbit_consumer_handler_duration_seconds_count{server="local",queue="q",consumer="c"} 3`,
+		`gorabbit_publisher_pool_connections{server="local",queue="",consumer=""} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing line %s", line)
+		}
+	}
+	if strings.Contains(buf.String(), "gorabbit_publisher_published_total") {
+		t.Error("metric without values must be skipped")
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Header().Get("Content-Type") != PrometheusContentType || rec.Body.String() != buf.String() {
+		t.Fatal("wrong http exposition")
+	}
+}
+
+func TestConnectionPool_PublishMetrics(t *testing.T) {
+	cp, _ := newTestPool(RabbitServer{MaxConnections: 1})
+	m := NewPrometheusMetrics(nil)
+	cp.metrics = m
+	cp.name = "local"
+	if e := cp.Publish(context.Background(), amqp.Publishing{}, RabbitQueue{Name: "q"}, "a", "b"); e != nil {
+		t.Fatal(e)
+	}
+	buf := new(bytes.Buffer)
+	_, _ = m.WriteTo(buf)
+	for _, line := range []string{
+		`gorabbit_publisher_published_total{server="local",queue="q",consumer=""} 2`,
+		`gorabbit_publisher_confirm_duration_seconds_count{server="local",queue="q",consumer=""} 2`,
+		`gorabbit_publisher_pool_wait_seconds_count{server="local",queue="",consumer=""} 1`,
+		`gorabbit_publisher_pool_connections{server="local",queue="",consumer=""} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing line %s", line)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package gorabbit
+
+import (
+	"context"
+	"errors"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"runtime/debug"
+	"time"
+)
+
+// RecoverMiddleware Recover handler panic and return HandlerErrorPanic error after pause
+// Not positive delay disables pause
+func RecoverMiddleware(delay time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, d amqp.Delivery) (e porterr.IError) {
+			defer func() {
+				if r := recover(); r != nil {
+					e = porterr.NewF(HandlerErrorPanic, "%v \n %s", r, debug.Stack())
+					if delay > 0 {
+						time.Sleep(delay)
+					}
+				}
+			}()
+			return next(ctx, d)
+		}
+	}
+}
+
+// TimeoutMiddleware Limit processing time of delivery
+// Handler must respect context. Error returned after deadline is replaced by HandlerErrorTimeout
+func TimeoutMiddleware(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, d amqp.Delivery) porterr.IError {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			e := next(ctx, d)
+			if e != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return porterr.NewF(HandlerErrorTimeout, "processing timeout %s exceeded: %s", timeout, e.Error())
+			}
+			return e
+		}
+	}
+}
+
+// LoggingMiddleware Log result of processing with consumer and delivery fields
+func LoggingMiddleware(logger Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, d amqp.Delivery) porterr.IError {
+			start := time.Now()
+			e := next(ctx, d)
+			info := ConsumerInfoFromContext(ctx)
+			fields := []Field{
+				F(FieldConsumer, info.Name),
+				F(FieldQueue, info.Queue),
+				F(FieldSubscriber, info.Subscriber),
+				F(FieldDeliveryTag, d.DeliveryTag),
+				F(FieldMessageId, d.MessageId),
+				F(FieldDuration, time.Since(start)),
+			}
+			if e != nil {
+				logger.Log(LogLevelError, "delivery processed", append(fields, F(FieldError, e.Error()))...)
+			} else {
+				logger.Log(LogLevelInfo, "delivery processed", fields...)
+			}
+			return e
+		}
+	}
+}
+
+// MetricsMiddleware Collect delivery metrics labeled with consumer from context
+func MetricsMiddleware(m Metrics) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, d amqp.Delivery) porterr.IError {
+			labels := ConsumerInfoFromContext(ctx).Labels()
+			m.DeliveryReceived(labels)
+			m.InFlight(labels, 1)
+			start := time.Now()
+			e := next(ctx, d)
+			m.HandlerDuration(labels, time.Since(start))
+			m.InFlight(labels, -1)
+			switch {
+			case e == nil:
+				m.DeliveryAcked(labels)
+			case e.GetCode() == HandlerErrorPanic:
+				m.HandlerPanic(labels)
+				m.DeliveryRejected(labels)
+			case e.GetCode() == HandlerErrorReject:
+				m.DeliveryRejected(labels)
+			default:
+				m.DeliveryNacked(labels)
+			}
+			return e
+		}
+	}
+}
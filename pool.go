@@ -1,18 +1,26 @@
 package gorabbit
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/dimonrus/gocli"
-	"github.com/dimonrus/gohelp"
 	"github.com/dimonrus/porterr"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // MaxMessagesPerConnection will close connection on reach limit
-const MaxMessagesPerConnection = int64(50000)
+// Deprecated: use RabbitServer.MaxMessagesPerConnection
+const MaxMessagesPerConnection = DefaultMaxMessagesPerConnection
+
+const (
+	// PublishErrorNack message negatively confirmed by server
+	PublishErrorNack = "GORABBIT_PUBLISH_NACK"
+	// PublishErrorReturned mandatory message returned by server as unroutable
+	PublishErrorReturned = "GORABBIT_PUBLISH_RETURNED"
+)
 
 // ServerPool RabbitMq server Pool
 type ServerPool struct {
@@ -22,231 +30,543 @@ type ServerPool struct {
 	m sync.Mutex
 	// logger
 	logger gocli.Logger
+	// dialer for new connection pools
+	dialer Dialer
+	// metrics collector for new connection pools
+	metrics Metrics
 }
 
 // NewServerPool Init server pool
 func NewServerPool(l gocli.Logger) *ServerPool {
 	return &ServerPool{
-		pool:   make(map[string]*ConnectionPool),
-		logger: l,
+		pool:    make(map[string]*ConnectionPool),
+		logger:  l,
+		dialer:  DialAMQP,
+		metrics: NopMetrics{},
+	}
+}
+
+// SetDialer Set dialer for connection pools
+func (sp *ServerPool) SetDialer(d Dialer) *ServerPool {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	sp.dialer = d
+	return sp
+}
+
+// SetMetrics Set metrics collector for connection pools
+func (sp *ServerPool) SetMetrics(m Metrics) *ServerPool {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	sp.metrics = m
+	for _, p := range sp.pool {
+		p.metrics = m
 	}
+	return sp
 }
 
 // GetConnectionPoolOrCreate Get connection pool
 // If not - create
-func (sp *ServerPool) GetConnectionPoolOrCreate(server string, maxConnections int) *ConnectionPool {
+func (sp *ServerPool) GetConnectionPoolOrCreate(name string, server RabbitServer) *ConnectionPool {
 	sp.m.Lock()
 	defer sp.m.Unlock()
-	if _, ok := sp.pool[server]; !ok {
-		p := NewConnectionPool(maxConnections)
-		go func(pool *ConnectionPool) {
-			// idle connections
-			e := pool.idle(sp.logger)
-			// log error
-			if e != nil {
-				sp.logger.Errorln(e)
-			}
-		}(p)
-		sp.pool[server] = p
+	if _, ok := sp.pool[name]; !ok {
+		sp.pool[name] = sp.newPool(name, server)
+	}
+	return sp.pool[name]
+}
+
+// ReplacePool Close connection pool of server and install pool with new server config
+// Publisher racing with replace never recreates pool with old config
+func (sp *ServerPool) ReplacePool(name string, server RabbitServer) {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	if p, ok := sp.pool[name]; ok {
+		p.Close()
+	}
+	sp.pool[name] = sp.newPool(name, server)
+}
+
+// Create connection pool with dialer and metrics of server pool. Must be called under lock
+func (sp *ServerPool) newPool(name string, server RabbitServer) *ConnectionPool {
+	p := NewConnectionPool(server)
+	p.name = name
+	p.logger = sp.logger
+	p.dialer = sp.dialer
+	p.metrics = sp.metrics
+	return p
+}
+
+// Stats Get statistics of pools by server name
+func (sp *ServerPool) Stats() map[string]PoolStats {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	stats := make(map[string]PoolStats, len(sp.pool))
+	for name, p := range sp.pool {
+		stats[name] = p.Stats()
+	}
+	return stats
+}
+
+// ClosePool Close connection pool of server
+// New pool is created on next publish
+func (sp *ServerPool) ClosePool(name string) {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	if p, ok := sp.pool[name]; ok {
+		p.Close()
+		delete(sp.pool, name)
+	}
+}
+
+// Close all connection pools
+func (sp *ServerPool) Close() {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	for name, p := range sp.pool {
+		p.Close()
+		delete(sp.pool, name)
 	}
-	return sp.pool[server]
 }
 
 // ConnectionPool Connection pool
+// Each connection is leased exclusively with Acquire and returned with Release
 type ConnectionPool struct {
-	// Connection pool
-	// Uses round-robin algorithm
-	pool []*connection
-	// cursor for current connection
-	cursor int32
-	// Lock until using
+	// Server name
+	name string
+	// Server configuration
+	server RabbitServer
+	// Dial function
+	dialer Dialer
+	// logger
+	logger gocli.Logger
+	// Metrics collector
+	metrics Metrics
+	// Lock for pool state
 	m sync.Mutex
-	// flag shows that idle function in process
-	fIdle bool
-	// exit
-	exit chan struct{}
-	// request per second
-	rps int32
+	// Idle connections ready for lease
+	idle []*PoolConn
+	// Count of idle, leased and dialing connections
+	open int
+	// Queue of waiters. First in first served
+	waiters []chan *PoolConn
+	// Pool is closed
+	closed bool
 }
 
 // NewConnectionPool Init connection pool
-func NewConnectionPool(maxConnection int) *ConnectionPool {
+func NewConnectionPool(server RabbitServer) *ConnectionPool {
+	server.init()
 	return &ConnectionPool{
-		pool: make([]*connection, maxConnection),
+		server:  server,
+		dialer:  DialAMQP,
+		metrics: NopMetrics{},
+		idle:    make([]*PoolConn, 0, server.MaxConnections),
 	}
 }
 
-// Connection struct
-type connection struct {
+// PoolConn Connection with channel in confirm mode leased from pool with Acquire
+type PoolConn struct {
 	// amqp connection
-	conn *amqp.Connection
+	conn Connection
 	// amqp channel
-	channel *amqp.Channel
-	// limit for message rate
+	channel Channel
+	// publish confirmations of channel
+	confirms chan amqp.Confirmation
+	// returned messages of channel
+	returns chan amqp.Return
+	// count of messages published to channel
 	limitRate int64
-	// idle deadline UnixNano
-	deadline int64
-	// 0 - when connection is not busy
-	busy int32
+	// idle timer. Started on release
+	timer *time.Timer
+	// 1 - when connection closed by server or network
+	broken int32
 }
 
-// IsBusy check if connection is busy
-func (c *connection) IsBusy() bool {
-	return atomic.LoadInt32(&c.busy) != 0
+// Put channel into confirm mode and listen confirmations
+func (c *PoolConn) setChannel(channel Channel) error {
+	if err := channel.Confirm(false); err != nil {
+		return err
+	}
+	c.channel = channel
+	c.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	c.returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+	return nil
 }
 
-// Publish message
-func (c *connection) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (e porterr.IError) {
-	atomic.StoreInt32(&c.busy, 1)
-	defer func() {
-		atomic.AddInt64(&c.limitRate, 1)
-		atomic.StoreInt32(&c.busy, 0)
-	}()
+// Publish message and wait for server confirmation
+func (c *PoolConn) Publish(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (e porterr.IError) {
+	seq := c.channel.GetNextPublishSeqNo()
 	// channel publish
-	err := c.channel.Publish(exchange, key, mandatory, immediate, msg)
+	err := c.channel.Publish(exchange, key, mandatory, false, msg)
 	if err != nil {
 		e = porterr.NewF(porterr.PortErrorProducer, err.Error())
+		return
 	}
-	return
-}
-
-// Init idle worker fo pool
-func (cp *ConnectionPool) idle(logger gocli.Logger) (e porterr.IError) {
-	if cp.fIdle {
-		return porterr.New(porterr.PortErrorProducer, "idle already in process")
-	}
-	cp.fIdle = true
-	var i int
+	atomic.AddInt64(&c.limitRate, 1)
 	for {
 		select {
-		case <-cp.exit:
-			cp.fIdle = false
-			return
-		default:
-		}
-		cp.m.Lock()
-		if cp.pool[i] != nil && atomic.LoadInt32(&cp.pool[i].busy) == 0 {
-			if atomic.LoadInt64(&cp.pool[i].limitRate)-MaxMessagesPerConnection >= 0 {
-				e = cp.reopenChannel(i)
-				if e != nil {
-					logger.Errorln(e.Error())
-				}
-			} else if atomic.LoadInt64(&cp.pool[i].deadline) < time.Now().UnixNano() {
-				e = cp.closeConnection(i)
-				if e != nil {
-					logger.Errorln(e.Error())
-				}
+		case confirm, ok := <-c.confirms:
+			if !ok {
+				atomic.StoreInt32(&c.broken, 1)
+				return porterr.New(porterr.PortErrorProducer, "Channel closed before publish confirmation")
 			}
+			// Confirmation of previous abandoned publishing
+			if confirm.DeliveryTag < seq {
+				continue
+			}
+			// Return is always received before confirmation
+			select {
+			case r := <-c.returns:
+				return porterr.NewF(PublishErrorReturned, "Message returned: %v %s", r.ReplyCode, r.ReplyText)
+			default:
+			}
+			if !confirm.Ack {
+				return porterr.New(PublishErrorNack, "Message negatively confirmed by server")
+			}
+			return
+		case <-ctx.Done():
+			// Confirmation will never be read. Channel must not be reused
+			atomic.StoreInt32(&c.broken, 1)
+			return porterr.NewF(porterr.PortErrorProducer, "Publish confirmation: %s", ctx.Err().Error())
 		}
-		i++
-		if i == len(cp.pool) {
-			i = 0
-		}
-		cp.m.Unlock()
-		time.Sleep(time.Millisecond * 100)
 	}
 }
 
-// Close connection
-func (cp *ConnectionPool) reopenChannel(cursor int) (e porterr.IError) {
-	if cp.pool[cursor] == nil || cp.pool[cursor].channel == nil {
-		e = porterr.New(porterr.PortErrorProducer, "Can't close channel: channel is undefined")
-		return
-	}
-	err := cp.pool[cursor].channel.Close()
+// IsBroken check if connection or channel can not be used anymore
+func (c *PoolConn) IsBroken() bool {
+	return atomic.LoadInt32(&c.broken) != 0 || c.conn.IsClosed() || c.channel.IsClosed()
+}
+
+// Reopen channel
+func (c *PoolConn) reopenChannel() (e porterr.IError) {
+	err := c.channel.Close()
 	if err != nil {
 		e = porterr.NewF(porterr.PortErrorProducer, "Can't close channel: %s", err.Error())
 	}
-	cp.pool[cursor].channel, err = cp.pool[cursor].conn.Channel()
+	channel, err := c.conn.Channel()
 	if err != nil {
+		atomic.StoreInt32(&c.broken, 1)
 		e = porterr.NewF(porterr.PortErrorProducer, "Can't open channel: %s", err.Error())
+		return
 	}
-	atomic.StoreInt64(&cp.pool[cursor].limitRate, 0)
+	// Set confirm mode
+	if err = c.setChannel(channel); err != nil {
+		atomic.StoreInt32(&c.broken, 1)
+		e = porterr.NewF(porterr.PortErrorProducer, "Confirm mode set failed: %s ", err.Error())
+		return
+	}
+	atomic.StoreInt64(&c.limitRate, 0)
 	return e
 }
 
-// Close connection
-func (cp *ConnectionPool) closeConnection(cursor int) (e porterr.IError) {
-	if cp.pool[cursor] == nil || cp.pool[cursor].channel == nil {
-		e = porterr.New(porterr.PortErrorProducer, "Can't close channel: channel is undefined")
+// Close channel and connection
+func (c *PoolConn) close() (e porterr.IError) {
+	c.timer.Stop()
+	if c.conn.IsClosed() {
 		return
 	}
-	err := cp.pool[cursor].channel.Close()
+	err := c.channel.Close()
 	if err != nil {
 		e = porterr.NewF(porterr.PortErrorProducer, "Can't close channel: %s", err.Error())
 	}
-	err = cp.pool[cursor].conn.Close()
+	err = c.conn.Close()
 	if err != nil {
 		e = porterr.NewF(porterr.PortErrorProducer, "Can't close connection: %s", err.Error())
 	}
-	cp.pool[cursor] = nil
 	return e
 }
 
 // Dial to rabbit mq
-func (cp *ConnectionPool) dial(s RabbitServer) (c *connection, e porterr.IError) {
-	c = &connection{
-		deadline: time.Now().Add(s.MaxIdleConnectionLifeTime).UnixNano(),
-	}
+func (cp *ConnectionPool) dial() (c *PoolConn, e porterr.IError) {
+	c = &PoolConn{}
 	var err error
-	c.conn, err = amqp.Dial(s.String())
+	c.conn, err = cp.dialer(cp.server.String())
 	if err != nil {
-		e = porterr.NewF(porterr.PortErrorProducer, "Can't dial to RabbitMq server (%s): %s", s.String(), err.Error())
+		e = porterr.NewF(porterr.PortErrorProducer, "Can't dial to RabbitMq server (%s): %s", cp.server.Host, err.Error())
 		return
 	}
-	c.channel, err = c.conn.Channel()
+	channel, err := c.conn.Channel()
 	if err != nil {
+		_ = c.conn.Close()
 		e = porterr.NewF(porterr.PortErrorProducer, "Can't get channel: %s", err.Error())
 		return
 	}
 	// Set confirm mode
-	if err = c.channel.Confirm(false); err != nil {
+	if err = c.setChannel(channel); err != nil {
+		_ = c.conn.Close()
 		e = porterr.NewF(porterr.PortErrorProducer, "Confirm mode set failed: %s ", err.Error())
+		return
 	}
+	// Timer is started on release
+	c.timer = time.AfterFunc(cp.server.MaxIdleConnectionLifeTime, func() {
+		cp.expire(c)
+	})
+	c.timer.Stop()
+	// Drop connection when it closed by server or network
+	closed := c.conn.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if ae := <-closed; ae != nil {
+			cp.metrics.Reconnect(Labels{Server: cp.name})
+		}
+		atomic.StoreInt32(&c.broken, 1)
+		cp.expire(c)
+	}()
 	return
 }
 
-// GetConnection Get current connection using round-robin algorithm
-func (cp *ConnectionPool) GetConnection(s RabbitServer) (c *connection, e porterr.IError) {
+// Remove idle connection from pool and close it
+// Leased connection is not affected and will be closed on release
+func (cp *ConnectionPool) expire(c *PoolConn) {
+	cp.m.Lock()
+	if !cp.removeIdle(c) {
+		cp.m.Unlock()
+		return
+	}
+	cp.freeSlot()
+	cp.m.Unlock()
+	cp.metrics.PoolSize(Labels{Server: cp.name}, cp.Size())
+	cp.closeConnection(c)
+}
+
+// Remove connection from idle list. Must be called under lock
+func (cp *ConnectionPool) removeIdle(c *PoolConn) bool {
+	for i := range cp.idle {
+		if cp.idle[i] == c {
+			cp.idle = append(cp.idle[:i], cp.idle[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Free slot of connection and pass it to first waiter. Must be called under lock
+func (cp *ConnectionPool) freeSlot() {
+	if len(cp.waiters) > 0 && !cp.closed {
+		w := cp.waiters[0]
+		cp.waiters = cp.waiters[1:]
+		// Waiter will dial new connection in this slot
+		w <- nil
+		return
+	}
+	cp.open--
+}
+
+// Close connection with logging
+func (cp *ConnectionPool) closeConnection(c *PoolConn) {
+	if e := c.close(); e != nil && cp.logger != nil {
+		cp.logger.Errorln(e.Error())
+	}
+}
+
+// Dial new connection in reserved slot
+func (cp *ConnectionPool) dialSlot() (*PoolConn, porterr.IError) {
+	c, e := cp.dial()
+	if e != nil {
+		cp.m.Lock()
+		cp.freeSlot()
+		cp.m.Unlock()
+		return nil, e
+	}
+	cp.metrics.PoolSize(Labels{Server: cp.name}, cp.Size())
+	return c, nil
+}
+
+// Size count of open connections
+func (cp *ConnectionPool) Size() int {
+	cp.m.Lock()
+	defer cp.m.Unlock()
+	return cp.open
+}
+
+// PoolStats Connection pool statistics
+type PoolStats struct {
+	// Open connections
+	Open int `json:"open"`
+	// Idle connections
+	Idle int `json:"idle"`
+	// Waiters for connection
+	Waiters int `json:"waiters"`
+	// Max connections from config
+	MaxConnections int `json:"maxConnections"`
+}
+
+// Stats Get pool statistics
+func (cp *ConnectionPool) Stats() PoolStats {
 	cp.m.Lock()
 	defer cp.m.Unlock()
-	var i = gohelp.GetRndNumber(0, s.MaxConnections)
+	return PoolStats{
+		Open:           cp.open,
+		Idle:           len(cp.idle),
+		Waiters:        len(cp.waiters),
+		MaxConnections: cp.server.MaxConnections,
+	}
+}
+
+// Acquire Lease connection for exclusive use
+// Waits for free connection when pool is exhausted. Waiters are served in order of arrival
+// Connection must be returned with Release
+func (cp *ConnectionPool) Acquire(ctx context.Context) (*PoolConn, porterr.IError) {
+	start := time.Now()
+	c, e := cp.acquire(ctx)
+	if e == nil {
+		cp.metrics.PoolWait(Labels{Server: cp.name}, time.Since(start))
+	}
+	return c, e
+}
+
+// Lease connection
+func (cp *ConnectionPool) acquire(ctx context.Context) (*PoolConn, porterr.IError) {
 	for {
-		if cp.pool[i] != nil {
-			if !cp.pool[i].IsBusy() && !cp.pool[i].conn.IsClosed() && !cp.pool[i].channel.IsClosed() {
-				c = cp.pool[i]
-				return
-			} else if cp.pool[i].conn.IsClosed() || cp.pool[i].channel.IsClosed() {
-				cp.pool[i], e = cp.dial(s)
-				c = cp.pool[i]
-				return
+		cp.m.Lock()
+		if cp.closed {
+			cp.m.Unlock()
+			return nil, porterr.New(porterr.PortErrorProducer, "Connection pool is closed")
+		}
+		// New requests never overtake waiters
+		if len(cp.waiters) == 0 {
+			if n := len(cp.idle); n > 0 {
+				c := cp.idle[n-1]
+				cp.idle = cp.idle[:n-1]
+				c.timer.Stop()
+				if c.IsBroken() {
+					cp.freeSlot()
+					cp.m.Unlock()
+					cp.closeConnection(c)
+					continue
+				}
+				cp.m.Unlock()
+				return c, nil
+			}
+			if cp.open < cp.server.MaxConnections {
+				cp.open++
+				cp.m.Unlock()
+				return cp.dialSlot()
 			}
-		} else {
-			cp.pool[i], e = cp.dial(s)
-			c = cp.pool[i]
-			return
 		}
-		i++
-		if i == len(cp.pool) {
-			i = 0
+		w := make(chan *PoolConn, 1)
+		cp.waiters = append(cp.waiters, w)
+		cp.m.Unlock()
+		select {
+		case c, ok := <-w:
+			if !ok {
+				return nil, porterr.New(porterr.PortErrorProducer, "Connection pool is closed")
+			}
+			if c == nil {
+				return cp.dialSlot()
+			}
+			return c, nil
+		case <-ctx.Done():
+			cp.m.Lock()
+			for i := range cp.waiters {
+				if cp.waiters[i] == w {
+					cp.waiters = append(cp.waiters[:i], cp.waiters[i+1:]...)
+					cp.m.Unlock()
+					return nil, porterr.NewF(porterr.PortErrorProducer, "Acquire connection: %s", ctx.Err().Error())
+				}
+			}
+			cp.m.Unlock()
+			// Connection or slot already passed to the waiter
+			if c, ok := <-w; ok {
+				if c == nil {
+					cp.m.Lock()
+					cp.freeSlot()
+					cp.m.Unlock()
+				} else {
+					cp.Release(c)
+				}
+			}
+			return nil, porterr.NewF(porterr.PortErrorProducer, "Acquire connection: %s", ctx.Err().Error())
+		}
+	}
+}
+
+// Release Return leased connection to pool
+// Broken connections and connections released after pool close are closed
+func (cp *ConnectionPool) Release(c *PoolConn) {
+	// Recycle channel on reach messages limit
+	if !c.IsBroken() && atomic.LoadInt64(&c.limitRate) >= cp.server.MaxMessagesPerConnection {
+		if e := c.reopenChannel(); e != nil && cp.logger != nil {
+			cp.logger.Errorln(e.Error())
 		}
 	}
+	cp.m.Lock()
+	if cp.closed || c.IsBroken() {
+		cp.freeSlot()
+		cp.m.Unlock()
+		cp.metrics.PoolSize(Labels{Server: cp.name}, cp.Size())
+		cp.closeConnection(c)
+		return
+	}
+	if len(cp.waiters) > 0 {
+		w := cp.waiters[0]
+		cp.waiters = cp.waiters[1:]
+		cp.m.Unlock()
+		w <- c
+		return
+	}
+	cp.idle = append(cp.idle, c)
+	c.timer.Reset(cp.server.MaxIdleConnectionLifeTime)
+	cp.m.Unlock()
 }
 
-// Publish a message to queue
-func (cp *ConnectionPool) Publish(p amqp.Publishing, s RabbitServer, q RabbitQueue, route ...string) (e porterr.IError) {
+// Close connection pool
+// Idle connections are closed immediately, leased connections are closed on release
+func (cp *ConnectionPool) Close() {
+	cp.m.Lock()
+	if cp.closed {
+		cp.m.Unlock()
+		return
+	}
+	cp.closed = true
+	idle := cp.idle
+	cp.idle = nil
+	cp.open -= len(idle)
+	for _, w := range cp.waiters {
+		close(w)
+	}
+	cp.waiters = nil
+	cp.m.Unlock()
+	cp.metrics.PoolSize(Labels{Server: cp.name}, cp.Size())
+	for _, c := range idle {
+		cp.closeConnection(c)
+	}
+}
+
+// Publish a message to queue and wait for confirmations
+// Routing keys are published in order. Keys after failed key are not published
+func (cp *ConnectionPool) Publish(ctx context.Context, p amqp.Publishing, q RabbitQueue, route ...string) porterr.IError {
+	_, e := cp.publish(ctx, p, q, route...)
+	return e
+}
+
+// Publish a message to routing keys in order until error. Count of confirmed routing keys is returned
+func (cp *ConnectionPool) publish(ctx context.Context, p amqp.Publishing, q RabbitQueue, route ...string) (published int, e porterr.IError) {
 	// Get connection with an initiated channel
-	conn, e := cp.GetConnection(s)
+	conn, e := cp.Acquire(ctx)
 	if e != nil {
 		return
 	}
+	defer cp.Release(conn)
+	labels := Labels{Server: cp.name, Queue: q.Name}
 	// Publish to all routing keys
 	for _, key := range route {
-		err := conn.Publish(q.Exchange, key, false, false, p)
-		if err != nil {
-			e = porterr.NewF(porterr.PortErrorProducer, err.Error())
+		start := time.Now()
+		e = conn.Publish(ctx, q.Exchange, key, q.Mandatory, p)
+		if e != nil {
+			switch e.GetCode() {
+			case PublishErrorNack:
+				cp.metrics.PublishConfirmDuration(labels, time.Since(start))
+				cp.metrics.PublishNacked(labels)
+			case PublishErrorReturned:
+				cp.metrics.PublishConfirmDuration(labels, time.Since(start))
+				cp.metrics.PublishReturned(labels)
+			}
 			break
 		}
+		cp.metrics.PublishConfirmDuration(labels, time.Since(start))
+		cp.metrics.Published(labels)
+		published++
 	}
 	return
 }
@@ -0,0 +1,358 @@
+package gorabbit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fake connection for pool tests
+type fakeConnection struct {
+	m        sync.Mutex
+	closed   bool
+	channels int
+	notify   []chan *amqp.Error
+}
+
+func (c *fakeConnection) Channel() (Channel, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	c.channels++
+	return &fakeChannel{conn: c}, nil
+}
+
+func (c *fakeConnection) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *fakeConnection) IsClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.closed
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *fakeConnection) shutdown(err *amqp.Error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, n := range c.notify {
+		if err != nil {
+			n <- err
+		}
+		close(n)
+	}
+}
+
+// fake channel for pool tests
+type fakeChannel struct {
+	conn      *fakeConnection
+	closed    int32
+	inUse     int32
+	published int32
+	seq       uint64
+	confirms  chan amqp.Confirmation
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if !atomic.CompareAndSwapInt32(&ch.inUse, 0, 1) {
+		return errors.New("concurrent use of channel")
+	}
+	defer atomic.StoreInt32(&ch.inUse, 0)
+	if ch.IsClosed() {
+		return amqp.ErrClosed
+	}
+	atomic.AddInt32(&ch.published, 1)
+	time.Sleep(time.Microsecond * 50)
+	if ch.confirms != nil {
+		ch.confirms <- amqp.Confirmation{DeliveryTag: atomic.AddUint64(&ch.seq, 1), Ack: true}
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error { return nil }
+
+func (ch *fakeChannel) GetNextPublishSeqNo() uint64 { return atomic.LoadUint64(&ch.seq) + 1 }
+
+func (ch *fakeChannel) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.confirms = c
+	return c
+}
+
+func (ch *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return { return c }
+
+func (ch *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+func (ch *fakeChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) QueuePurge(name string, noWait bool) (int, error) { return 0, nil }
+
+func (ch *fakeChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	return amqp.Delivery{}, false, nil
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error { return nil }
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return make(chan amqp.Delivery), nil
+}
+
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error { return nil }
+
+func (ch *fakeChannel) Close() error {
+	atomic.StoreInt32(&ch.closed, 1)
+	return nil
+}
+
+func (ch *fakeChannel) IsClosed() bool {
+	return atomic.LoadInt32(&ch.closed) != 0 || ch.conn.IsClosed()
+}
+
+func (ch *fakeChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error { return c }
+
+// fake dialer registry
+type fakeDialer struct {
+	m     sync.Mutex
+	conns []*fakeConnection
+}
+
+func (d *fakeDialer) Dial(url string) (Connection, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	c := &fakeConnection{}
+	d.conns = append(d.conns, c)
+	return c, nil
+}
+
+func (d *fakeDialer) Count() int {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return len(d.conns)
+}
+
+func newTestPool(server RabbitServer) (*ConnectionPool, *fakeDialer) {
+	d := &fakeDialer{}
+	cp := NewConnectionPool(server)
+	cp.dialer = d.Dial
+	return cp, d
+}
+
+// wait until pool has n waiters
+func waitForWaiters(cp *ConnectionPool, n int) {
+	for {
+		cp.m.Lock()
+		l := len(cp.waiters)
+		cp.m.Unlock()
+		if l >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnectionPool_AcquireExclusive(t *testing.T) {
+	cp, d := newTestPool(RabbitServer{MaxConnections: 3})
+	defer cp.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				e := cp.Publish(context.Background(), amqp.Publishing{}, RabbitQueue{}, "a", "b")
+				if e != nil {
+					t.Error(e)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if d.Count() > 3 {
+		t.Fatalf("dialed %v connections, max is 3", d.Count())
+	}
+	var published int32
+	for _, c := range cp.idle {
+		published += atomic.LoadInt32(&c.channel.(*fakeChannel).published)
+	}
+	if published != 50*50*2 {
+		t.Fatalf("published %v messages", published)
+	}
+}
+
+func TestConnectionPool_AcquireFairness(t *testing.T) {
+	cp, _ := newTestPool(RabbitServer{MaxConnections: 1})
+	defer cp.Close()
+	c, e := cp.Acquire(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	var order []int
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, e := cp.Acquire(context.Background())
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			m.Lock()
+			order = append(order, i)
+			m.Unlock()
+			cp.Release(c)
+		}(i)
+		waitForWaiters(cp, i+1)
+	}
+	cp.Release(c)
+	wg.Wait()
+	for i := range order {
+		if order[i] != i {
+			t.Fatalf("waiters served out of order: %v", order)
+		}
+	}
+}
+
+func TestConnectionPool_AcquireContext(t *testing.T) {
+	cp, _ := newTestPool(RabbitServer{MaxConnections: 1})
+	defer cp.Close()
+	c, e := cp.Acquire(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, e = cp.Acquire(ctx); e == nil {
+		t.Fatal("acquire must fail on context deadline")
+	}
+	cp.Release(c)
+	c, e = cp.Acquire(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	cp.Release(c)
+}
+
+func TestConnectionPool_Close(t *testing.T) {
+	cp, d := newTestPool(RabbitServer{MaxConnections: 1})
+	c, e := cp.Acquire(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, e := cp.Acquire(context.Background()); e == nil {
+			t.Error("waiter must fail on pool close")
+		}
+	}()
+	waitForWaiters(cp, 1)
+	cp.Close()
+	<-done
+	// In-flight connection is still usable
+	if e = c.Publish(context.Background(), "", "", false, amqp.Publishing{}); e != nil {
+		t.Fatal(e)
+	}
+	cp.Release(c)
+	if !d.conns[0].IsClosed() {
+		t.Fatal("connection must be closed on release after pool close")
+	}
+	if _, e = cp.Acquire(context.Background()); e == nil {
+		t.Fatal("acquire must fail on closed pool")
+	}
+}
+
+func TestConnectionPool_IdleExpire(t *testing.T) {
+	cp, d := newTestPool(RabbitServer{MaxConnections: 2, MaxIdleConnectionLifeTime: time.Millisecond * 50})
+	defer cp.Close()
+	c, e := cp.Acquire(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	// Leased connection never expires
+	time.Sleep(time.Millisecond * 100)
+	if d.conns[0].IsClosed() {
+		t.Fatal("leased connection must not be closed")
+	}
+	cp.Release(c)
+	time.Sleep(time.Millisecond * 100)
+	if !d.conns[0].IsClosed() {
+		t.Fatal("idle connection must be closed")
+	}
+	cp.m.Lock()
+	defer cp.m.Unlock()
+	if cp.open != 0 || len(cp.idle) != 0 {
+		t.Fatal("pool must be empty")
+	}
+}
+
+func TestConnectionPool_NotifyClose(t *testing.T) {
+	cp, d := newTestPool(RabbitServer{MaxConnections: 1})
+	defer cp.Close()
+	c, e := cp.Acquire(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	cp.Release(c)
+	d.conns[0].shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "forced"})
+	c, e = cp.Acquire(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer cp.Release(c)
+	if d.Count() != 2 {
+		t.Fatal("closed connection must be replaced")
+	}
+}
+
+func TestConnectionPool_RecycleChannel(t *testing.T) {
+	cp, d := newTestPool(RabbitServer{MaxConnections: 1, MaxMessagesPerConnection: 2})
+	defer cp.Close()
+	for i := 0; i < 5; i++ {
+		if e := cp.Publish(context.Background(), amqp.Publishing{}, RabbitQueue{}); e != nil {
+			t.Fatal(e)
+		}
+		if e := cp.Publish(context.Background(), amqp.Publishing{}, RabbitQueue{}, "a", "b"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if d.conns[0].channels != 6 {
+		t.Fatalf("channel must be recycled, opened %v channels", d.conns[0].channels)
+	}
+}
@@ -1,128 +1,70 @@
 package gorabbit
 
 import (
-	"fmt"
-	"github.com/dimonrus/gocli"
-	"github.com/dimonrus/gohelp"
+	"context"
 	"sync"
-	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/dimonrus/gocli"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func TestServerPool_GetConnectionPoolOrCreate(t *testing.T) {
 	pool := NewServerPool(gocli.NewLogger(gocli.LoggerConfig{}))
+	var wg sync.WaitGroup
 	for i := 1; i < 5; i++ {
+		wg.Add(1)
 		go func() {
-			conn := pool.GetConnectionPoolOrCreate("local", 10)
+			defer wg.Done()
+			conn := pool.GetConnectionPoolOrCreate("local", RabbitServer{MaxConnections: 10})
 			_ = conn
 		}()
 	}
-	time.Sleep(time.Second)
-}
-
-type conn struct {
-	some     string
-	deadline int64
-	busy     int32
-}
-
-func (c *conn) Process(i int) {
-	atomic.StoreInt32(&c.busy, 1)
-	defer func() {
-		atomic.StoreInt64(&c.deadline, time.Now().Add(time.Second*10).UnixNano())
-		atomic.StoreInt32(&c.busy, 0)
-	}()
-	time.Sleep(time.Millisecond * 500)
-	fmt.Println("Test", i)
-}
-
-func NewConnection() *conn {
-	return &conn{
-		some:     gohelp.RandString(10),
-		deadline: time.Now().Add(time.Second * 5).UnixNano(),
+	wg.Wait()
+	if len(pool.pool) != 1 {
+		t.Fatal("must be only one pool per server")
 	}
+	pool.Close()
 }
 
-type Pool struct {
-	// Connection pool
-	pool []*conn
-	// cursor for current connection
-	cursor int32
-	// Lock until using
-	m sync.Mutex
-	// flag shows that idle function in process
-	// exit
-	exit chan struct{}
-	// request per second
-	rps int32
-}
-
-func (p *Pool) GetConnection() *conn {
-	p.m.Lock()
-	defer p.m.Unlock()
-	var i int
-	for {
-		if p.pool[i] != nil {
-			if atomic.LoadInt32(&p.pool[i].busy) == 0 {
-				return p.pool[i]
-			}
-		} else {
-			p.pool[i] = NewConnection()
-		}
-		i++
-		if i == len(p.pool) {
-			i = 0
-		}
+func TestServerPool_ReplacePool(t *testing.T) {
+	pool := NewServerPool(gocli.NewLogger(gocli.LoggerConfig{}))
+	old := pool.GetConnectionPoolOrCreate("local", RabbitServer{Host: "old"})
+	pool.ReplacePool("local", RabbitServer{Host: "new"})
+	// Publisher with old config gets pool of new config
+	actual := pool.GetConnectionPoolOrCreate("local", RabbitServer{Host: "old"})
+	if actual == old || actual.server.Host != "new" {
+		t.Fatal("pool must be replaced with pool of new config")
 	}
+	pool.Close()
 }
 
-func (p *Pool) Idle() {
-	var i int
-	for {
-		select {
-		case <-p.exit:
-			return
-		default:
+func TestConnectionPool_IdleTimer(t *testing.T) {
+	cp, d := newTestPool(RabbitServer{MaxConnections: 2, MaxIdleConnectionLifeTime: time.Millisecond * 100})
+	defer cp.Close()
+	publish := func() {
+		if e := cp.Publish(context.Background(), amqp.Publishing{}, RabbitQueue{}, "a"); e != nil {
+			t.Fatal(e)
 		}
-		now := time.Now().UnixNano()
-		p.m.Lock()
-		if p.pool[i] != nil {
-			if atomic.LoadInt64(&p.pool[i].deadline) < now && atomic.LoadInt32(&p.pool[i].busy) == 0 {
-				p.pool[i] = nil
-				fmt.Println("remove connection", i)
-			}
-		}
-		i++
-		if i == len(p.pool) {
-			i = 0
-		}
-		p.m.Unlock()
-		time.Sleep(time.Second)
 	}
-}
-
-func NewPool() *Pool {
-	p := &Pool{pool: make([]*conn, DefaultMaxConnections)}
-	go func() {
-		p.Idle()
-	}()
-	return p
-}
-
-func TestNewPool(t *testing.T) {
-	c := make(chan struct{}, 0)
-	p := NewPool()
-	for i := 0; i < 100; i++ {
-		go p.GetConnection().Process(i)
-		go p.GetConnection().Process(i)
-		go p.GetConnection().Process(i)
+	// Idle timer is refreshed on every use
+	for i := 0; i < 6; i++ {
+		publish()
+		time.Sleep(time.Millisecond * 40)
+	}
+	if d.Count() != 1 || d.conns[0].IsClosed() {
+		t.Fatal("used connection must not be expired")
+	}
+	// Idle connection is closed by timer and slot is released
+	time.Sleep(time.Millisecond * 200)
+	if !d.conns[0].IsClosed() || cp.Stats().Open != 0 {
+		t.Fatal("idle connection must be expired")
 	}
-	time.Sleep(time.Second * 11)
-	for i := 0; i < 100; i++ {
-		go p.GetConnection().Process(i)
-		go p.GetConnection().Process(i)
-		go p.GetConnection().Process(i)
+	// Released slot is used by new connection
+	publish()
+	publish()
+	if d.Count() != 2 || d.conns[1].IsClosed() || cp.Stats().Open != 1 {
+		t.Fatalf("new connection must be opened in released slot, dialed %v", d.Count())
 	}
-	<-c
 }
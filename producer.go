@@ -1,9 +1,11 @@
 package gorabbit
 
 import (
+	"context"
 	"github.com/dimonrus/gohelp"
 	"github.com/dimonrus/porterr"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"strings"
 	"time"
 )
 
@@ -13,15 +15,23 @@ import (
 // server - name of the server defined in config
 // route - routing keys
 func (a *Application) Publish(p amqp.Publishing, queue string, server string, route ...string) porterr.IError {
-	// Get server config
-	srv, e := a.GetConfig().GetServer(server)
-	if e != nil {
-		return e
-	}
-	// Set default setting if not set in config
-	srv.init()
+	return a.PublishContext(context.Background(), p, queue, server, route...)
+}
+
+// PublishContext Publisher with context
+// Trace context of span in ctx is injected into message headers
+// Empty MessageId is generated with NewMessageId after publish interceptors
+// Failed publish is retried until ctx is done. Confirmed routing keys are not published again
+// Nacked and returned messages are not retried
+func (a *Application) PublishContext(ctx context.Context, p amqp.Publishing, queue string, server string, route ...string) porterr.IError {
+	return a.publish(ctx, p, 0, queue, server, route...)
+}
+
+// Publish message through interceptors and pool. Positive delay applies delay strategy of queue
+func (a *Application) publish(ctx context.Context, p amqp.Publishing, delay time.Duration, queue string, server string, route ...string) (e porterr.IError) {
+	config := a.GetConfig()
 	// Get queue config
-	q, e := a.GetConfig().GetQueue(queue)
+	q, e := config.GetQueue(queue)
 	if e != nil {
 		return e
 	}
@@ -32,11 +42,81 @@ func (a *Application) Publish(p amqp.Publishing, queue string, server string, ro
 	if len(route) == 0 {
 		route = append(route, "")
 	}
-	cp := a.sp.GetConnectionPoolOrCreate(server, srv.MaxConnections)
-	// Publish a message
-	for e = cp.Publish(p, *srv, *q, route...); e != nil; {
-		a.GetLogger().Errorln(gohelp.Red("PUBLISH ERROR: " + e.Error()))
-		time.Sleep(time.Millisecond * 1000)
+	// Collect interceptors of application and queue
+	interceptors, e := a.publishInterceptors(q)
+	if e != nil {
+		return e
+	}
+	if delay > 0 {
+		if e = q.validateDelay(delay); e != nil {
+			return e
+		}
+	}
+	// Do not modify headers of caller
+	headers := make(amqp.Table, len(p.Headers)+2)
+	for k, v := range p.Headers {
+		headers[k] = v
+	}
+	p.Headers = headers
+	cp, e := a.connectionPool(server)
+	if e != nil {
+		return e
+	}
+	// Start producer span
+	ctx, span := a.tracer.Start(ctx, queue+" publish", SpanKindProducer)
+	defer func() {
+		if e != nil {
+			span.RecordError(e)
+		}
+		span.End()
+	}()
+	span.SetAttribute(AttributeMessagingSystem, "rabbitmq")
+	span.SetAttribute(AttributeDestination, queue)
+	span.SetAttribute(AttributeRoutingKey, strings.Join(route, ","))
+	// Publish message through the pool
+	publish := func(ctx context.Context, m *PublishMessage) (e porterr.IError) {
+		// Message id identifies message for dedup of consumer
+		if m.Publishing.MessageId == "" {
+			m.Publishing.MessageId = NewMessageId()
+		}
+		span.SetAttribute(AttributeMessageId, m.Publishing.MessageId)
+		InjectTraceContext(m.Publishing.Headers, span.SpanContext())
+		target, keys := *q, m.Route
+		if delay > 0 {
+			if target, keys, e = a.delayMessage(ctx, cp, server, q, delay, m); e != nil {
+				return e
+			}
+		}
+		for {
+			var published int
+			if published, e = cp.publish(ctx, m.Publishing, target, keys...); e == nil {
+				return nil
+			}
+			a.GetLogger().Errorln(gohelp.Red("PUBLISH ERROR: " + e.Error()))
+			// Unroutable message will be returned again. Nacked message is not retried
+			// because server refused it and retry can not fix it
+			if e.GetCode() == PublishErrorReturned || e.GetCode() == PublishErrorNack || ctx.Err() != nil {
+				return e
+			}
+			// Confirmed routing keys are not published again
+			keys = keys[published:]
+			a.metrics.PublishRetry(Labels{Server: m.Server, Queue: m.Queue})
+			time.Sleep(time.Millisecond * 1000)
+			// Pool is replaced when server config is reloaded
+			if cp, e = a.connectionPool(server); e != nil {
+				return e
+			}
+		}
+	}
+	return ChainPublish(publish, interceptors...)(ctx, &PublishMessage{Publishing: p, Queue: queue, Server: server, Route: route})
+}
+
+// Get connection pool of server. Pool is created with server of actual config
+// because pool of server can be replaced or closed by config reload
+func (a *Application) connectionPool(server string) (*ConnectionPool, porterr.IError) {
+	srv, e := a.GetConfig().GetServer(server)
+	if e != nil {
+		return nil, e
 	}
-	return e
+	return a.sp.GetConnectionPoolOrCreate(server, *srv), nil
 }
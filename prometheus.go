@@ -0,0 +1,322 @@
+package gorabbit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Metric types
+	prometheusCounter   = "counter"
+	prometheusGauge     = "gauge"
+	prometheusHistogram = "histogram"
+
+	// PrometheusContentType content type of text exposition format
+	PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// DefaultPrometheusBuckets Default histogram buckets in seconds
+var DefaultPrometheusBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric description
+type prometheusMetric struct {
+	// Metric type
+	kind string
+	// Help text
+	help string
+}
+
+// Known metrics
+var prometheusMetrics = map[string]prometheusMetric{
+	"gorabbit_consumer_deliveries_received_total": {prometheusCounter, "Deliveries received by subscribers"},
+	"gorabbit_consumer_deliveries_acked_total":    {prometheusCounter, "Deliveries acked after processing"},
+	"gorabbit_consumer_deliveries_nacked_total":   {prometheusCounter, "Deliveries nacked after processing"},
+	"gorabbit_consumer_deliveries_rejected_total": {prometheusCounter, "Deliveries rejected after processing"},
+	"gorabbit_consumer_duplicates_total":          {prometheusCounter, "Duplicate deliveries acked without processing"},
+	"gorabbit_consumer_handler_duration_seconds":  {prometheusHistogram, "Duration of delivery processing"},
+	"gorabbit_consumer_panics_total":              {prometheusCounter, "Recovered handler panics"},
+	"gorabbit_consumer_in_flight":                 {prometheusGauge, "Deliveries in processing"},
+	"gorabbit_publisher_published_total":          {prometheusCounter, "Messages published and confirmed"},
+	"gorabbit_publisher_confirm_duration_seconds": {prometheusHistogram, "Time between publish and confirmation"},
+	"gorabbit_publisher_nacks_total":              {prometheusCounter, "Messages negatively confirmed by server"},
+	"gorabbit_publisher_returns_total":            {prometheusCounter, "Mandatory messages returned as unroutable"},
+	"gorabbit_publisher_retries_total":            {prometheusCounter, "Publish retries after error"},
+	"gorabbit_publisher_pool_connections":         {prometheusGauge, "Open connections in publish pool"},
+	"gorabbit_publisher_pool_wait_seconds":        {prometheusHistogram, "Time spent on connection acquire"},
+	"gorabbit_reconnects_total":                   {prometheusCounter, "Connections reopened after failure"},
+}
+
+// Histogram values
+type prometheusHistogramValue struct {
+	// Count of observations per bucket. Not cumulative
+	counts []uint64
+	// Count of all observations
+	count uint64
+	// Sum of observations
+	sum float64
+}
+
+// PrometheusMetrics Metrics collector with Prometheus text exposition
+type PrometheusMetrics struct {
+	// Lock for values
+	m sync.Mutex
+	// Histogram buckets
+	buckets []float64
+	// Counter and gauge values
+	values map[string]map[Labels]float64
+	// Histogram values
+	histograms map[string]map[Labels]*prometheusHistogramValue
+}
+
+// NewPrometheusMetrics Create collector. Nil buckets means DefaultPrometheusBuckets
+func NewPrometheusMetrics(buckets []float64) *PrometheusMetrics {
+	if buckets == nil {
+		buckets = DefaultPrometheusBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &PrometheusMetrics{
+		buckets:    buckets,
+		values:     make(map[string]map[Labels]float64),
+		histograms: make(map[string]map[Labels]*prometheusHistogramValue),
+	}
+}
+
+// Add value to counter or gauge
+func (p *PrometheusMetrics) add(name string, l Labels, value float64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.values[name]; !ok {
+		p.values[name] = make(map[Labels]float64)
+	}
+	p.values[name][l] += value
+}
+
+// Set gauge value
+func (p *PrometheusMetrics) set(name string, l Labels, value float64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.values[name]; !ok {
+		p.values[name] = make(map[Labels]float64)
+	}
+	p.values[name][l] = value
+}
+
+// Observe histogram value
+func (p *PrometheusMetrics) observe(name string, l Labels, d time.Duration) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.histograms[name]; !ok {
+		p.histograms[name] = make(map[Labels]*prometheusHistogramValue)
+	}
+	h, ok := p.histograms[name][l]
+	if !ok {
+		h = &prometheusHistogramValue{counts: make([]uint64, len(p.buckets))}
+		p.histograms[name][l] = h
+	}
+	value := d.Seconds()
+	for i := range p.buckets {
+		if value <= p.buckets[i] {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// DeliveryReceived increment counter
+func (p *PrometheusMetrics) DeliveryReceived(l Labels) {
+	p.add("gorabbit_consumer_deliveries_received_total", l, 1)
+}
+
+// DeliveryAcked increment counter
+func (p *PrometheusMetrics) DeliveryAcked(l Labels) {
+	p.add("gorabbit_consumer_deliveries_acked_total", l, 1)
+}
+
+// DeliveryNacked increment counter
+func (p *PrometheusMetrics) DeliveryNacked(l Labels) {
+	p.add("gorabbit_consumer_deliveries_nacked_total", l, 1)
+}
+
+// DeliveryRejected increment counter
+func (p *PrometheusMetrics) DeliveryRejected(l Labels) {
+	p.add("gorabbit_consumer_deliveries_rejected_total", l, 1)
+}
+
+// DeliveryDuplicate increment counter
+func (p *PrometheusMetrics) DeliveryDuplicate(l Labels) {
+	p.add("gorabbit_consumer_duplicates_total", l, 1)
+}
+
+// HandlerDuration observe histogram
+func (p *PrometheusMetrics) HandlerDuration(l Labels, d time.Duration) {
+	p.observe("gorabbit_consumer_handler_duration_seconds", l, d)
+}
+
+// HandlerPanic increment counter
+func (p *PrometheusMetrics) HandlerPanic(l Labels) {
+	p.add("gorabbit_consumer_panics_total", l, 1)
+}
+
+// InFlight change gauge
+func (p *PrometheusMetrics) InFlight(l Labels, delta int) {
+	p.add("gorabbit_consumer_in_flight", l, float64(delta))
+}
+
+// Published increment counter
+func (p *PrometheusMetrics) Published(l Labels) {
+	p.add("gorabbit_publisher_published_total", l, 1)
+}
+
+// PublishConfirmDuration observe histogram
+func (p *PrometheusMetrics) PublishConfirmDuration(l Labels, d time.Duration) {
+	p.observe("gorabbit_publisher_confirm_duration_seconds", l, d)
+}
+
+// PublishNacked increment counter
+func (p *PrometheusMetrics) PublishNacked(l Labels) {
+	p.add("gorabbit_publisher_nacks_total", l, 1)
+}
+
+// PublishReturned increment counter
+func (p *PrometheusMetrics) PublishReturned(l Labels) {
+	p.add("gorabbit_publisher_returns_total", l, 1)
+}
+
+// PublishRetry increment counter
+func (p *PrometheusMetrics) PublishRetry(l Labels) {
+	p.add("gorabbit_publisher_retries_total", l, 1)
+}
+
+// PoolSize set gauge
+func (p *PrometheusMetrics) PoolSize(l Labels, size int) {
+	p.set("gorabbit_publisher_pool_connections", l, float64(size))
+}
+
+// PoolWait observe histogram
+func (p *PrometheusMetrics) PoolWait(l Labels, d time.Duration) {
+	p.observe("gorabbit_publisher_pool_wait_seconds", l, d)
+}
+
+// Reconnect increment counter
+func (p *PrometheusMetrics) Reconnect(l Labels) {
+	p.add("gorabbit_reconnects_total", l, 1)
+}
+
+// Render labels
+func formatPrometheusLabels(l Labels, extra ...string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := []string{
+		`server="` + escape.Replace(l.Server) + `"`,
+		`queue="` + escape.Replace(l.Queue) + `"`,
+		`consumer="` + escape.Replace(l.Consumer) + `"`,
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape.Replace(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Sort labels for stable output
+func sortedLabels(keys []Labels) []Labels {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Server != keys[j].Server {
+			return keys[i].Server < keys[j].Server
+		}
+		if keys[i].Queue != keys[j].Queue {
+			return keys[i].Queue < keys[j].Queue
+		}
+		return keys[i].Consumer < keys[j].Consumer
+	})
+	return keys
+}
+
+// WriteTo write metrics in Prometheus text exposition format
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	names := make([]string, 0, len(prometheusMetrics))
+	for name := range prometheusMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, name := range names {
+		metric := prometheusMetrics[name]
+		if metric.kind == prometheusHistogram {
+			series := p.histograms[name]
+			if len(series) == 0 {
+				continue
+			}
+			fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", name, metric.help, name, metric.kind)
+			keys := make([]Labels, 0, len(series))
+			for l := range series {
+				keys = append(keys, l)
+			}
+			for _, l := range sortedLabels(keys) {
+				h := series[l]
+				var cumulative uint64
+				for i, bound := range p.buckets {
+					cumulative += h.counts[i]
+					fmt.Fprintf(cw, "%s_bucket%s %d\n", name, formatPrometheusLabels(l, "le", strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+				}
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", name, formatPrometheusLabels(l, "le", "+Inf"), h.count)
+				fmt.Fprintf(cw, "%s_sum%s %s\n", name, formatPrometheusLabels(l), strconv.FormatFloat(h.sum, 'g', -1, 64))
+				fmt.Fprintf(cw, "%s_count%s %d\n", name, formatPrometheusLabels(l), h.count)
+			}
+			continue
+		}
+		series := p.values[name]
+		if len(series) == 0 {
+			continue
+		}
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", name, metric.help, name, metric.kind)
+		keys := make([]Labels, 0, len(series))
+		for l := range series {
+			keys = append(keys, l)
+		}
+		for _, l := range sortedLabels(keys) {
+			fmt.Fprintf(cw, "%s%s %s\n", name, formatPrometheusLabels(l), strconv.FormatFloat(series[l], 'g', -1, 64))
+		}
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// ServeHTTP expose metrics for Prometheus scraper
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", PrometheusContentType)
+	_, _ = p.WriteTo(w)
+}
+
+// Writer with count of written bytes
+type countingWriter struct {
+	// Buffered writer
+	w *bufio.Writer
+	// Written bytes
+	n int64
+	// First write error
+	err error
+}
+
+// Write bytes
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
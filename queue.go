@@ -0,0 +1,313 @@
+package gorabbit
+
+import (
+	"fmt"
+	"github.com/dimonrus/gocli"
+	"github.com/dimonrus/gohelp"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"strconv"
+	"time"
+)
+
+const (
+	// QueueErrorConfirm Queue error code. Purge requires confirmation token
+	QueueErrorConfirm = "GORABBIT_QUEUE_CONFIRM"
+
+	// CommandQueue queue command keyword
+	CommandQueue = "queue"
+	// CommandInfo queue info action
+	CommandInfo = "info"
+	// CommandPurge queue purge action
+	CommandPurge = "purge"
+	// CommandPeek queue peek action
+	CommandPeek = "peek"
+
+	// PurgeTokenTTL Lifetime of purge confirmation token
+	PurgeTokenTTL = time.Minute
+	// MaxPeekCount Max count of messages in one peek
+	MaxPeekCount = 100
+)
+
+// QueueInfo Queue state reported by server
+type QueueInfo struct {
+	// Queue name
+	Name string `json:"name"`
+	// Server name from config
+	Server string `json:"server"`
+	// Count of ready messages
+	Messages int `json:"messages"`
+	// Count of consumers
+	Consumers int `json:"consumers"`
+}
+
+// QueueMessage Message received by peek
+type QueueMessage struct {
+	// Message id
+	MessageId string `json:"messageId,omitempty"`
+	// Correlation id
+	CorrelationId string `json:"correlationId,omitempty"`
+	// Exchange message was published to
+	Exchange string `json:"exchange"`
+	// Routing key
+	RoutingKey string `json:"routingKey"`
+	// Message was delivered before
+	Redelivered bool `json:"redelivered"`
+	// Content type
+	ContentType string `json:"contentType,omitempty"`
+	// Message headers
+	Headers amqp.Table `json:"headers,omitempty"`
+	// Body truncated to DefaultLogBodyLimit
+	Body string `json:"body"`
+}
+
+// QueueCommandResult Result of queue action in json reply
+type QueueCommandResult struct {
+	// Queue name
+	Queue string `json:"queue"`
+	// Command action
+	Action string `json:"action"`
+	// Error code
+	Code string `json:"code,omitempty"`
+	// Error message
+	Error string `json:"error,omitempty"`
+	// Queue state for info action
+	Info *QueueInfo `json:"info,omitempty"`
+	// Confirmation token for purge action
+	Token string `json:"token,omitempty"`
+	// Count of purged messages
+	Purged *int `json:"purged,omitempty"`
+	// Messages for peek action
+	Messages []QueueMessage `json:"messages,omitempty"`
+}
+
+// Purge confirmation token
+type purgeToken struct {
+	// Token value
+	value string
+	// Token is not accepted after
+	expires time.Time
+}
+
+// QueueInfo Get count of messages and consumers of queue from config with passive declare
+func (a *Application) QueueInfo(name string) (QueueInfo, porterr.IError) {
+	var info QueueInfo
+	e := a.withQueueChannel(name, func(q *RabbitQueue, server string, channel Channel) porterr.IError {
+		state, err := channel.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Arguments)
+		if err != nil {
+			return porterr.NewF(porterr.PortErrorConnection, "Queue '%s' info error: %s", q.Name, err.Error())
+		}
+		info = QueueInfo{Name: q.Name, Server: server, Messages: state.Messages, Consumers: state.Consumers}
+		return nil
+	})
+	return info, e
+}
+
+// PurgeToken Create confirmation token for purge of queue. Token expires after PurgeTokenTTL
+func (a *Application) PurgeToken(name string) (string, porterr.IError) {
+	if _, e := a.GetConfig().GetQueue(name); e != nil {
+		return "", e
+	}
+	token := gohelp.RandString(8)
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.purgeTokens == nil {
+		a.purgeTokens = make(map[string]purgeToken)
+	}
+	a.purgeTokens[name] = purgeToken{value: token, expires: time.Now().Add(PurgeTokenTTL)}
+	return token, nil
+}
+
+// PurgeQueue Remove ready messages from queue. Token must be created with PurgeToken
+// Token is accepted once
+func (a *Application) PurgeQueue(name string, token string) (int, porterr.IError) {
+	a.m.Lock()
+	expected, ok := a.purgeTokens[name]
+	if ok && expected.value == token {
+		delete(a.purgeTokens, name)
+	}
+	a.m.Unlock()
+	if !ok || expected.value != token || time.Now().After(expected.expires) {
+		return 0, porterr.NewF(QueueErrorConfirm, "Purge of queue '%s' is not confirmed. Token is wrong or expired", name)
+	}
+	var count int
+	e := a.withQueueChannel(name, func(q *RabbitQueue, server string, channel Channel) porterr.IError {
+		var err error
+		count, err = channel.QueuePurge(q.Name, false)
+		if err != nil {
+			return porterr.NewF(porterr.PortErrorConnection, "Queue '%s' purge error: %s", q.Name, err.Error())
+		}
+		return nil
+	})
+	return count, e
+}
+
+// PeekQueue Get up to count messages and requeue them
+// Requeued messages are marked as redelivered by server
+func (a *Application) PeekQueue(name string, count int) ([]QueueMessage, porterr.IError) {
+	if count <= 0 || count > MaxPeekCount {
+		return nil, porterr.NewF(porterr.PortErrorParam, "Peek count must be between 1 and %d", MaxPeekCount)
+	}
+	messages := make([]QueueMessage, 0, count)
+	e := a.withQueueChannel(name, func(q *RabbitQueue, server string, channel Channel) porterr.IError {
+		var last amqp.Delivery
+		for len(messages) < count {
+			d, ok, err := channel.Get(q.Name, false)
+			if err != nil {
+				return porterr.NewF(porterr.PortErrorConnection, "Queue '%s' get error: %s", q.Name, err.Error())
+			}
+			if !ok {
+				break
+			}
+			last = d
+			messages = append(messages, QueueMessage{
+				MessageId:     d.MessageId,
+				CorrelationId: d.CorrelationId,
+				Exchange:      d.Exchange,
+				RoutingKey:    d.RoutingKey,
+				Redelivered:   d.Redelivered,
+				ContentType:   d.ContentType,
+				Headers:       d.Headers,
+				Body:          TruncateBody(d.Body, DefaultLogBodyLimit),
+			})
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		// Requeue all received messages at once to keep order
+		if err := last.Nack(true, true); err != nil {
+			return porterr.NewF(porterr.PortErrorConnection, "Queue '%s' requeue error: %s", q.Name, err.Error())
+		}
+		return nil
+	})
+	return messages, e
+}
+
+// Server name of queue. If queue has no server the only configured server is used
+func (a *Application) queueServer(q *RabbitQueue) (string, porterr.IError) {
+	if q.Server != "" {
+		return q.Server, nil
+	}
+	servers := a.GetConfig().Servers
+	if len(servers) != 1 {
+		return "", porterr.NewF(porterr.PortErrorParam, "Server is not defined for queue '%s'", q.Name)
+	}
+	for name := range servers {
+		return name, nil
+	}
+	return "", nil
+}
+
+// Open dedicated connection to server of queue and call fn with channel
+func (a *Application) withQueueChannel(name string, fn func(q *RabbitQueue, server string, channel Channel) porterr.IError) porterr.IError {
+	q, e := a.GetConfig().GetQueue(name)
+	if e != nil {
+		return e
+	}
+	server, e := a.queueServer(q)
+	if e != nil {
+		return e
+	}
+	return a.withServerChannel(server, func(channel Channel) porterr.IError {
+		return fn(q, server, channel)
+	})
+}
+
+// Open dedicated connection to server and call fn with channel
+func (a *Application) withServerChannel(server string, fn func(channel Channel) porterr.IError) porterr.IError {
+	srv, e := a.GetConfig().GetServer(server)
+	if e != nil {
+		return e
+	}
+	conn, err := a.dialer(srv.String())
+	if err != nil {
+		return porterr.NewF(porterr.PortErrorConnection, "Failed connect to %s RabbitMQ Server", srv.Host)
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return porterr.NewF(porterr.PortErrorConnection, "RabbitMQ Channel Error")
+	}
+	defer channel.Close()
+	return fn(channel)
+}
+
+// Queue command processor
+// queue info name, queue purge name [token], queue peek name [N], queue replay src dst [N] [dry] [key rk] [header name value]
+func (a *Application) queueCommander(command *gocli.Command) {
+	args, asJSON := ParseOutputFormat(command, command.Arguments())
+	if len(args) < 3 {
+		a.FailMessage("Queue command must contain action with queue name", command)
+		return
+	}
+	action, name := args[1].Name, args[2].Name
+	if action == CommandReplay {
+		a.replayCommander(command, args, asJSON)
+		return
+	}
+	result := QueueCommandResult{Queue: name, Action: action}
+	var e porterr.IError
+	switch action {
+	case CommandInfo:
+		var info QueueInfo
+		info, e = a.QueueInfo(name)
+		if e == nil {
+			result.Info = &info
+			if !asJSON {
+				a.SuccessMessage(fmt.Sprintf("Queue '%s' on server '%s' has %v messages and %v consumers", name, info.Server, info.Messages, info.Consumers), command)
+			}
+		}
+	case CommandPurge:
+		if len(args) < 4 {
+			result.Token, e = a.PurgeToken(name)
+			if e == nil && !asJSON {
+				a.AttentionMessage(fmt.Sprintf("Purge removes all ready messages of queue '%s'. Confirm in %v with: queue purge %s %s", name, PurgeTokenTTL, name, result.Token), command)
+			}
+			break
+		}
+		var purged int
+		purged, e = a.PurgeQueue(name, args[3].Name)
+		if e == nil {
+			result.Purged = &purged
+			if !asJSON {
+				a.AttentionMessage(fmt.Sprintf("Queue '%s' is purged. %v messages removed", name, purged), command)
+			}
+		}
+	case CommandPeek:
+		count := 1
+		if len(args) > 3 {
+			n, err := strconv.Atoi(args[3].Name)
+			if err != nil {
+				e = porterr.NewF(porterr.PortErrorParam, "Wrong peek count: %s", args[3].Name)
+				break
+			}
+			count = n
+		}
+		result.Messages, e = a.PeekQueue(name, count)
+		if e == nil && !asJSON {
+			a.SuccessMessage(fmt.Sprintf("Queue '%s' peek %v messages", name, len(result.Messages)), command)
+			for i, m := range result.Messages {
+				a.SuccessMessage(FormatFields(fmt.Sprintf("#%v", i+1),
+					F(FieldMessageId, m.MessageId),
+					F(FieldRoutingKey, m.RoutingKey),
+					F(FieldRedelivered, m.Redelivered),
+					F(FieldHeaders, m.Headers),
+					F(FieldBody, m.Body),
+				), command)
+			}
+		}
+	default:
+		a.AttentionMessage("Unknown command: "+command.GetOrigin(), command)
+		return
+	}
+	if e != nil {
+		result.Code = fmt.Sprint(e.GetCode())
+		result.Error = e.Error()
+		if !asJSON {
+			a.FailMessage(e.Error(), command)
+		}
+	}
+	if asJSON {
+		a.respondJSON(command, result)
+	}
+}
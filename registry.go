@@ -0,0 +1,127 @@
+package gorabbit
+
+import (
+	"github.com/dimonrus/gocli"
+	"github.com/dimonrus/porterr"
+	"math"
+	"strconv"
+)
+
+const (
+	// ConsumerErrorExists Consumer error code. Consumer with the same name is registered
+	ConsumerErrorExists = "GORABBIT_CONSUMER_EXISTS"
+	// ConsumerErrorHandler Consumer error code. Handler is not registered
+	ConsumerErrorHandler = "GORABBIT_CONSUMER_HANDLER"
+)
+
+// RegisterHandler Register handler by name for consumers added at runtime with consumer add command
+func (a *Application) RegisterHandler(name string, h Handler) *Application {
+	a.rm.Lock()
+	defer a.rm.Unlock()
+	if a.handlers == nil {
+		a.handlers = make(map[string]Handler)
+	}
+	a.handlers[name] = h
+	return a
+}
+
+// Get handler registered by name
+func (a *Application) getHandler(name string) (Handler, porterr.IError) {
+	a.rm.RLock()
+	defer a.rm.RUnlock()
+	h, ok := a.handlers[name]
+	if !ok {
+		return nil, porterr.NewF(ConsumerErrorHandler, "Handler '%s' is not registered", name)
+	}
+	return h, nil
+}
+
+// RegisterConsumer Add consumer to registry
+// Queue and server must be defined in config. Consumer is started when start is true
+func (a *Application) RegisterConsumer(name string, consumer *Consumer, start bool) porterr.IError {
+	if name == "" || consumer == nil {
+		return porterr.New(porterr.PortErrorParam, "Consumer name and consumer are required")
+	}
+	if consumer.Handler == nil && consumer.Callback == nil && consumer.BatchHandler == nil && consumer.ReplyHandler == nil {
+		return porterr.NewF(porterr.PortErrorParam, "Handler or callback of consumer '%s' is not defined", name)
+	}
+	config := a.GetConfig()
+	q, e := config.GetQueue(consumer.Queue)
+	if e != nil {
+		return e
+	}
+	if e = consumer.validate(q); e != nil {
+		return e
+	}
+	if q.Exchange == "" {
+		return porterr.NewF(porterr.PortErrorParam, "Exchange is not defined for queue '%s'", q.Name)
+	}
+	if _, e = config.GetServer(consumer.Server); e != nil {
+		return e
+	}
+	a.rm.Lock()
+	if _, ok := a.registry[name]; ok {
+		a.rm.Unlock()
+		return porterr.NewF(ConsumerErrorExists, "Consumer '%s' already registered", name)
+	}
+	if a.registry == nil {
+		a.registry = make(Registry)
+	}
+	consumer.name = name
+	a.registry[name] = consumer
+	a.rm.Unlock()
+	if start {
+		return a.StartConsumer(name)
+	}
+	return nil
+}
+
+// UnregisterConsumer Stop consumer and remove it from registry
+// Consumer is removed only when it is stopped, so consumer failed to stop is still available for commands
+func (a *Application) UnregisterConsumer(name string) porterr.IError {
+	consumer, e := a.getConsumer(name)
+	if e != nil {
+		return e
+	}
+	if e = a.stopConsumer(name, consumer); e != nil && e.GetCode() != ConsumerErrorStopped {
+		return e
+	}
+	a.rm.Lock()
+	defer a.rm.Unlock()
+	if a.registry[name] != consumer {
+		return porterr.NewF(ConsumerErrorNotFound, "Consumer '%s' not found in registry", name)
+	}
+	// Consumer is started again while stopping
+	if consumer.State() != ConsumerStateIdle {
+		return porterr.NewF(ConsumerErrorStarted, "Subscribers for '%s' already started", name)
+	}
+	delete(a.registry, name)
+	return nil
+}
+
+// Consumer add command processor
+// consumer add name queue server handler [N] [start]
+func (a *Application) addConsumer(args []gocli.Argument) (string, porterr.IError) {
+	if len(args) < 4 {
+		return "", porterr.New(porterr.PortErrorArgument, "Consumer add command must contain name, queue, server and handler")
+	}
+	name := args[0].Name
+	h, e := a.getHandler(args[3].Name)
+	if e != nil {
+		return name, e
+	}
+	consumer := &Consumer{Queue: args[1].Name, Server: args[2].Name, Handler: h, Count: 1}
+	var start bool
+	for _, arg := range args[4:] {
+		if arg.Name == CommandStart {
+			start = true
+			continue
+		}
+		count, err := strconv.Atoi(arg.Name)
+		if err != nil || count < 0 || count > math.MaxUint16 {
+			return name, porterr.NewF(porterr.PortErrorArgument, "Wrong subscribers count: %s", arg.Name)
+		}
+		consumer.Count = uint16(count)
+	}
+	return name, a.RegisterConsumer(name, consumer, start)
+}
@@ -0,0 +1,293 @@
+package gorabbit
+
+import (
+	"fmt"
+	"github.com/dimonrus/gocli"
+	"github.com/dimonrus/porterr"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// CommandConfig config command keyword
+	CommandConfig = "config"
+	// CommandReload config reload action
+	CommandReload = "reload"
+)
+
+// ConfigLoader Load actual configuration for config reload command
+type ConfigLoader func() (Config, porterr.IError)
+
+// ReloadResult Changes applied by config reload
+type ReloadResult struct {
+	// Consumers restarted because of changed queue or server
+	Restarted []string `json:"restarted"`
+	// Consumers stopped because queue or server was removed from config
+	Stopped []string `json:"stopped"`
+	// Queues with added or removed routing keys
+	Rebound []string `json:"rebound"`
+	// Servers with rebuilt publish connection pool
+	Pools []string `json:"pools"`
+	// Error code
+	Code string `json:"code,omitempty"`
+	// Error message
+	Error string `json:"error,omitempty"`
+}
+
+// Queue binding to exchange
+type binding struct {
+	// Exchange name
+	exchange string
+	// Routing key
+	key string
+}
+
+// SetConfigLoader Set loader of configuration for config reload command
+func (a *Application) SetConfigLoader(l ConfigLoader) *Application {
+	a.configLoader = l
+	return a
+}
+
+// ReloadConfig Replace configuration without process restart
+// Running consumers are restarted only when their queue or server definition is changed
+// Added and removed routing keys of declared queues are bound and unbound on dedicated channel without restart
+// Publish connection pool of changed server is replaced with pool of new server config
+// Publish connection pool of removed server is closed. Consumers of removed queue or server are stopped
+// Consumers are restarted on server change only when connection address or credentials are changed
+// Concurrent reloads are applied one by one
+func (a *Application) ReloadConfig(newConfig Config) (ReloadResult, porterr.IError) {
+	a.lm.Lock()
+	defer a.lm.Unlock()
+	result := ReloadResult{Restarted: []string{}, Stopped: []string{}, Rebound: []string{}, Pools: []string{}}
+	a.cm.Lock()
+	old := a.config
+	a.config = &newConfig
+	a.cm.Unlock()
+	// Changed and removed servers
+	servers := make(map[string]bool)
+	// Servers with changed connection of consumers
+	reconnect := make(map[string]bool)
+	for name, srv := range old.Servers {
+		actual, ok := newConfig.Servers[name]
+		if !ok || actual != srv {
+			servers[name] = true
+		}
+		if !ok || actual.String() != srv.String() {
+			reconnect[name] = true
+		}
+	}
+	for name := range servers {
+		if srv, ok := newConfig.Servers[name]; ok {
+			a.sp.ReplacePool(name, srv)
+		} else {
+			a.sp.ClosePool(name)
+		}
+		a.closeRPCClient(name)
+		result.Pools = append(result.Pools, name)
+	}
+	var e porterr.IError
+	result.Rebound, e = a.rebindQueues(old, &newConfig)
+	for _, name := range a.consumerNames() {
+		consumer, err := a.getConsumer(name)
+		if err != nil {
+			continue
+		}
+		switch consumer.State() {
+		case "", ConsumerStateIdle, ConsumerStateStopping:
+			continue
+		}
+		oldQueue, err := old.GetQueue(consumer.Queue)
+		if err != nil {
+			continue
+		}
+		queue, queueErr := newConfig.GetQueue(consumer.Queue)
+		_, serverErr := newConfig.GetServer(consumer.Server)
+		if queueErr != nil || serverErr != nil {
+			if err = a.StopConsumer(name); err != nil && !isConsumerStateError(err) && e == nil {
+				e = err
+			}
+			result.Stopped = append(result.Stopped, name)
+			continue
+		}
+		if queueChanged(*oldQueue, *queue) || reconnect[consumer.Server] {
+			if err = a.RestartConsumer(name); err != nil && e == nil {
+				e = err
+			}
+			result.Restarted = append(result.Restarted, name)
+		}
+	}
+	sort.Strings(result.Pools)
+	return result, e
+}
+
+// Bind added and unbind removed routing keys of queues kept in config
+// Bindings are changed on servers of registered consumers of queue or on server of queue
+// Queue not declared on server is skipped because it is bound on declare by consumer
+func (a *Application) rebindQueues(old, config *Config) ([]string, porterr.IError) {
+	rebound := make([]string, 0)
+	names := make([]string, 0, len(config.Queues))
+	for name := range config.Queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var e porterr.IError
+	for _, name := range names {
+		oldQueue, err := old.GetQueue(name)
+		if err != nil {
+			continue
+		}
+		queue, _ := config.GetQueue(name)
+		added, removed := diffBindings(*oldQueue, *queue)
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		done := false
+		for _, server := range a.bindingServers(queue) {
+			err = a.withServerChannel(server, func(channel Channel) porterr.IError {
+				declared, err := rebind(channel, *oldQueue, *queue, added, removed)
+				done = done || declared
+				return err
+			})
+			if err != nil && e == nil {
+				e = err
+			}
+		}
+		if done {
+			rebound = append(rebound, name)
+		}
+	}
+	return rebound, e
+}
+
+// Servers of registered consumers of queue. Server of queue is used when queue has no consumers
+func (a *Application) bindingServers(q *RabbitQueue) []string {
+	servers := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, consumer := range a.GetRegistry() {
+		if consumer.Queue == q.Name && !seen[consumer.Server] {
+			seen[consumer.Server] = true
+			servers = append(servers, consumer.Server)
+		}
+	}
+	if len(servers) == 0 {
+		if server, e := a.queueServer(q); e == nil {
+			servers = append(servers, server)
+		}
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// Declare exchange of queue, bind added and unbind removed routing keys on channel
+// False is returned when queue is not declared on server
+func rebind(channel Channel, oldQueue, queue RabbitQueue, added, removed []binding) (bool, porterr.IError) {
+	if _, err := channel.QueueDeclarePassive(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, nil); err != nil {
+		return false, nil
+	}
+	if len(added) > 0 && queue.Exchange != "" {
+		if err := channel.ExchangeDeclare(queue.Exchange, queue.Type, queue.Durable, queue.AutoDelete, queue.Internal, queue.Nowait, queue.Arguments); err != nil {
+			return false, porterr.NewF(porterr.PortErrorConnection, "Failed to declare exchange: '%s'", queue.Exchange)
+		}
+	}
+	for _, b := range removed {
+		if err := channel.QueueUnbind(oldQueue.Name, b.key, b.exchange, oldQueue.Arguments); err != nil {
+			return false, porterr.NewF(porterr.PortErrorConnection, "Failed to unbind a queue: '%s' for key '%s'", oldQueue.Name, b.key)
+		}
+	}
+	for _, b := range added {
+		if err := channel.QueueBind(queue.Name, b.key, b.exchange, queue.Nowait, queue.Arguments); err != nil {
+			return false, porterr.NewF(porterr.PortErrorConnection, "Failed to bind a queue: '%s' for key '%s'", queue.Name, b.key)
+		}
+	}
+	return true, nil
+}
+
+// Queue definition used by consumer is changed
+func queueChanged(oldQueue, queue RabbitQueue) bool {
+	return !reflect.DeepEqual(consumeDefinition(oldQueue), consumeDefinition(queue))
+}
+
+// Queue definition without options not affecting consuming
+// Routing keys are rebound without restart. Publish options are read from config on every publish
+func consumeDefinition(q RabbitQueue) RabbitQueue {
+	q.RoutingKey = nil
+	q.Mandatory = false
+	q.Interceptors = nil
+	q.Delay = ""
+	return q
+}
+
+// Bindings of new queue that are absent in old queue and bindings of old queue absent in new queue
+func diffBindings(oldQueue, queue RabbitQueue) (added []binding, removed []binding) {
+	oldBindings, bindings := queueBindings(oldQueue), queueBindings(queue)
+	for _, b := range bindings {
+		if !containsBinding(oldBindings, b) {
+			added = append(added, b)
+		}
+	}
+	for _, b := range oldBindings {
+		if !containsBinding(bindings, b) {
+			removed = append(removed, b)
+		}
+	}
+	return
+}
+
+// Bindings of queue. Empty routing key is used when keys are not defined
+func queueBindings(q RabbitQueue) []binding {
+	keys := q.RoutingKey
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	bindings := make([]binding, 0, len(keys))
+	for _, key := range keys {
+		bindings = append(bindings, binding{exchange: q.Exchange, key: key})
+	}
+	return bindings
+}
+
+// Check binding is in list
+func containsBinding(bindings []binding, b binding) bool {
+	for _, item := range bindings {
+		if item == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Config command processor
+// config reload
+func (a *Application) configCommander(command *gocli.Command) {
+	args, asJSON := ParseOutputFormat(command, command.Arguments())
+	if len(args) < 2 || args[1].Name != CommandReload {
+		a.AttentionMessage("Unknown command: "+command.GetOrigin(), command)
+		return
+	}
+	var result ReloadResult
+	var e porterr.IError
+	if a.configLoader == nil {
+		e = porterr.New(porterr.PortErrorSystem, "Config loader is not defined")
+	} else {
+		var config Config
+		if config, e = a.configLoader(); e == nil {
+			result, e = a.ReloadConfig(config)
+		}
+	}
+	if e != nil {
+		result.Code = fmt.Sprint(e.GetCode())
+		result.Error = e.Error()
+	}
+	if asJSON {
+		a.respondJSON(command, result)
+		return
+	}
+	if e != nil {
+		a.FailMessage(e.Error(), command)
+		return
+	}
+	a.SuccessMessage(fmt.Sprintf("Config is reloaded. Restarted: [%s], stopped: [%s], rebound: [%s], pools: [%s]",
+		strings.Join(result.Restarted, ", "), strings.Join(result.Stopped, ", "),
+		strings.Join(result.Rebound, ", "), strings.Join(result.Pools, ", ")), command)
+}
@@ -0,0 +1,244 @@
+package gorabbit
+
+import (
+	"context"
+	"fmt"
+	"github.com/dimonrus/gocli"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"strconv"
+)
+
+const (
+	// CommandReplay queue replay action
+	CommandReplay = "replay"
+
+	// CommandKeyWordDry replay without publishing
+	CommandKeyWordDry = "dry"
+	// CommandKeyWordKey routing key filter of replay
+	CommandKeyWordKey = "key"
+	// CommandKeyWordHeader header filter of replay
+	CommandKeyWordHeader = "header"
+)
+
+// ReplayFilter Filter of replayed messages. Empty filter matches all messages
+type ReplayFilter struct {
+	// Routing key of message. Empty matches any key
+	RoutingKey string
+	// Headers of message. Values are compared as strings
+	Headers map[string]string
+}
+
+// Match Check delivery matches filter
+func (f ReplayFilter) Match(d amqp.Delivery) bool {
+	if f.RoutingKey != "" && f.RoutingKey != d.RoutingKey {
+		return false
+	}
+	for k, v := range f.Headers {
+		value, ok := d.Headers[k]
+		if !ok || fmt.Sprint(value) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ReplayResult Result of replay
+type ReplayResult struct {
+	// Source queue
+	Source string `json:"source"`
+	// Destination queue
+	Destination string `json:"destination"`
+	// Messages received from source
+	Scanned int `json:"scanned"`
+	// Messages matched filter
+	Matched int `json:"matched"`
+	// Messages published to destination and removed from source
+	Replayed int `json:"replayed"`
+	// Nothing is published and removed
+	DryRun bool `json:"dryRun"`
+	// Error code
+	Code string `json:"code,omitempty"`
+	// Error message
+	Error string `json:"error,omitempty"`
+}
+
+// Replay Move up to limit messages matched filter from src queue to dst queue
+// Message is published once through ServerPool of server of dst queue to its original exchange and routing key
+// from x-death header. Message without x-death is published to exchange of dst queue with its routing key
+// when dst queue is bound with it, otherwise with the first routing key of dst queue
+// Message is acked in src only after publish is confirmed. Zero limit means all messages
+// Not matched messages are requeued when replay is finished
+func (a *Application) Replay(src, dst string, filter ReplayFilter, limit int) (ReplayResult, porterr.IError) {
+	return a.replay(src, dst, filter, limit, false)
+}
+
+// ReplayDryRun Count messages that would be replayed. Messages are requeued
+func (a *Application) ReplayDryRun(src, dst string, filter ReplayFilter, limit int) (ReplayResult, porterr.IError) {
+	return a.replay(src, dst, filter, limit, true)
+}
+
+// Replay messages or count them on dry run
+func (a *Application) replay(src, dst string, filter ReplayFilter, limit int, dryRun bool) (ReplayResult, porterr.IError) {
+	result := ReplayResult{Source: src, Destination: dst, DryRun: dryRun}
+	q, e := a.GetConfig().GetQueue(dst)
+	if e != nil {
+		return result, e
+	}
+	server, e := a.queueServer(q)
+	if e != nil {
+		return result, e
+	}
+	cp, e := a.connectionPool(server)
+	if e != nil {
+		return result, e
+	}
+	e = a.withQueueChannel(src, func(sq *RabbitQueue, _ string, channel Channel) porterr.IError {
+		// Skipped messages are kept unacked to not receive them again
+		skipped := make([]amqp.Delivery, 0)
+		defer func() {
+			// Requeue in reverse order to keep original order in queue head
+			for i := len(skipped) - 1; i >= 0; i-- {
+				_ = skipped[i].Nack(false, true)
+			}
+		}()
+		for limit <= 0 || result.Matched < limit {
+			d, ok, err := channel.Get(sq.Name, false)
+			if err != nil {
+				return porterr.NewF(porterr.PortErrorConnection, "Queue '%s' get error: %s", sq.Name, err.Error())
+			}
+			if !ok {
+				return nil
+			}
+			result.Scanned++
+			if !filter.Match(d) {
+				skipped = append(skipped, d)
+				continue
+			}
+			result.Matched++
+			if dryRun {
+				skipped = append(skipped, d)
+				continue
+			}
+			target, key := replayRoute(d, *q)
+			if e := cp.Publish(context.Background(), deliveryPublishing(d), target, key); e != nil {
+				_ = d.Nack(false, true)
+				return e
+			}
+			if err = d.Ack(false); err != nil {
+				return porterr.NewF(porterr.PortErrorConnection, "Queue '%s' ack error: %s", sq.Name, err.Error())
+			}
+			result.Replayed++
+		}
+		return nil
+	})
+	return result, e
+}
+
+// Original route of dead-lettered message from the latest x-death entry
+// Exchange and routing key of dst queue are used when original route is unknown
+func replayRoute(d amqp.Delivery, dst RabbitQueue) (RabbitQueue, string) {
+	if deaths, ok := d.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			exchange, isString := death["exchange"].(string)
+			keys, _ := death["routing-keys"].([]interface{})
+			if isString && len(keys) > 0 {
+				if key, ok := keys[0].(string); ok {
+					dst.Exchange = exchange
+					return dst, key
+				}
+			}
+		}
+	}
+	for _, key := range dst.RoutingKey {
+		if key == d.RoutingKey {
+			return dst, key
+		}
+	}
+	if len(dst.RoutingKey) > 0 {
+		return dst, dst.RoutingKey[0]
+	}
+	return dst, ""
+}
+
+// Copy properties and body of delivery to publishing
+func deliveryPublishing(d amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// Replay command processor
+// queue replay src dst [N] [dry] [key routing_key] [header name value]
+func (a *Application) replayCommander(command *gocli.Command, args []gocli.Argument, asJSON bool) {
+	if len(args) < 4 {
+		a.FailMessage("Replay command must contain source and destination queues", command)
+		return
+	}
+	src, dst := args[2].Name, args[3].Name
+	filter := ReplayFilter{Headers: make(map[string]string)}
+	var limit int
+	var dryRun bool
+	var e porterr.IError
+	for i := 4; i < len(args) && e == nil; i++ {
+		switch args[i].Name {
+		case CommandKeyWordDry:
+			dryRun = true
+		case CommandKeyWordKey:
+			if i+1 >= len(args) {
+				e = porterr.New(porterr.PortErrorArgument, "Routing key is not defined")
+				break
+			}
+			i++
+			filter.RoutingKey = args[i].Name
+		case CommandKeyWordHeader:
+			if i+2 >= len(args) {
+				e = porterr.New(porterr.PortErrorArgument, "Header must contain name and value")
+				break
+			}
+			filter.Headers[args[i+1].Name] = args[i+2].Name
+			i += 2
+		default:
+			n, err := strconv.Atoi(args[i].Name)
+			if err != nil || n < 0 {
+				e = porterr.NewF(porterr.PortErrorArgument, "Unknown replay argument: %s", args[i].Name)
+				break
+			}
+			limit = n
+		}
+	}
+	result := ReplayResult{Source: src, Destination: dst, DryRun: dryRun}
+	if e == nil {
+		result, e = a.replay(src, dst, filter, limit, dryRun)
+	}
+	if e != nil {
+		result.Code = fmt.Sprint(e.GetCode())
+		result.Error = e.Error()
+	}
+	if asJSON {
+		a.respondJSON(command, result)
+		return
+	}
+	if e != nil {
+		a.FailMessage(e.Error(), command)
+	}
+	message := fmt.Sprintf("Replay '%s' to '%s': scanned %v, matched %v, replayed %v", src, dst, result.Scanned, result.Matched, result.Replayed)
+	if dryRun {
+		a.AttentionMessage("Dry run. "+message, command)
+	} else {
+		a.SuccessMessage(message, command)
+	}
+}
@@ -0,0 +1,323 @@
+package gorabbit
+
+import (
+	"context"
+	"errors"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DirectReplyTo Pseudo queue of RabbitMQ direct reply-to
+	DirectReplyTo = "amq.rabbitmq.reply-to"
+	// DefaultCallTimeout Default timeout of call when context has no deadline
+	DefaultCallTimeout = time.Second * 30
+
+	// CallErrorTimeout Call error code. Reply is not received before deadline of context
+	CallErrorTimeout = "GORABBIT_CALL_TIMEOUT"
+	// CallErrorCanceled Call error code. Context of call is canceled
+	CallErrorCanceled = "GORABBIT_CALL_CANCELED"
+	// CallErrorClosed Call error code. Reply channel is closed before reply
+	CallErrorClosed = "GORABBIT_CALL_CLOSED"
+)
+
+// ReplyMode Mode of receiving replies of calls
+type ReplyMode uint8
+
+const (
+	// ReplyModeDirect Replies are received with direct reply-to. Default mode
+	ReplyModeDirect ReplyMode = iota
+	// ReplyModeQueue Replies are received from exclusive auto-delete queue of application
+	ReplyModeQueue
+)
+
+// ReplyHandler Handler of request returning reply
+// Reply is published to ReplyTo of request with CorrelationId of request on nil error
+// Error is processed as error of Handler and reply is not published
+type ReplyHandler func(ctx context.Context, d amqp.Delivery) (amqp.Publishing, porterr.IError)
+
+// Client of calls to one server
+// Requests are published on channel consuming replies as direct reply-to requires
+type rpcClient struct {
+	// Connection of client
+	connection Connection
+	// Channel for requests and replies
+	channel Channel
+	// Reply address of requests
+	replyTo string
+	// Lock for calls
+	m sync.Mutex
+	// Waiting calls by correlation id
+	calls map[string]chan rpcResult
+	// Client is closed
+	closed bool
+}
+
+// Reply or error of call
+type rpcResult struct {
+	// Reply delivery
+	d amqp.Delivery
+	// Call error
+	e porterr.IError
+}
+
+// SetReplyMode Set mode of receiving replies of calls
+// Mode is applied to clients created after set
+func (a *Application) SetReplyMode(mode ReplyMode) *Application {
+	a.rpcm.Lock()
+	defer a.rpcm.Unlock()
+	a.replyMode = mode
+	return a
+}
+
+// Call Publish request and wait for reply with the same CorrelationId
+// Empty CorrelationId and MessageId are generated. ReplyTo is set by client of server
+// DefaultCallTimeout is applied when ctx has no deadline
+func (a *Application) Call(ctx context.Context, queue string, server string, p amqp.Publishing, route ...string) (d amqp.Delivery, e porterr.IError) {
+	config := a.GetConfig()
+	srv, e := config.GetServer(server)
+	if e != nil {
+		return
+	}
+	srv.init()
+	q, e := config.GetQueue(queue)
+	if e != nil {
+		return
+	}
+	if len(route) == 0 {
+		route = q.RoutingKey
+	}
+	if len(route) == 0 {
+		route = append(route, "")
+	}
+	interceptors, e := a.publishInterceptors(q)
+	if e != nil {
+		return
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+	client, e := a.getRPCClient(server, *srv)
+	if e != nil {
+		return
+	}
+	headers := make(amqp.Table, len(p.Headers)+2)
+	for k, v := range p.Headers {
+		headers[k] = v
+	}
+	p.Headers = headers
+	if p.CorrelationId == "" {
+		p.CorrelationId = NewMessageId()
+	}
+	ctx, span := a.tracer.Start(ctx, queue+" call", SpanKindProducer)
+	defer func() {
+		if e != nil {
+			span.RecordError(e)
+		}
+		span.End()
+	}()
+	span.SetAttribute(AttributeMessagingSystem, "rabbitmq")
+	span.SetAttribute(AttributeDestination, queue)
+	span.SetAttribute(AttributeRoutingKey, strings.Join(route, ","))
+	var replies chan rpcResult
+	var correlationId string
+	publish := func(ctx context.Context, m *PublishMessage) porterr.IError {
+		if m.Publishing.MessageId == "" {
+			m.Publishing.MessageId = NewMessageId()
+		}
+		span.SetAttribute(AttributeMessageId, m.Publishing.MessageId)
+		InjectTraceContext(m.Publishing.Headers, span.SpanContext())
+		m.Publishing.ReplyTo = client.replyTo
+		correlationId = m.Publishing.CorrelationId
+		if replies = client.register(correlationId); replies == nil {
+			return porterr.New(CallErrorClosed, "Reply channel is closed")
+		}
+		for _, key := range m.Route {
+			if err := client.channel.Publish(q.Exchange, key, q.Mandatory, false, m.Publishing); err != nil {
+				return porterr.NewF(porterr.PortErrorProducer, err.Error())
+			}
+			a.metrics.Published(Labels{Server: m.Server, Queue: m.Queue})
+		}
+		return nil
+	}
+	e = ChainPublish(publish, interceptors...)(ctx, &PublishMessage{Publishing: p, Queue: queue, Server: server, Route: route})
+	if replies != nil {
+		defer client.unregister(correlationId)
+	}
+	if e != nil {
+		return
+	}
+	select {
+	case r := <-replies:
+		return r.d, r.e
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			e = porterr.NewF(CallErrorTimeout, "Reply of call to '%s' is not received: %s", queue, ctx.Err().Error())
+		} else {
+			e = porterr.NewF(CallErrorCanceled, "Call to '%s' is canceled: %s", queue, ctx.Err().Error())
+		}
+		return
+	}
+}
+
+// Reply Publish reply to ReplyTo of request with CorrelationId of request
+// Reply is published through pool of server of consumer from ctx
+func (a *Application) Reply(ctx context.Context, request amqp.Delivery, p amqp.Publishing) porterr.IError {
+	if request.ReplyTo == "" {
+		return porterr.New(porterr.PortErrorParam, "Request has no reply address")
+	}
+	info := ConsumerInfoFromContext(ctx)
+	cp, e := a.connectionPool(info.Server)
+	if e != nil {
+		return e
+	}
+	p.CorrelationId = request.CorrelationId
+	if p.MessageId == "" {
+		p.MessageId = NewMessageId()
+	}
+	// Default exchange routes reply by name of reply queue
+	return cp.Publish(ctx, p, RabbitQueue{Name: request.ReplyTo}, request.ReplyTo)
+}
+
+// Wrap reply handler into handler publishing reply when request has reply address
+func replyHandler(h ReplyHandler, reply func(ctx context.Context, request amqp.Delivery, p amqp.Publishing) porterr.IError) Handler {
+	return func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		p, e := h(ctx, d)
+		if e != nil || d.ReplyTo == "" {
+			return e
+		}
+		return reply(ctx, d, p)
+	}
+}
+
+// Get client of server or create new one when client is closed
+func (a *Application) getRPCClient(server string, srv RabbitServer) (*rpcClient, porterr.IError) {
+	a.rpcm.Lock()
+	defer a.rpcm.Unlock()
+	if c, ok := a.rpc[server]; ok && !c.isClosed() {
+		return c, nil
+	}
+	conn, err := a.dialer(srv.String())
+	if err != nil {
+		return nil, porterr.NewF(porterr.PortErrorConnection, "Failed connect to %s RabbitMQ Server", srv.Host)
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return nil, porterr.NewF(porterr.PortErrorConnection, "RabbitMQ Channel Error")
+	}
+	replyTo := DirectReplyTo
+	if a.replyMode == ReplyModeQueue {
+		q, err := channel.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			_ = conn.Close()
+			return nil, porterr.NewF(porterr.PortErrorConnection, "Failed to declare reply queue: %s", err.Error())
+		}
+		replyTo = q.Name
+	}
+	deliveries, err := channel.Consume(replyTo, "", true, true, false, false, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, porterr.NewF(porterr.PortErrorConnection, "Failed to consume replies: %s", err.Error())
+	}
+	c := &rpcClient{
+		connection: conn,
+		channel:    channel,
+		replyTo:    replyTo,
+		calls:      make(map[string]chan rpcResult),
+	}
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+	go c.listen(deliveries, returns)
+	if a.rpc == nil {
+		a.rpc = make(map[string]*rpcClient)
+	}
+	a.rpc[server] = c
+	return c, nil
+}
+
+// Close client of server. New client is created on next call
+func (a *Application) closeRPCClient(server string) {
+	a.rpcm.Lock()
+	c, ok := a.rpc[server]
+	delete(a.rpc, server)
+	a.rpcm.Unlock()
+	if ok {
+		_ = c.connection.Close()
+	}
+}
+
+// Register call waiting for reply. Returns nil when client is closed
+func (c *rpcClient) register(correlationId string) chan rpcResult {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return nil
+	}
+	replies := make(chan rpcResult, 1)
+	c.calls[correlationId] = replies
+	return replies
+}
+
+// Remove call
+func (c *rpcClient) unregister(correlationId string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.calls, correlationId)
+}
+
+// Pass result to waiting call. Result of unknown or completed call is dropped
+func (c *rpcClient) resolve(correlationId string, r rpcResult) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if replies, ok := c.calls[correlationId]; ok {
+		delete(c.calls, correlationId)
+		replies <- r
+	}
+}
+
+// Check if client is closed
+func (c *rpcClient) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.closed
+}
+
+// Dispatch replies and returned requests until reply consumer is closed
+// Waiting calls fail with CallErrorClosed on close
+func (c *rpcClient) listen(deliveries <-chan amqp.Delivery, returns <-chan amqp.Return) {
+	for deliveries != nil {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				deliveries = nil
+				continue
+			}
+			c.resolve(d.CorrelationId, rpcResult{d: d})
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.resolve(r.CorrelationId, rpcResult{e: porterr.NewF(PublishErrorReturned, "Message returned: %v %s", r.ReplyCode, r.ReplyText)})
+		}
+	}
+	c.m.Lock()
+	c.closed = true
+	calls := c.calls
+	c.calls = make(map[string]chan rpcResult)
+	c.m.Unlock()
+	for _, replies := range calls {
+		replies <- rpcResult{e: porterr.New(CallErrorClosed, "Reply channel is closed before reply")}
+	}
+	// Returns are closed with channel
+	_ = c.connection.Close()
+	if returns != nil {
+		for range returns {
+		}
+	}
+}
@@ -12,6 +12,8 @@ const (
 	DefaultMaxIdleConnectionLifeTime = 10 * time.Second
 	// DefaultMaxConnectionOnRPS Maximum connection on 5000 rps
 	DefaultMaxConnectionOnRPS = 5000
+	// DefaultMaxMessagesPerConnection Default count of messages before channel recycling
+	DefaultMaxMessagesPerConnection = int64(50000)
 )
 
 // RabbitServer Server configuration
@@ -30,6 +32,8 @@ type RabbitServer struct {
 	MaxConnections int `yaml:"maxPublishConnections"`
 	// Maximum lifetime for idle connection
 	MaxIdleConnectionLifeTime time.Duration `yaml:"maxIdleConnectionLifeTime"`
+	// Publish channel will be reopened on reach limit
+	MaxMessagesPerConnection int64 `yaml:"maxMessagesPerConnection"`
 }
 
 // Get connection string
@@ -45,4 +49,7 @@ func (srv *RabbitServer) init() {
 	if srv.MaxConnections == 0 {
 		srv.MaxConnections = DefaultMaxConnections
 	}
+	if srv.MaxMessagesPerConnection == 0 {
+		srv.MaxMessagesPerConnection = DefaultMaxMessagesPerConnection
+	}
 }
@@ -0,0 +1,43 @@
+//go:build go1.21
+
+package gorabbit
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Adapter of slog.Logger
+type slogLogger struct {
+	// Wrapped logger
+	logger *slog.Logger
+}
+
+// NewSlogLogger Create structured logger on top of slog.Logger
+func NewSlogLogger(l *slog.Logger) Logger {
+	return &slogLogger{logger: l}
+}
+
+// Log write entry
+func (s *slogLogger) Log(level LogLevel, msg string, fields ...Field) {
+	var lvl slog.Level
+	switch level {
+	case LogLevelDebug:
+		lvl = slog.LevelDebug
+	case LogLevelWarn:
+		lvl = slog.LevelWarn
+	case LogLevelError:
+		lvl = slog.LevelError
+	default:
+		lvl = slog.LevelInfo
+	}
+	ctx := context.Background()
+	if !s.logger.Enabled(ctx, lvl) {
+		return
+	}
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	s.logger.LogAttrs(ctx, lvl, msg, attrs...)
+}
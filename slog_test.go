@@ -0,0 +1,23 @@
+//go:build go1.21
+
+package gorabbit
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	l.Log(LogLevelDebug, "skipped")
+	l.Log(LogLevelError, "processing error", F(FieldConsumer, "orders"), F(FieldDeliveryTag, uint64(7)))
+	if strings.Contains(buf.String(), "skipped") {
+		t.Fatal("debug entry must be skipped")
+	}
+	if !strings.Contains(buf.String(), `level=ERROR msg="processing error" consumer=orders delivery_tag=7`) {
+		t.Fatalf("wrong entry %s", buf.String())
+	}
+}
@@ -0,0 +1,188 @@
+package gorabbit
+
+import (
+	"context"
+	"fmt"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+	"time"
+)
+
+// HeaderStreamOffset Header with stream offset of delivery. Also consumer argument with start offset
+const HeaderStreamOffset = "x-stream-offset"
+
+// StreamOffset Start position of stream consumer. Zero value means next
+type StreamOffset struct {
+	// Value of x-stream-offset argument
+	value interface{}
+}
+
+var (
+	// StreamFirst Start from the first message available in stream
+	StreamFirst = StreamOffset{value: "first"}
+	// StreamLast Start from the last chunk of stream
+	StreamLast = StreamOffset{value: "last"}
+	// StreamNext Start from the next message published to stream
+	StreamNext = StreamOffset{value: "next"}
+)
+
+// StreamAt Start from offset
+func StreamAt(offset int64) StreamOffset {
+	return StreamOffset{value: offset}
+}
+
+// StreamSince Start from messages published since time
+func StreamSince(t time.Time) StreamOffset {
+	return StreamOffset{value: t}
+}
+
+// IsZero check if offset is not set
+func (o StreamOffset) IsZero() bool {
+	return o.value == nil
+}
+
+// Argument Value of x-stream-offset consumer argument. Nil when offset is not set
+func (o StreamOffset) Argument() interface{} {
+	return o.value
+}
+
+// String offset for logs
+func (o StreamOffset) String() string {
+	if o.value == nil {
+		return "next"
+	}
+	return fmt.Sprint(o.value)
+}
+
+// DeliveryOffset Get stream offset of delivery. ok is false for delivery of not stream queue
+func DeliveryOffset(d amqp.Delivery) (offset int64, ok bool) {
+	switch v := d.Headers[HeaderStreamOffset].(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// OffsetStore Store of processed offsets of stream consumers
+type OffsetStore interface {
+	// Load last processed offset of consumer of queue. ok is false when offset is not stored
+	Load(ctx context.Context, consumer string, queue string) (offset int64, ok bool, err error)
+	// Save last processed offset of consumer of queue
+	Save(ctx context.Context, consumer string, queue string, offset int64) error
+}
+
+// OffsetMiddleware Save offset of successfully processed delivery of stream
+// Consumer and queue are taken from context. Error of store save is logged with log when set
+// and does not fail delivery because delivery is processed
+func OffsetMiddleware(store OffsetStore, log Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, d amqp.Delivery) porterr.IError {
+			e := next(ctx, d)
+			if offset, ok := DeliveryOffset(d); ok && e == nil {
+				info := ConsumerInfoFromContext(ctx)
+				if err := store.Save(ctx, info.Name, info.Queue, offset); err != nil && log != nil {
+					log.Log(LogLevelError, "offset save error", F(FieldConsumer, info.Name), F(FieldQueue, info.Queue),
+						F(FieldSubscriber, info.Subscriber), F(FieldOffset, offset), F(FieldError, err.Error()))
+				}
+			}
+			return e
+		}
+	}
+}
+
+// MemoryOffsetStore In-memory store of offsets
+type MemoryOffsetStore struct {
+	// Lock for offsets
+	m sync.Mutex
+	// Offsets by consumer and queue
+	offsets map[string]int64
+}
+
+// NewMemoryOffsetStore Create memory store of offsets
+func NewMemoryOffsetStore() *MemoryOffsetStore {
+	return &MemoryOffsetStore{offsets: make(map[string]int64)}
+}
+
+// Load last processed offset of consumer of queue
+func (s *MemoryOffsetStore) Load(ctx context.Context, consumer string, queue string) (int64, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	offset, ok := s.offsets[consumer+"/"+queue]
+	return offset, ok, nil
+}
+
+// Save last processed offset of consumer of queue
+func (s *MemoryOffsetStore) Save(ctx context.Context, consumer string, queue string, offset int64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.offsets[consumer+"/"+queue] = offset
+	return nil
+}
+
+// Check if queue is declared as stream
+func (q *RabbitQueue) isStream() bool {
+	return q.queueType() == QueueTypeStream
+}
+
+// Validate stream options of consumer
+// Stream requires prefetch. Offsets are saved in order only by single sequential subscriber
+func (c *Consumer) validateStream(q *RabbitQueue, prefetch Prefetch) porterr.IError {
+	if !q.isStream() {
+		if !c.StreamOffset.IsZero() || c.OffsetStore != nil {
+			return porterr.NewF(porterr.PortErrorParam, "Stream offset requires stream queue, '%s' is not a stream", q.Name)
+		}
+		return nil
+	}
+	if prefetch.Count <= 0 {
+		return porterr.NewF(porterr.PortErrorParam, "Prefetch count is required for stream queue '%s'", q.Name)
+	}
+	if c.OffsetStore != nil && (c.count() > 1 || c.Concurrency > 1 || c.BatchHandler != nil) {
+		return porterr.New(porterr.PortErrorParam, "Offset store requires single subscriber with sequential processing")
+	}
+	return nil
+}
+
+// Store of processed offsets of stream consumer. Nil when offsets are not tracked
+// Without OffsetStore offsets of single sequential subscriber are kept in memory of consumer,
+// so consuming is resumed after processed offset on pause, reconnect and restart of consumer
+// Offsets of many or concurrent subscribers are not tracked because they are not processed in order
+func (c *Consumer) offsetStore() OffsetStore {
+	if c.OffsetStore != nil {
+		return c.OffsetStore
+	}
+	if !c.stream || c.count() > 1 || c.Concurrency > 1 || c.BatchHandler != nil {
+		return nil
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.offsets == nil {
+		c.offsets = NewMemoryOffsetStore()
+	}
+	return c.offsets
+}
+
+// Consume arguments of subscriber. Stream consuming is resumed after stored offset
+func (c *Consumer) consumeArgs() (amqp.Table, porterr.IError) {
+	if !c.stream {
+		return nil, nil
+	}
+	offset := c.StreamOffset
+	if store := c.offsetStore(); store != nil {
+		stored, ok, err := store.Load(context.Background(), c.name, c.Queue)
+		if err != nil {
+			return nil, porterr.NewF(porterr.PortErrorSystem, "Offset store error: %s", err.Error())
+		}
+		if ok {
+			offset = StreamAt(stored + 1)
+		}
+	}
+	if offset.IsZero() {
+		return nil, nil
+	}
+	return amqp.Table{HeaderStreamOffset: offset.Argument()}, nil
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Send request to admin handler
+func adminRequest(t *testing.T, h http.Handler, method, path, body string, out interface{}) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestApplication_AdminHandler(t *testing.T) {
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{
+		"admin": {Queue: "rmq.fanout1", Server: "local", Count: 2, Callback: func(d amqp.Delivery) {}},
+	}).SetDialer(b.Dial).SetMetrics(gorabbit.NewPrometheusMetrics(nil))
+	h := a.AdminHandler()
+
+	if code := adminRequest(t, h, http.MethodGet, gorabbit.AdminPathLive, "", nil); code != http.StatusOK {
+		t.Fatal("liveness must be ok")
+	}
+	if code := adminRequest(t, h, http.MethodGet, gorabbit.AdminPathReady, "", nil); code != http.StatusOK {
+		t.Fatal("not started consumer must not fail readiness")
+	}
+	if code := adminRequest(t, h, http.MethodPost, "/consumers/unknown/start", "", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown consumer must return 404, got %v", code)
+	}
+	if code := adminRequest(t, h, http.MethodGet, "/consumers/admin/start", "", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("action must require POST, got %v", code)
+	}
+
+	if code := adminRequest(t, h, http.MethodPost, "/consumers/all/start", "", nil); code != http.StatusAccepted {
+		t.Fatalf("start must be accepted, got %v", code)
+	}
+	eventually(t, func() bool {
+		return adminRequest(t, h, http.MethodGet, gorabbit.AdminPathReady, "", nil) == http.StatusOK
+	})
+	var status gorabbit.ConsumerStatus
+	adminRequest(t, h, http.MethodGet, "/consumers/admin", "", &status)
+	if !status.Connected || status.Subscribers != 2 || status.Queue != "rmq.fanout1" {
+		t.Fatalf("wrong status %v", status)
+	}
+	if code := adminRequest(t, h, http.MethodPost, "/consumers/admin/start", "", nil); code != http.StatusConflict {
+		t.Fatalf("second start must conflict, got %v", code)
+	}
+
+	if code := adminRequest(t, h, http.MethodPost, "/consumers/admin/count", `{"count":1}`, nil); code != http.StatusAccepted {
+		t.Fatalf("set count must be accepted, got %v", code)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	eventually(t, func() bool {
+		return adminRequest(t, h, http.MethodGet, gorabbit.AdminPathReady, "", nil) == http.StatusOK
+	})
+	if code := adminRequest(t, h, http.MethodPost, "/consumers/admin/count?value=x", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("wrong count must fail, got %v", code)
+	}
+
+	if e := a.Publish(amqp.Publishing{}, "rmq.fanout1", "local"); e != nil {
+		t.Fatal(e)
+	}
+	pools := map[string]gorabbit.PoolStats{}
+	adminRequest(t, h, http.MethodGet, gorabbit.AdminPathPools, "", &pools)
+	if pools["local"].Open != 1 || pools["local"].MaxConnections != 15 {
+		t.Fatalf("wrong pool stats %v", pools)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, gorabbit.AdminPathMetrics, nil))
+	if !strings.Contains(rec.Body.String(), "gorabbit_publisher_published_total") {
+		t.Fatal("metrics must be exposed")
+	}
+
+	var statuses []gorabbit.ConsumerStatus
+	if code := adminRequest(t, h, http.MethodPost, "/consumers/all/stop", "", &statuses); code != http.StatusAccepted {
+		t.Fatalf("stop must be accepted, got %v", code)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 0 })
+}
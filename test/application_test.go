@@ -0,0 +1,389 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/gorabbit/gorabbittest"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// wait until condition is true
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 2)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not reached")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestApplication_ConsumeFakeBroker(t *testing.T) {
+	var processed int32
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{
+		"test": {Queue: "rmq.test", Server: "local", Count: 3, Callback: func(d amqp.Delivery) {
+			atomic.AddInt32(&processed, 1)
+		}},
+	}).SetDialer(b.Dial)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if e := a.Consume("test"); e != nil {
+			t.Error(e)
+		}
+	}()
+	eventually(t, func() bool { return b.Consumers("rmq.test") == 3 })
+
+	for i := 0; i < 100; i++ {
+		if e := a.Publish(amqp.Publishing{Body: []byte("hello")}, "rmq.test", "local"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	eventually(t, func() bool { return atomic.LoadInt32(&processed) == 100 })
+	if b.Unacked("rmq.test") != 0 {
+		t.Fatal("all messages must be acked")
+	}
+
+	a.GetRegistry()["test"].Stop()
+	<-done
+	eventually(t, func() bool { return b.Consumers("rmq.test") == 0 })
+}
+
+func TestApplication_ConsumeConnectionClosed(t *testing.T) {
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{
+		"fan": {Queue: "rmq.fanout1", Server: "local", Count: 1, Callback: func(d amqp.Delivery) {}},
+	}).SetDialer(b.Dial)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- a.Consume("fan")
+	}()
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	b.CloseConnections("shutdown")
+	select {
+	case e := <-result:
+		if e == nil {
+			t.Fatal("consume must return error on connection close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("consume must stop on connection close")
+	}
+}
+
+func TestApplication_Metrics(t *testing.T) {
+	b := fakebroker.New()
+	m := gorabbit.NewPrometheusMetrics(nil)
+	a := testInitApp(gorabbit.Registry{
+		"metrics": {Queue: "rmq.fanout2", Server: "local", Count: 1, Callback: func(d amqp.Delivery) {}},
+	}).SetDialer(b.Dial).SetMetrics(m)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = a.Consume("metrics")
+	}()
+	eventually(t, func() bool { return b.Consumers("rmq.fanout2") == 1 })
+	if e := a.Publish(amqp.Publishing{Body: []byte("hello")}, "rmq.fanout2", "local"); e != nil {
+		t.Fatal(e)
+	}
+	expected := []string{
+		`gorabbit_publisher_published_total{server="local",queue="rmq.fanout2",consumer=""} 1`,
+		`gorabbit_consumer_deliveries_received_total{server="local",queue="rmq.fanout2",consumer="metrics"} 1`,
+		`gorabbit_consumer_deliveries_acked_total{server="local",queue="rmq.fanout2",consumer="metrics"} 1`,
+		`gorabbit_consumer_in_flight{server="local",queue="rmq.fanout2",consumer="metrics"} 0`,
+	}
+	eventually(t, func() bool {
+		buf := new(bytes.Buffer)
+		_, _ = m.WriteTo(buf)
+		for _, line := range expected {
+			if !strings.Contains(buf.String(), line+"\n") {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Unroutable mandatory message is not retried
+	if e := a.Publish(amqp.Publishing{}, "rmq.mandatory", "local"); e == nil || e.GetCode() != gorabbit.PublishErrorReturned {
+		t.Fatalf("returned message must fail publish, got %v", e)
+	}
+
+	a.GetRegistry()["metrics"].Stop()
+	<-done
+}
+
+func TestApplication_TracePropagation(t *testing.T) {
+	b := fakebroker.New()
+	tracer := gorabbittest.NewSpanRecorder()
+	received := make(chan amqp.Delivery, 1)
+	a := testInitApp(gorabbit.Registry{
+		"trace": {Queue: "rmq.fanout", Server: "local", Count: 1, Callback: func(d amqp.Delivery) {
+			received <- d
+		}},
+	}).SetDialer(b.Dial).SetTracer(tracer)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = a.Consume("trace")
+	}()
+	eventually(t, func() bool { return b.Consumers("rmq.fanout") == 1 })
+
+	parent, _ := gorabbit.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := gorabbit.ContextWithSpanContext(context.Background(), parent)
+	p := amqp.Publishing{Headers: amqp.Table{"tenant": "t1"}}
+	if e := a.PublishContext(ctx, p, "rmq.fanout", "local"); e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := p.Headers[gorabbit.HeaderTraceParent]; ok {
+		t.Fatal("headers of caller must not be modified")
+	}
+	d := <-received
+	if d.Headers["tenant"] != "t1" {
+		t.Fatal("headers must be published")
+	}
+	eventually(t, func() bool { return len(tracer.Ended()) == 2 })
+
+	spans := tracer.Ended()
+	producer, consumer := spans[0], spans[1]
+	if producer.Kind != gorabbit.SpanKindProducer || producer.Parent != parent {
+		t.Fatalf("wrong producer span %v", producer)
+	}
+	if consumer.Kind != gorabbit.SpanKindConsumer || consumer.Parent.SpanID != producer.Context.SpanID {
+		t.Fatalf("consumer span must be child of producer span %v", consumer)
+	}
+	if consumer.Context.TraceID != parent.TraceID || consumer.Attributes[gorabbit.AttributeConsumer] != "trace" {
+		t.Fatalf("wrong consumer span %v", consumer)
+	}
+	if sc, _ := gorabbit.ExtractTraceContext(d.Headers); sc.SpanID != producer.Context.SpanID {
+		t.Fatal("delivery must contain producer span context")
+	}
+
+	a.GetRegistry()["trace"].Stop()
+	<-done
+}
+
+func TestApplication_PauseResume(t *testing.T) {
+	var processed int32
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{
+		"paused": {Queue: "rmq.test", Server: "local", Count: 2, Callback: func(d amqp.Delivery) {
+			atomic.AddInt32(&processed, 1)
+		}},
+	}).SetDialer(b.Dial)
+
+	if e := a.ResumeConsumer("paused"); e == nil || e.GetCode() != gorabbit.ConsumerErrorNotPaused {
+		t.Fatal("resume of running consumer must fail")
+	}
+	if e := a.StartConsumer("paused"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.test") == 2 })
+
+	reply := runCommand(t, a, "consumer pause paused", 1)
+	if !strings.Contains(reply[0], "Consumer 'paused' is paused") {
+		t.Fatalf("wrong pause reply %s", reply[0])
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.test") == 0 })
+	status, _ := a.ConsumerStatus("paused")
+	if !status.Paused || !status.Connected || status.Subscribers != 0 || !status.Ready {
+		t.Fatalf("wrong status of paused consumer %v", status)
+	}
+	if e := a.PauseConsumer("paused"); e == nil || e.GetCode() != gorabbit.ConsumerErrorPaused {
+		t.Fatal("second pause must fail")
+	}
+	if e := a.Publish(amqp.Publishing{Body: []byte("hello")}, "rmq.test", "local"); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if atomic.LoadInt32(&processed) != 0 || b.QueueLength("rmq.test") != 1 {
+		t.Fatal("paused consumer must not receive messages")
+	}
+
+	// Pause survives reconnect
+	b.CloseConnections("reconnect")
+	eventually(t, func() bool { return b.Connections() == 0 })
+	// Paused consumer does not fail readiness while connection is lost
+	if status, _ = a.ConsumerStatus("paused"); !status.Ready || !a.IsReady() {
+		t.Fatalf("paused consumer must be ready %v", status)
+	}
+	deadline := time.Now().Add(time.Second * 3)
+	for b.Connections() == 0 || !a.GetRegistry()["paused"].IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("consumer must reconnect")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if b.Consumers("rmq.test") != 0 || !a.GetRegistry()["paused"].IsPaused() {
+		t.Fatal("consumer must stay paused after reconnect")
+	}
+
+	var results []gorabbit.ConsumerCommandResult
+	reply = runCommand(t, a, "consumer resume paused --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Error != "" || results[0].Status.Paused || results[0].Status.Subscribers != 2 {
+		t.Fatalf("wrong resume result %v", results)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.test") == 2 })
+	eventually(t, func() bool { return atomic.LoadInt32(&processed) == 1 })
+
+	if e := a.StopConsumer("paused"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.test") == 0 })
+}
+
+func TestApplication_ConsumerStateMachine(t *testing.T) {
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{
+		"first":  {Queue: "rmq.fanout1", Server: "local", Count: 1, Callback: func(d amqp.Delivery) {}},
+		"second": {Queue: "rmq.fanout2", Server: "local", Count: 2, Callback: func(d amqp.Delivery) {}},
+	}).SetDialer(b.Dial)
+	state := func(name string) gorabbit.ConsumerState {
+		status, _ := a.ConsumerStatus(name)
+		return status.State
+	}
+	if state("first") != gorabbit.ConsumerStateIdle {
+		t.Fatal("consumer must be idle before start")
+	}
+
+	// Supervisor retries failed consumer
+	b.FailDial(errors.New("connection refused"))
+	if e := a.StartConsumer("first"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return state("first") == gorabbit.ConsumerStateFailed })
+	if e := a.StartConsumer("first"); e == nil || e.GetCode() != gorabbit.ConsumerErrorStarted {
+		t.Fatal("failed consumer is supervised and can not be started again")
+	}
+	if e := a.StartConsumer("second"); e != nil {
+		t.Fatal(e)
+	}
+	b.FailDial(nil)
+	eventually(t, func() bool {
+		return state("first") == gorabbit.ConsumerStateRunning && state("second") == gorabbit.ConsumerStateRunning
+	})
+	if b.Consumers("rmq.fanout1") != 1 || b.Consumers("rmq.fanout2") != 2 {
+		t.Fatal("every consumer must be started once")
+	}
+
+	// Stop of failed consumer cancels retries
+	b.FailDial(errors.New("connection refused"))
+	b.CloseConnections("failure")
+	eventually(t, func() bool { return state("first") == gorabbit.ConsumerStateFailed })
+	if e := a.StopConsumer("first"); e != nil {
+		t.Fatal(e)
+	}
+	if state("first") != gorabbit.ConsumerStateIdle {
+		t.Fatal("stopped consumer must be idle")
+	}
+	b.FailDial(nil)
+	eventually(t, func() bool { return state("second") == gorabbit.ConsumerStateRunning })
+	time.Sleep(gorabbit.DefaultRetryDelay + time.Millisecond*100)
+	if state("first") != gorabbit.ConsumerStateIdle || b.Consumers("rmq.fanout1") != 0 {
+		t.Fatal("stopped consumer must not be retried")
+	}
+
+	// Concurrent commands are serialized by state machine
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 3 {
+			case 0:
+				_ = a.StartConsumer("first")
+			case 1:
+				_ = a.RestartConsumer("first")
+			case 2:
+				_ = a.SetConsumerCount("first", i%4+1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	eventually(t, func() bool {
+		status, _ := a.ConsumerStatus("first")
+		return status.State == gorabbit.ConsumerStateRunning && b.Consumers("rmq.fanout1") == status.Desired
+	})
+	for _, name := range []string{"first", "second"} {
+		if e := a.StopConsumer(name); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if b.Consumers("rmq.fanout1") != 0 || b.Consumers("rmq.fanout2") != 0 {
+		t.Fatal("all subscribers must be stopped")
+	}
+}
+
+func TestApplication_StopUnsupervisedConsumer(t *testing.T) {
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{
+		"fan": {Queue: "rmq.fanout1", Server: "local", Count: 1, Callback: func(d amqp.Delivery) {}},
+	}).SetDialer(b.Dial)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- a.Consume("fan")
+	}()
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+
+	// Concurrent stops of consumer without supervisor
+	var wg sync.WaitGroup
+	var stopped int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e := a.StopConsumer("fan"); e == nil {
+				atomic.AddInt32(&stopped, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if stopped != 1 {
+		t.Fatalf("consumer must be stopped once, stopped %d", stopped)
+	}
+	select {
+	case e := <-result:
+		if e != nil {
+			t.Fatal(e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("consume must return on stop")
+	}
+	status, _ := a.ConsumerStatus("fan")
+	if status.State != gorabbit.ConsumerStateIdle || b.Consumers("rmq.fanout1") != 0 {
+		t.Fatal("stopped consumer must be idle")
+	}
+
+	// Restart moves consumer under supervisor
+	go func() {
+		result <- a.Consume("fan")
+	}()
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	if e := a.RestartConsumer("fan"); e != nil {
+		t.Fatal(e)
+	}
+	<-result
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	if e := a.StopConsumer("fan"); e != nil {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_BatchHandler(t *testing.T) {
+	b := fakebroker.New()
+	var m sync.Mutex
+	var sizes []int
+	handled := make(map[string]int)
+	handler := func(ctx context.Context, deliveries []amqp.Delivery) porterr.IError {
+		m.Lock()
+		defer m.Unlock()
+		sizes = append(sizes, len(deliveries))
+		failures := make(map[int]porterr.IError)
+		for i, d := range deliveries {
+			body := string(d.Body)
+			handled[body]++
+			switch {
+			case body == "reject":
+				failures[i] = gorabbit.RejectError("rejected")
+			case body == "retry" && handled[body] == 1:
+				failures[i] = porterr.New(porterr.PortErrorSystem, "retry")
+			}
+		}
+		if len(failures) > 0 {
+			return gorabbit.BatchError(failures)
+		}
+		return nil
+	}
+	batchSizes := func() []int {
+		m.Lock()
+		defer m.Unlock()
+		return append([]int(nil), sizes...)
+	}
+	a := testInitApp(gorabbit.Registry{}).SetDialer(b.Dial)
+	if e := a.RegisterConsumer("small", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Count: 1,
+		BatchHandler: handler, BatchSize: 3, Prefetch: gorabbit.Prefetch{Count: 2}}, false); e == nil {
+		t.Fatal("prefetch less than batch size must fail")
+	}
+	if e := a.RegisterConsumer("dedup", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Count: 1,
+		BatchHandler: handler, BatchSize: 3, Prefetch: gorabbit.Prefetch{Count: 3}, DedupStore: gorabbit.NewMemoryDedupStore(0)}, false); e == nil {
+		t.Fatal("dedup store of batch handler must fail")
+	}
+	if e := a.RegisterConsumer("batch", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Count: 1,
+		BatchHandler: handler, BatchSize: 3, BatchWait: time.Millisecond * 100, Prefetch: gorabbit.Prefetch{Count: 3}}, true); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+
+	// Full batches and partial batch after wait
+	for i := 0; i < 7; i++ {
+		if err := b.Publish("amq.fanout", "", amqp.Publishing{Body: []byte("ok")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool { return len(batchSizes()) == 3 })
+	if s := batchSizes(); s[0] != 3 || s[1] != 3 || s[2] != 1 {
+		t.Fatalf("wrong batch sizes %v", s)
+	}
+	eventually(t, func() bool { return b.Unacked("rmq.fanout1") == 0 && b.QueueLength("rmq.fanout1") == 0 })
+
+	// Failed deliveries are settled individually
+	for _, body := range []string{"retry", "reject", "ok"} {
+		if err := b.Publish("amq.fanout", "", amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return handled["retry"] == 2
+	})
+	eventually(t, func() bool { return b.Unacked("rmq.fanout1") == 0 && b.QueueLength("rmq.fanout1") == 0 })
+	m.Lock()
+	if handled["reject"] != 1 || handled["ok"] != 8 {
+		t.Fatalf("rejected delivery must not be requeued %v", handled)
+	}
+	m.Unlock()
+
+	// Collected batch is processed on stop
+	if e := a.UnregisterConsumer("batch"); e != nil {
+		t.Fatal(e)
+	}
+	if e := a.RegisterConsumer("batch", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Count: 1,
+		BatchHandler: handler, BatchSize: 3, BatchWait: time.Minute, Prefetch: gorabbit.Prefetch{Count: 3}}, true); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	count := len(batchSizes())
+	for i := 0; i < 2; i++ {
+		if err := b.Publish("amq.fanout", "", amqp.Publishing{Body: []byte("ok")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool { return b.Unacked("rmq.fanout1") == 2 })
+	// Let subscriber receive deliveries from client channel
+	time.Sleep(time.Millisecond * 50)
+	if e := a.StopConsumer("batch"); e != nil {
+		t.Fatal(e)
+	}
+	if s := batchSizes(); len(s) != count+1 || s[count] != 2 || b.Unacked("rmq.fanout1") != 0 || b.QueueLength("rmq.fanout1") != 0 {
+		t.Fatalf("collected batch must be processed on stop %v", s)
+	}
+
+	// Collected batch is processed on pause because channel stays open
+	if e := a.StartConsumer("batch"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	count = len(batchSizes())
+	for i := 0; i < 2; i++ {
+		if err := b.Publish("amq.fanout", "", amqp.Publishing{Body: []byte("ok")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool { return b.Unacked("rmq.fanout1") == 2 })
+	time.Sleep(time.Millisecond * 50)
+	if e := a.PauseConsumer("batch"); e != nil {
+		t.Fatal(e)
+	}
+	if s := batchSizes(); len(s) != count+1 || s[count] != 2 || b.Unacked("rmq.fanout1") != 0 || b.QueueLength("rmq.fanout1") != 0 {
+		t.Fatalf("collected batch must be processed on pause %v", s)
+	}
+	if e := a.StopConsumer("batch"); e != nil {
+		t.Fatal(e)
+	}
+}
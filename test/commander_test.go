@@ -0,0 +1,112 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/dimonrus/gocli"
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Run command and read reply lines
+func runCommand(t *testing.T, a *gorabbit.Application, origin string, lines int) []string {
+	server, client := net.Pipe()
+	defer client.Close()
+	command := gocli.ParseCommand([]byte(origin))
+	command.BindConnection(server)
+	go func() {
+		defer server.Close()
+		a.ConsumerCommander(command)
+	}()
+	reader := bufio.NewReader(client)
+	result := make([]string, 0, lines)
+	for i := 0; i < lines; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, line)
+	}
+	// Drain rest of reply
+	go func() { _, _ = reader.ReadString(0) }()
+	return result
+}
+
+func TestApplication_ConsumerCommanderJSON(t *testing.T) {
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{
+		"first":  {Queue: "rmq.fanout1", Server: "local", Count: 2, Callback: func(d amqp.Delivery) {}},
+		"second": {Queue: "rmq.fanout2", Server: "local", Count: 1, Callback: func(d amqp.Delivery) {}},
+	}).SetDialer(b.Dial)
+
+	var results []gorabbit.ConsumerCommandResult
+	reply := runCommand(t, a, "consumer start first --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "first" || results[0].Action != gorabbit.CommandStart || results[0].Error != "" {
+		t.Fatalf("wrong start result %v", results)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 2 })
+	eventually(t, func() bool {
+		status, _ := a.ConsumerStatus("first")
+		return status.Uptime > 0
+	})
+
+	var statuses []gorabbit.ConsumerStatus
+	reply = runCommand(t, a, "consumer status all --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0].Name != "first" || statuses[1].Name != "second" {
+		t.Fatalf("wrong statuses %v", statuses)
+	}
+	first, second := statuses[0], statuses[1]
+	if first.Queue != "rmq.fanout1" || first.Server != "local" || first.Desired != 2 || first.Subscribers != 2 ||
+		first.Connection != gorabbit.ConnectionStateOpen || first.Uptime <= 0 {
+		t.Fatalf("wrong status of running consumer %v", first)
+	}
+	if second.Subscribers != 0 || second.Connection != gorabbit.ConnectionStateClosed || second.Uptime != 0 {
+		t.Fatalf("wrong status of stopped consumer %v", second)
+	}
+
+	results = nil
+	reply = runCommand(t, a, "consumer start first --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &results); err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Code != gorabbit.ConsumerErrorStarted {
+		t.Fatalf("second start must fail %v", results)
+	}
+
+	// Bare json is a consumer name
+	results = nil
+	reply = runCommand(t, a, "consumer start json --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "json" || results[0].Code != gorabbit.ConsumerErrorNotFound {
+		t.Fatalf("bare json must be kept as consumer name %v", results)
+	}
+
+	// Text output is kept
+	reply = runCommand(t, a, "consumer status first", 1)
+	if !strings.Contains(reply[0], "Consumer 'first' have a 2 subscribers") {
+		t.Fatalf("wrong text reply %s", reply[0])
+	}
+
+	results = nil
+	reply = runCommand(t, a, "consumer stop all --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Error != "" || results[1].Code != gorabbit.ConsumerErrorStopped {
+		t.Fatalf("wrong stop results %v", results)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 0 })
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_Concurrency(t *testing.T) {
+	b := fakebroker.New()
+	var current, max, processed int32
+	release := make(chan struct{})
+	handler := func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		n := atomic.AddInt32(&current, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&current, -1)
+		atomic.AddInt32(&processed, 1)
+		return nil
+	}
+	a := testInitApp(gorabbit.Registry{
+		"workers": {Queue: "rmq.fanout1", Server: "local", Count: 1, Concurrency: 4,
+			Prefetch: gorabbit.Prefetch{Count: 10}, Handler: handler},
+	}).SetDialer(b.Dial)
+	if e := a.StartConsumer("workers"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	for i := 0; i < 8; i++ {
+		if err := b.Publish("amq.fanout", "", amqp.Publishing{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool { return atomic.LoadInt32(&current) == 4 })
+	close(release)
+	eventually(t, func() bool { return atomic.LoadInt32(&processed) == 8 && b.Unacked("rmq.fanout1") == 0 })
+	if atomic.LoadInt32(&max) != 4 {
+		t.Fatalf("pool must be bounded by concurrency, got %v", max)
+	}
+	if e := a.StopConsumer("workers"); e != nil {
+		t.Fatal(e)
+	}
+
+	// Count is not limited by 255
+	if e := a.SetConsumerCount("workers", 300); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 300 })
+	if e := a.StopConsumer("workers"); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestApplication_OrderedAck(t *testing.T) {
+	b := fakebroker.New()
+	var m sync.Mutex
+	done := make(map[string]bool)
+	release := make(chan struct{})
+	handler := func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		if string(d.Body) == "block" {
+			<-release
+		}
+		m.Lock()
+		done[string(d.Body)] = true
+		m.Unlock()
+		if string(d.Body) == "reject" {
+			return gorabbit.RejectError("rejected")
+		}
+		return nil
+	}
+	a := testInitApp(gorabbit.Registry{}).SetDialer(b.Dial)
+	if e := a.RegisterConsumer("shared", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Count: 2,
+		OrderedAck: true, Handler: handler}, false); e == nil {
+		t.Fatal("ordered ack on shared channel of many subscribers must fail")
+	}
+	if e := a.RegisterConsumer("ordered", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Count: 2,
+		Isolation: gorabbit.IsolationChannel, Concurrency: 3, OrderedAck: true, Handler: handler}, true); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 2 })
+	if e := a.SetConsumerCount("ordered", 1); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	for _, body := range []string{"block", "ok", "reject"} {
+		if err := b.Publish("amq.fanout", "", amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return done["ok"] && done["reject"]
+	})
+	// Rejected delivery is settled immediately. Successful delivery waits for previous one
+	eventually(t, func() bool { return b.Unacked("rmq.fanout1") == 2 })
+	close(release)
+	eventually(t, func() bool { return b.Unacked("rmq.fanout1") == 0 && b.QueueLength("rmq.fanout1") == 0 })
+	if e := a.UnregisterConsumer("ordered"); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestApplication_ConcurrencyIsolatedPause(t *testing.T) {
+	b := fakebroker.New()
+	var current int32
+	release := make(chan struct{})
+	handler := func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		atomic.AddInt32(&current, 1)
+		<-release
+		return nil
+	}
+	a := testInitApp(gorabbit.Registry{
+		"workers": {Queue: "rmq.fanout1", Server: "local", Count: 1, Concurrency: 4, Isolation: gorabbit.IsolationChannel,
+			Prefetch: gorabbit.Prefetch{Count: 4}, Handler: handler},
+	}).SetDialer(b.Dial)
+	if e := a.StartConsumer("workers"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	for i := 0; i < 4; i++ {
+		if err := b.Publish("amq.fanout", "", amqp.Publishing{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool { return atomic.LoadInt32(&current) == 4 })
+	paused := make(chan porterr.IError)
+	go func() { paused <- a.PauseConsumer("workers") }()
+	close(release)
+	if e := <-paused; e != nil {
+		t.Fatal(e)
+	}
+	// In-flight deliveries are acked before channel of subscriber is closed
+	if b.Unacked("rmq.fanout1") != 0 || b.QueueLength("rmq.fanout1") != 0 {
+		t.Fatalf("deliveries must be acked, unacked %v, ready %v", b.Unacked("rmq.fanout1"), b.QueueLength("rmq.fanout1"))
+	}
+	if e := a.StopConsumer("workers"); e != nil {
+		t.Fatal(e)
+	}
+}
@@ -1,3 +1,5 @@
+//go:build integration
+
 package test
 
 import (
@@ -8,19 +10,12 @@ import (
 	amqp "github.com/rabbitmq/amqp091-go"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strconv"
 	"sync/atomic"
 	"testing"
 	"time"
 )
 
-type rConfig struct {
-	Arguments gocli.ArgumentMap
-	Rabbit    gorabbit.Config
-}
-
-var cfg rConfig
 var registry = map[string]*gorabbit.Consumer{
 	"test": {Queue: "rmq.test", Server: "local", Callback: tTestConsume, Count: 5},
 	"fan1": {Queue: "rmq.fanout1", Server: "local", Callback: tTestConsumeFanout, Count: 1},
@@ -52,25 +47,8 @@ func tTestConsumeFanout(d amqp.Delivery) {
 	fmt.Println("Тестовое сообщение успешно получено: "+string(d.Body), " - ", fanoutProcessed)
 }
 
-// Init test application
-func testInitApp() *gorabbit.Application {
-	rootPath, err := filepath.Abs("")
-	if err != nil {
-		panic(err)
-	}
-
-	app := gocli.NewApplication("global", rootPath+"/config", &cfg)
-	app.ParseFlags(cfg.Arguments)
-
-	a := gorabbit.NewApplication(cfg.Rabbit, app).SetRegistry(registry)
-
-	a.AttentionMessage("Starting AMQP Application...")
-
-	return a
-}
-
 func TestApplication_Consume(t *testing.T) {
-	a := testInitApp()
+	a := testInitApp(registry)
 	go func() {
 		e := a.Start(":3333", a.ConsumerCommander)
 		if e != nil {
@@ -97,7 +75,7 @@ func TestApplication_Consume(t *testing.T) {
 }
 
 func TestApplication_Publish(t *testing.T) {
-	app := testInitApp()
+	app := testInitApp(registry)
 	pub := amqp.Publishing{
 		Body: []byte("Hello my friend"),
 	}
@@ -110,7 +88,8 @@ func TestApplication_Publish(t *testing.T) {
 				pub.Body = []byte("hello:" + strconv.Itoa(v))
 				e := app.Publish(pub, "rmq.test", "local")
 				if e != nil {
-					t.Fatal(e)
+					t.Error(e)
+					return
 				}
 			}
 		}(value, pub)
@@ -124,7 +103,7 @@ func TestApplication_Publish(t *testing.T) {
 }
 
 func TestApplication_PublishFanout(t *testing.T) {
-	app := testInitApp()
+	app := testInitApp(registry)
 	pub := amqp.Publishing{
 		Body: []byte("Hello my friend"),
 	}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_Dedup(t *testing.T) {
+	b := fakebroker.New()
+	var m sync.Mutex
+	handled := make(map[string]int)
+	handler := func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		m.Lock()
+		defer m.Unlock()
+		handled[gorabbit.ConsumerInfoFromContext(ctx).Queue+"/"+d.MessageId]++
+		return nil
+	}
+	// Consumers of different queues share store
+	store := gorabbit.NewMemoryDedupStore(0)
+	metrics := gorabbit.NewPrometheusMetrics(nil)
+	a := testInitApp(gorabbit.Registry{
+		"dedup": {Queue: "rmq.fanout1", Server: "local", Count: 1, Handler: handler, DedupStore: store},
+		"other": {Queue: "rmq.fanout2", Server: "local", Count: 1, Handler: handler, DedupStore: store},
+	}).SetDialer(b.Dial).SetMetrics(metrics)
+	for _, name := range []string{"dedup", "other"} {
+		if e := a.StartConsumer(name); e != nil {
+			t.Fatal(e)
+		}
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 && b.Consumers("rmq.fanout2") == 1 })
+
+	// Duplicates are acked without handler call
+	for i := 0; i < 3; i++ {
+		if err := b.Publish("amq.fanout", "", amqp.Publishing{MessageId: "same"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Publisher assigns message id
+	for i := 0; i < 2; i++ {
+		if e := a.Publish(amqp.Publishing{}, "rmq.fanout1", "local"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	eventually(t, func() bool {
+		return b.Unacked("rmq.fanout1") == 0 && b.QueueLength("rmq.fanout1") == 0 &&
+			b.Unacked("rmq.fanout2") == 0 && b.QueueLength("rmq.fanout2") == 0
+	})
+	m.Lock()
+	if len(handled) != 6 || handled["rmq.fanout1/same"] != 1 || handled["rmq.fanout2/same"] != 1 || handled["rmq.fanout1/"] != 0 {
+		t.Fatalf("duplicates must be skipped per queue and message id generated %v", handled)
+	}
+	m.Unlock()
+	// Duplicates are not counted as received deliveries
+	buf := new(bytes.Buffer)
+	_, _ = metrics.WriteTo(buf)
+	for _, line := range []string{
+		`gorabbit_consumer_deliveries_received_total{server="local",queue="rmq.fanout1",consumer="dedup"} 3`,
+		`gorabbit_consumer_deliveries_acked_total{server="local",queue="rmq.fanout1",consumer="dedup"} 3`,
+		`gorabbit_consumer_duplicates_total{server="local",queue="rmq.fanout1",consumer="dedup"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("metric %s is not found in\n%s", line, buf.String())
+		}
+	}
+	for _, name := range []string{"dedup", "other"} {
+		if e := a.StopConsumer(name); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
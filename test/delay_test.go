@@ -0,0 +1,94 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_PublishDelayed(t *testing.T) {
+	b := fakebroker.New()
+	var m sync.Mutex
+	received := make(map[string]time.Time)
+	handler := func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		m.Lock()
+		defer m.Unlock()
+		received[string(d.Body)] = time.Now()
+		return nil
+	}
+	receivedAt := func(body string) (time.Time, bool) {
+		m.Lock()
+		defer m.Unlock()
+		at, ok := received[body]
+		return at, ok
+	}
+	a := testInitApp(gorabbit.Registry{
+		"delayed":  {Queue: "rmq.delayed", Server: "local", Count: 1, Handler: handler},
+		"deferred": {Queue: "rmq.deferred", Server: "local", Count: 1, Handler: handler},
+	}).SetDialer(b.Dial)
+	for _, name := range []string{"delayed", "deferred"} {
+		if e := a.StartConsumer(name); e != nil {
+			t.Fatal(e)
+		}
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.delayed") == 1 && b.Consumers("rmq.deferred") == 1 })
+
+	ctx := context.Background()
+	start := time.Now()
+	if e := a.PublishDelayed(ctx, amqp.Publishing{Body: []byte("plugin")}, time.Millisecond*200, "rmq.delayed", "local"); e != nil {
+		t.Fatal(e)
+	}
+	for _, delay := range []time.Duration{time.Millisecond * 300, time.Millisecond * 100} {
+		body := delay.String()
+		if e := a.PublishDelayed(ctx, amqp.Publishing{Body: []byte(body)}, delay, "rmq.deferred", "local"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	// Message waits in delay queue of exact delay
+	if b.QueueLength("rmq.deferred.delay.300.deferred") != 1 || b.QueueLength("rmq.deferred.delay.100.deferred") != 1 {
+		t.Fatal("message must wait in delay queue of its delay")
+	}
+	delays := map[string]time.Duration{"plugin": time.Millisecond * 200, "300ms": time.Millisecond * 300, "100ms": time.Millisecond * 100}
+	for body, delay := range delays {
+		eventually(t, func() bool {
+			_, ok := receivedAt(body)
+			return ok
+		})
+		if at, _ := receivedAt(body); at.Sub(start) < delay {
+			t.Fatalf("message %s is received before delay %s", body, at.Sub(start))
+		}
+	}
+	// Short delay does not wait behind long delay published earlier
+	short, _ := receivedAt("100ms")
+	long, _ := receivedAt("300ms")
+	if !short.Before(long) {
+		t.Fatal("message with short delay must be received first")
+	}
+
+	// Not positive delay publishes immediately
+	if e := a.PublishDelayed(ctx, amqp.Publishing{Body: []byte("now")}, 0, "rmq.delayed", "local"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool {
+		_, ok := receivedAt("now")
+		return ok
+	})
+
+	if e := a.PublishDelayed(ctx, amqp.Publishing{}, gorabbit.MaxDelayQueue+time.Millisecond, "rmq.deferred", "local"); e == nil || e.GetCode() != gorabbit.PublishErrorDelay {
+		t.Fatalf("delay over max delay of delay queue must fail, got %v", e)
+	}
+	if e := a.PublishDelayed(ctx, amqp.Publishing{}, time.Second, "rmq.fanout1", "local"); e == nil || e.GetCode() != gorabbit.PublishErrorDelay {
+		t.Fatalf("delay plugin requires delayed message exchange, got %v", e)
+	}
+	for _, name := range []string{"delayed", "deferred"} {
+		if e := a.StopConsumer(name); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
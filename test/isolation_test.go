@@ -0,0 +1,94 @@
+package test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_IsolatedSubscribers(t *testing.T) {
+	b := fakebroker.New()
+	var processed int32
+	release := make(chan struct{})
+	callback := func(d amqp.Delivery) {
+		// First message blocks its subscriber
+		if atomic.AddInt32(&processed, 1) == 1 {
+			<-release
+		}
+	}
+	a := testInitApp(gorabbit.Registry{
+		"channel": {Queue: "rmq.fanout1", Server: "local", Count: 2, Callback: callback,
+			Isolation: gorabbit.IsolationChannel, Prefetch: gorabbit.Prefetch{Count: 1}},
+		"connection": {Queue: "rmq.fanout2", Server: "local", Count: 2, Callback: func(d amqp.Delivery) {},
+			Isolation: gorabbit.IsolationConnection},
+	}).SetDialer(b.Dial)
+
+	if e := a.StartConsumer("connection"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout2") == 2 })
+	if b.Connections() != 3 {
+		t.Fatalf("every subscriber must have own connection, got %v", b.Connections())
+	}
+	if e := a.StopConsumer("connection"); e != nil {
+		t.Fatal(e)
+	}
+	if b.Connections() != 0 {
+		t.Fatal("connections of subscribers must be closed")
+	}
+
+	if e := a.StartConsumer("channel"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 2 })
+	// Slow subscriber does not block other subscriber
+	for i := 0; i < 4; i++ {
+		if err := b.Publish("amq.fanout", "", amqp.Publishing{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool { return atomic.LoadInt32(&processed) == 4 })
+
+	// Failed channel restarts only its subscriber
+	close(release)
+	eventually(t, func() bool { return b.Unacked("rmq.fanout1") == 0 })
+
+	// Pause cancels isolated subscribers without resubscribe
+	if e := a.PauseConsumer("channel"); e != nil {
+		t.Fatal(e)
+	}
+	if status, _ := a.ConsumerStatus("channel"); status.LastError != "" || b.Consumers("rmq.fanout1") != 0 {
+		t.Fatalf("pause must not be handled as channel failure %v", status)
+	}
+	if e := a.ResumeConsumer("channel"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 2 })
+	tags := b.ConsumerTags("rmq.fanout1")
+	if !b.CloseChannel(tags[0], "test") {
+		t.Fatal("channel must be closed")
+	}
+	if b.Consumers("rmq.fanout1") != 1 || b.Connections() != 1 {
+		t.Fatal("other subscriber and connection must stay open")
+	}
+	if err := b.Publish("amq.fanout", "", amqp.Publishing{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return atomic.LoadInt32(&processed) == 5 })
+	time.Sleep(gorabbit.DefaultRetryDelay)
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 2 })
+	status, _ := a.ConsumerStatus("channel")
+	if status.State != gorabbit.ConsumerStateRunning || status.Subscribers != 2 || b.Connections() != 1 {
+		t.Fatalf("consumer must not be restarted %v", status)
+	}
+	if e := a.StopConsumer("channel"); e != nil {
+		t.Fatal(e)
+	}
+	if b.Connections() != 0 {
+		t.Fatal("connection must be closed")
+	}
+}
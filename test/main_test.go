@@ -0,0 +1,37 @@
+package test
+
+import (
+	"github.com/dimonrus/gocli"
+	"github.com/dimonrus/gorabbit"
+	"path/filepath"
+	"sync"
+)
+
+type rConfig struct {
+	Arguments gocli.ArgumentMap
+	Rabbit    gorabbit.Config
+}
+
+var cfg rConfig
+
+// Flags can be parsed only once
+var parseFlags sync.Once
+
+// Init test application
+func testInitApp(r gorabbit.Registry) *gorabbit.Application {
+	rootPath, err := filepath.Abs("")
+	if err != nil {
+		panic(err)
+	}
+
+	app := gocli.NewApplication("global", rootPath+"/config", &cfg)
+	parseFlags.Do(func() {
+		app.ParseFlags(cfg.Arguments)
+	})
+
+	a := gorabbit.NewApplication(cfg.Rabbit, app).SetRegistry(r)
+
+	a.AttentionMessage("Starting AMQP Application...")
+
+	return a
+}
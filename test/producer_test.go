@@ -0,0 +1,135 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Declare queue bound to routing key and start consuming
+func consumeQueue(t *testing.T, b *fakebroker.Broker, queue, key string) <-chan amqp.Delivery {
+	conn, err := b.Dial("amqp://fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ch.QueueDeclare(queue, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = ch.QueueBind(queue, key, "amq.direct", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume(queue, "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func TestApplication_PublishInterceptors(t *testing.T) {
+	b := fakebroker.New()
+	deliveries := consumeQueue(t, b, "intercepted", "intercepted")
+	a := testInitApp(nil).SetDialer(b.Dial).
+		UsePublish(
+			gorabbit.MessageIdInterceptor(nil),
+			gorabbit.TimestampInterceptor(),
+			gorabbit.AppIdInterceptor("orders-api"),
+			gorabbit.CorrelationIdInterceptor(),
+			gorabbit.TenantInterceptor(),
+			gorabbit.ValidateInterceptor(func(m *gorabbit.PublishMessage) error {
+				if m.Publishing.ContentType != "application/json" {
+					return errors.New("content type must be json")
+				}
+				return nil
+			}),
+		).
+		RegisterPublishInterceptor("limit", gorabbit.MaxBodySizeInterceptor(8))
+
+	ctx := gorabbit.ContextWithTenant(gorabbit.ContextWithCorrelationId(context.Background(), "corr-1"), "tenant-1")
+	if e := a.PublishContext(ctx, amqp.Publishing{ContentType: "application/json", Body: []byte("{}")}, "rmq.intercepted", "local"); e != nil {
+		t.Fatal(e)
+	}
+	d := <-deliveries
+	if len(d.MessageId) != 36 || d.Timestamp.IsZero() || d.AppId != "orders-api" || d.CorrelationId != "corr-1" || d.Headers[gorabbit.HeaderTenant] != "tenant-1" {
+		t.Fatalf("message is not enriched: %v", d)
+	}
+
+	e := a.PublishContext(ctx, amqp.Publishing{Body: []byte("{}")}, "rmq.intercepted", "local")
+	if e == nil || e.GetCode() != gorabbit.PublishErrorValidation {
+		t.Fatalf("invalid message must be rejected, got %v", e)
+	}
+	e = a.PublishContext(ctx, amqp.Publishing{ContentType: "application/json", Body: []byte(`{"big":true}`)}, "rmq.intercepted", "local")
+	if e == nil || e.GetCode() != gorabbit.PublishErrorBodySize {
+		t.Fatalf("oversized message must be rejected, got %v", e)
+	}
+	// Queue interceptor is not registered
+	e = testInitApp(nil).SetDialer(b.Dial).Publish(amqp.Publishing{}, "rmq.intercepted", "local")
+	if e == nil {
+		t.Fatal("unknown interceptor must fail publish")
+	}
+}
+
+func TestApplication_PublishRetry(t *testing.T) {
+	b := fakebroker.New()
+	first := consumeQueue(t, b, "retry.first", "retry.first")
+	second := consumeQueue(t, b, "retry.second", "retry.second")
+	a := testInitApp(nil).SetDialer(b.Dial)
+
+	// Only routing keys not confirmed are published again
+	b.FailPublish("retry.second")
+	if e := a.Publish(amqp.Publishing{Body: []byte("retry")}, "rmq.test", "local", "retry.first", "retry.second"); e != nil {
+		t.Fatal(e)
+	}
+	<-first
+	<-second
+	select {
+	case <-first:
+		t.Fatal("confirmed routing key must not be published again")
+	case <-second:
+		t.Fatal("message must be published once to failed routing key")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// Nacked message is not retried
+	b.NackPublishes(true)
+	start := time.Now()
+	if e := a.Publish(amqp.Publishing{}, "rmq.test", "local", "retry.first"); e == nil || e.GetCode() != gorabbit.PublishErrorNack {
+		t.Fatalf("nack must be returned, got %v", e)
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatal("nacked message must not be retried")
+	}
+}
+
+func TestConnectionPool_Lease(t *testing.T) {
+	b := fakebroker.New()
+	deliveries := consumeQueue(t, b, "lease", "lease")
+	a := testInitApp(nil)
+	sp := gorabbit.NewServerPool(a.GetLogger()).SetDialer(b.Dial)
+	defer sp.Close()
+	cp := sp.GetConnectionPoolOrCreate("local", cfg.Rabbit.Servers["local"])
+	ctx := context.Background()
+	var conn *gorabbit.PoolConn
+	conn, e := cp.Acquire(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = conn.Publish(ctx, "amq.direct", "lease", false, amqp.Publishing{Body: []byte("lease")}); e != nil {
+		t.Fatal(e)
+	}
+	cp.Release(conn)
+	if string((<-deliveries).Body) != "lease" {
+		t.Fatal("message must be published with leased connection")
+	}
+	if stats := cp.Stats(); stats.Open != 1 || stats.Idle != 1 {
+		t.Fatalf("released connection must be idle %v", stats)
+	}
+}
@@ -0,0 +1,161 @@
+package test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_QueueCommands(t *testing.T) {
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{}).SetDialer(b.Dial)
+	conn, _ := b.Dial("amqp://fake")
+	ch, _ := conn.Channel()
+	if _, err := ch.QueueDeclare("rmq.test", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("rmq.test", "golkp-test-message", "amq.direct", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		e := a.Publish(amqp.Publishing{MessageId: "m" + string(rune('0'+i)), Headers: amqp.Table{"n": int32(i)}, Body: []byte(strings.Repeat("x", 2000))}, "rmq.test", "local")
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	reply := runCommand(t, a, "queue info rmq.test", 1)
+	if !strings.Contains(reply[0], "Queue 'rmq.test' on server 'local' has 3 messages and 0 consumers") {
+		t.Fatalf("wrong info reply %s", reply[0])
+	}
+
+	var result gorabbit.QueueCommandResult
+	reply = runCommand(t, a, "queue peek rmq.test 2 --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Messages) != 2 || result.Messages[0].MessageId != "m0" || result.Messages[1].Headers["n"] != float64(1) ||
+		!strings.HasSuffix(result.Messages[0].Body, "...(2000 bytes)") {
+		t.Fatalf("wrong peek result %v", result)
+	}
+	if b.QueueLength("rmq.test") != 3 {
+		t.Fatal("peeked messages must be requeued")
+	}
+	reply = runCommand(t, a, "queue peek rmq.test", 2)
+	if !strings.Contains(reply[1], "message_id=m0") || !strings.Contains(reply[1], "redelivered=true") {
+		t.Fatalf("wrong peek reply %s", reply[1])
+	}
+
+	reply = runCommand(t, a, "queue purge rmq.test", 1)
+	if !strings.Contains(reply[0], "Confirm in 1m0s with: queue purge rmq.test ") {
+		t.Fatalf("wrong purge reply %s", reply[0])
+	}
+	result = gorabbit.QueueCommandResult{}
+	reply = runCommand(t, a, "queue purge rmq.test wrong --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Code != gorabbit.QueueErrorConfirm || b.QueueLength("rmq.test") != 3 {
+		t.Fatalf("purge with wrong token must fail %v", result)
+	}
+
+	token, e := a.PurgeToken("rmq.test")
+	if e != nil {
+		t.Fatal(e)
+	}
+	result = gorabbit.QueueCommandResult{}
+	reply = runCommand(t, a, "queue purge rmq.test "+token+" --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Purged == nil || *result.Purged != 3 || b.QueueLength("rmq.test") != 0 {
+		t.Fatalf("wrong purge result %v", result)
+	}
+	if _, e = a.PurgeQueue("rmq.test", token); e == nil {
+		t.Fatal("token must be accepted once")
+	}
+
+	if _, e = a.QueueInfo("rmq.unknown"); e == nil {
+		t.Fatal("queue must be defined in config")
+	}
+}
+
+func TestApplication_Replay(t *testing.T) {
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{}).SetDialer(b.Dial)
+	conn, _ := b.Dial("amqp://fake")
+	ch, _ := conn.Channel()
+	for queue, key := range map[string]string{"rmq.test": "golkp-test-message", "rmq.parking": "parking"} {
+		if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.QueueBind(queue, key, "amq.direct", false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = ch.QueueBind("rmq.parking", "parking.other", "amq.direct", false, nil)
+	for i, tenant := range []string{"a", "b", "a", "a"} {
+		key := "parking"
+		if i == 3 {
+			key = "parking.other"
+		}
+		_ = b.Publish("amq.direct", key, amqp.Publishing{MessageId: tenant, Headers: amqp.Table{"tenant": tenant}})
+	}
+
+	result, e := a.ReplayDryRun("rmq.parking", "rmq.test", gorabbit.ReplayFilter{Headers: map[string]string{"tenant": "a"}}, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result.Scanned != 4 || result.Matched != 3 || result.Replayed != 0 || b.QueueLength("rmq.parking") != 4 {
+		t.Fatalf("wrong dry run result %v", result)
+	}
+
+	reply := runCommand(t, a, "queue replay rmq.parking rmq.test 1 --header tenant a", 1)
+	if !strings.Contains(reply[0], "scanned 1, matched 1, replayed 1") {
+		t.Fatalf("wrong replay reply %s", reply[0])
+	}
+	if b.QueueLength("rmq.parking") != 3 || b.QueueLength("rmq.test") != 1 {
+		t.Fatal("message must be moved")
+	}
+
+	var jsonResult gorabbit.ReplayResult
+	reply = runCommand(t, a, "queue replay rmq.parking rmq.test --key parking.other --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &jsonResult); err != nil {
+		t.Fatal(err)
+	}
+	if jsonResult.Matched != 1 || jsonResult.Replayed != 1 || b.QueueLength("rmq.parking") != 2 || b.QueueLength("rmq.test") != 2 {
+		t.Fatalf("wrong replay by routing key %v", jsonResult)
+	}
+
+	// Source is not acked without confirm
+	b.NackPublishes(true)
+	result, e = a.Replay("rmq.parking", "rmq.test", gorabbit.ReplayFilter{}, 0)
+	if e == nil || result.Replayed != 0 || b.QueueLength("rmq.parking") != 2 {
+		t.Fatalf("nacked message must stay in source %v", result)
+	}
+	b.NackPublishes(false)
+	result, e = a.Replay("rmq.parking", "rmq.test", gorabbit.ReplayFilter{}, 0)
+	if e != nil || result.Replayed != 2 || b.QueueLength("rmq.parking") != 0 {
+		t.Fatalf("wrong replay of all messages %v %v", result, e)
+	}
+
+	// Message is published once to dst with many routing keys
+	ready := b.QueueLength("rmq.test")
+	result, e = a.Replay("rmq.test", "rmq.parking", gorabbit.ReplayFilter{}, 1)
+	if e != nil || result.Replayed != 1 || b.QueueLength("rmq.parking") != 1 || b.QueueLength("rmq.test") != ready-1 {
+		t.Fatalf("message must be published once %v %v", result, e)
+	}
+
+	// Dead-lettered message is published to original exchange and routing key
+	_, _, _ = ch.Get("rmq.parking", true)
+	death := amqp.Table{"exchange": "amq.direct", "routing-keys": []interface{}{"golkp-test-message"}, "queue": "rmq.test", "reason": "rejected"}
+	_ = b.Publish("amq.direct", "parking", amqp.Publishing{Headers: amqp.Table{"x-death": []interface{}{death}}})
+	result, e = a.Replay("rmq.parking", "rmq.parking", gorabbit.ReplayFilter{}, 0)
+	if e != nil || result.Replayed != 1 || b.QueueLength("rmq.parking") != 0 || b.QueueLength("rmq.test") != ready {
+		t.Fatalf("message must be published to original route %v %v", result, e)
+	}
+}
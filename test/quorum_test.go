@@ -0,0 +1,53 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_QuorumDeliveryLimit(t *testing.T) {
+	b := fakebroker.New()
+	var m sync.Mutex
+	var counts []int64
+	handler := func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		m.Lock()
+		defer m.Unlock()
+		if gorabbit.ConsumerInfoFromContext(ctx).DeliveryCount != gorabbit.DeliveryCount(d) {
+			t.Error("delivery count must be set in consumer info")
+		}
+		counts = append(counts, gorabbit.DeliveryCount(d))
+		return porterr.New(porterr.PortErrorSystem, "always fails")
+	}
+	a := testInitApp(gorabbit.Registry{}).SetDialer(b.Dial)
+	conn, _ := b.Dial("amqp://fake")
+	ch, _ := conn.Channel()
+	if _, err := ch.QueueDeclare("rmq.parking", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("rmq.parking", "parking", "amq.direct", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := a.RegisterConsumer("quorum", &gorabbit.Consumer{Queue: "rmq.quorum", Server: "local", Count: 1,
+		Handler: handler}, true); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.quorum") == 1 })
+	if err := b.Publish("amq.direct", "quorum", amqp.Publishing{Body: []byte("poison")}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return b.QueueLength("rmq.parking") == 1 })
+	m.Lock()
+	defer m.Unlock()
+	if len(counts) != 3 || counts[0] != 0 || counts[1] != 1 || counts[2] != 2 {
+		t.Fatalf("wrong delivery counts %v", counts)
+	}
+	if b.QueueLength("rmq.quorum") != 0 {
+		t.Fatal("message must leave quorum queue after delivery limit")
+	}
+}
@@ -0,0 +1,135 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_RegisterConsumer(t *testing.T) {
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{}).SetDialer(b.Dial)
+	a.RegisterHandler("noop", func(ctx context.Context, d amqp.Delivery) porterr.IError { return nil })
+	callback := func(d amqp.Delivery) {}
+
+	for name, consumer := range map[string]*gorabbit.Consumer{
+		"unknown queue":  {Queue: "rmq.unknown", Server: "local", Callback: callback},
+		"unknown server": {Queue: "rmq.test", Server: "remote", Callback: callback},
+		"no handler":     {Queue: "rmq.test", Server: "local"},
+	} {
+		if e := a.RegisterConsumer(name, consumer, false); e == nil {
+			t.Fatalf("%s must fail", name)
+		}
+	}
+	if e := a.RegisterConsumer("first", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Count: 1, Callback: callback}, true); e != nil {
+		t.Fatal(e)
+	}
+	if e := a.RegisterConsumer("first", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Callback: callback}, false); e == nil || e.GetCode() != gorabbit.ConsumerErrorExists {
+		t.Fatal("duplicate name must fail")
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+
+	reply := runCommand(t, a, "consumer add second rmq.fanout2 local noop 2 start", 1)
+	if !strings.Contains(reply[0], "Consumer 'second' is registered") {
+		t.Fatalf("wrong add reply %s", reply[0])
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout2") == 2 })
+	var results []gorabbit.ConsumerCommandResult
+	reply = runCommand(t, a, "consumer add third rmq.fanout2 local unknown --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Code != gorabbit.ConsumerErrorHandler {
+		t.Fatalf("unknown handler must fail %v", results)
+	}
+
+	// Registry is safe for concurrent changes
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("dynamic%v", i)
+			if e := a.RegisterConsumer(name, &gorabbit.Consumer{Queue: "rmq.test", Server: "local", Count: 1, Callback: callback}, i%2 == 0); e != nil {
+				t.Error(e)
+			}
+			a.ConsumersStatus()
+			if e := a.UnregisterConsumer(name); e != nil {
+				t.Error(e)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(a.GetRegistry()) != 2 || b.Consumers("rmq.test") != 0 {
+		t.Fatal("dynamic consumers must be removed")
+	}
+
+	results = nil
+	reply = runCommand(t, a, "consumer remove all --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Code != porterr.PortErrorParam || len(a.GetRegistry()) != 2 {
+		t.Fatalf("remove of all consumers must fail %v", results)
+	}
+
+	results = nil
+	reply = runCommand(t, a, "consumer remove first second --json", 1)
+	if err := json.Unmarshal([]byte(reply[0]), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Error != "" || results[1].Error != "" {
+		t.Fatalf("wrong remove results %v", results)
+	}
+	if len(a.ConsumersStatus()) != 0 || b.Consumers("rmq.fanout1") != 0 || b.Consumers("rmq.fanout2") != 0 {
+		t.Fatal("removed consumers must be stopped")
+	}
+	if e := a.UnregisterConsumer("first"); e == nil || e.GetCode() != gorabbit.ConsumerErrorNotFound {
+		t.Fatal("removed consumer must not be found")
+	}
+
+	// Consumer is kept in registry until it is stopped
+	release := make(chan struct{})
+	received := make(chan struct{})
+	if e := a.RegisterConsumer("slow", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Count: 1,
+		Callback: func(d amqp.Delivery) {
+			close(received)
+			<-release
+		}}, true); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	if e := a.Publish(amqp.Publishing{}, "rmq.fanout1", "local"); e != nil {
+		t.Fatal(e)
+	}
+	<-received
+	removed := make(chan porterr.IError, 1)
+	go func() {
+		removed <- a.UnregisterConsumer("slow")
+	}()
+	eventually(t, func() bool {
+		status, _ := a.ConsumerStatus("slow")
+		return status.State == gorabbit.ConsumerStateStopping
+	})
+	if e := a.UnregisterConsumer("slow"); e == nil || e.GetCode() != gorabbit.ConsumerErrorStopping {
+		t.Fatal("consumer must be stopping")
+	}
+	if _, e := a.ConsumerStatus("slow"); e != nil {
+		t.Fatal("stopping consumer must be kept in registry")
+	}
+	close(release)
+	if e := <-removed; e != nil {
+		t.Fatal(e)
+	}
+	if _, e := a.ConsumerStatus("slow"); e == nil || b.Consumers("rmq.fanout1") != 0 {
+		t.Fatal("stopped consumer must be removed")
+	}
+}
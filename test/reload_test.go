@@ -0,0 +1,252 @@
+package test
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Copy of test config. Maps are not shared with loaded config
+func copyConfig() gorabbit.Config {
+	config := gorabbit.Config{Servers: make(gorabbit.Servers), Queues: make(gorabbit.Queues)}
+	for name, srv := range cfg.Rabbit.Servers {
+		config.Servers[name] = srv
+	}
+	for name, q := range cfg.Rabbit.Queues {
+		config.Queues[name] = q
+	}
+	return config
+}
+
+func TestApplication_ReloadConfig(t *testing.T) {
+	b := fakebroker.New()
+	var dials int32
+	dialer := func(url string) (gorabbit.Connection, error) {
+		atomic.AddInt32(&dials, 1)
+		return b.Dial(url)
+	}
+	// Deliveries are acked by consumer after callback
+	callback := func(d amqp.Delivery) {}
+	var m sync.Mutex
+	var parked []string
+	park := func(d amqp.Delivery) {
+		m.Lock()
+		parked = append(parked, d.RoutingKey)
+		m.Unlock()
+	}
+	a := testInitApp(gorabbit.Registry{
+		"parking": {Queue: "rmq.parking", Server: "local", Count: 1, Callback: park},
+		"fanout":  {Queue: "rmq.fanout1", Server: "local", Count: 1, Callback: callback},
+		"idle":    {Queue: "rmq.fanout2", Server: "local", Count: 1, Callback: callback},
+	}).SetDialer(dialer)
+	for _, name := range []string{"parking", "fanout"} {
+		if e := a.StartConsumer(name); e != nil {
+			t.Fatal(e)
+		}
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.parking") == 1 && b.Consumers("rmq.fanout1") == 1 })
+	if e := a.Publish(amqp.Publishing{}, "rmq.fanout1", "local"); e != nil {
+		t.Fatal(e)
+	}
+
+	// Routing keys are rebound without restart
+	config := copyConfig()
+	parking := config.Queues["rmq.parking"]
+	parking.RoutingKey = []string{"parking", "parking.new"}
+	config.Queues["rmq.parking"] = parking
+	before := atomic.LoadInt32(&dials)
+	result, e := a.ReloadConfig(config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(result.Restarted) != 0 || len(result.Pools) != 0 || len(result.Rebound) != 1 || result.Rebound[0] != "rmq.parking" {
+		t.Fatalf("wrong rebind result %v", result)
+	}
+	// Bindings are changed on dedicated connection
+	if atomic.LoadInt32(&dials) != before+1 || b.Consumers("rmq.parking") != 1 {
+		t.Fatal("consumer must not be restarted on routing key change")
+	}
+	for _, key := range []string{"parking.other", "parking.new", "parking"} {
+		if err := b.Publish("amq.direct", key, amqp.Publishing{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return len(parked) > 0 && parked[len(parked)-1] == "parking"
+	})
+	// Message with removed routing key is not routed
+	if strings.Join(parked, ",") != "parking.new,parking" {
+		t.Fatalf("wrong routed messages %v", parked)
+	}
+
+	// Bindings of queue without running consumer are reconciled
+	if e = a.StopConsumer("fanout"); e != nil {
+		t.Fatal(e)
+	}
+	config = copyConfig()
+	config.Queues["rmq.parking"] = parking
+	fanout := config.Queues["rmq.fanout1"]
+	fanout.Exchange, fanout.Type, fanout.RoutingKey = "rmq.reload", "direct", []string{"reload"}
+	config.Queues["rmq.fanout1"] = fanout
+	if result, e = a.ReloadConfig(config); e != nil {
+		t.Fatal(e)
+	}
+	if len(result.Rebound) != 1 || result.Rebound[0] != "rmq.fanout1" {
+		t.Fatalf("wrong rebind result of stopped consumer %v", result)
+	}
+	ready := b.QueueLength("rmq.fanout1")
+	_ = b.Publish("amq.fanout", "", amqp.Publishing{})
+	_ = b.Publish("rmq.reload", "reload", amqp.Publishing{})
+	if b.QueueLength("rmq.fanout1") != ready+1 {
+		t.Fatal("queue must be bound only to exchange of new config")
+	}
+	config = copyConfig()
+	config.Queues["rmq.parking"] = parking
+	if _, e = a.ReloadConfig(config); e != nil {
+		t.Fatal(e)
+	}
+	if e = a.StartConsumer("fanout"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+
+	// Change of publish options does not restart consumer
+	config = copyConfig()
+	config.Queues["rmq.parking"] = parking
+	fanout = config.Queues["rmq.fanout1"]
+	fanout.Mandatory, fanout.Interceptors, fanout.Delay = true, []string{"limit"}, gorabbit.DelayQueue
+	config.Queues["rmq.fanout1"] = fanout
+	if result, e = a.ReloadConfig(config); e != nil {
+		t.Fatal(e)
+	}
+	if len(result.Restarted) != 0 {
+		t.Fatalf("publish options must not restart consumer %v", result)
+	}
+
+	// Only consumer of changed queue is restarted
+	config = copyConfig()
+	config.Queues["rmq.parking"] = parking
+	fanout = config.Queues["rmq.fanout1"]
+	fanout.Prefetch = gorabbit.Prefetch{Count: 5}
+	config.Queues["rmq.fanout1"] = fanout
+	before = atomic.LoadInt32(&dials)
+	result, e = a.ReloadConfig(config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(result.Restarted) != 1 || result.Restarted[0] != "fanout" || len(result.Rebound) != 0 {
+		t.Fatalf("wrong restart result %v", result)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	if atomic.LoadInt32(&dials) != before+1 {
+		t.Fatal("only one consumer must be restarted")
+	}
+	if a.GetConfig().Queues["rmq.fanout1"].Prefetch.Count != 5 {
+		t.Fatal("config must be replaced")
+	}
+
+	// Config reload command rebuilds pool of server with changed publish options without restart of consumers
+	a.SetConfigLoader(func() (gorabbit.Config, porterr.IError) {
+		config := copyConfig()
+		config.Queues["rmq.parking"], config.Queues["rmq.fanout1"] = parking, fanout
+		srv := config.Servers["local"]
+		srv.MaxConnections = 3
+		config.Servers["local"] = srv
+		return config, nil
+	})
+	reply := runCommand(t, a, "config reload --json", 1)
+	result = gorabbit.ReloadResult{}
+	if err := json.Unmarshal([]byte(reply[0]), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Error != "" || len(result.Pools) != 1 || result.Pools[0] != "local" || len(result.Restarted) != 0 {
+		t.Fatalf("wrong reload reply %s", reply[0])
+	}
+
+	// Consumers are restarted on change of server connection
+	a.SetConfigLoader(func() (gorabbit.Config, porterr.IError) {
+		config := copyConfig()
+		config.Queues["rmq.parking"], config.Queues["rmq.fanout1"] = parking, fanout
+		srv := config.Servers["local"]
+		srv.MaxConnections, srv.Vhost = 3, "reload"
+		config.Servers["local"] = srv
+		return config, nil
+	})
+	reply = runCommand(t, a, "config reload --json", 1)
+	result = gorabbit.ReloadResult{}
+	if err := json.Unmarshal([]byte(reply[0]), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Error != "" || len(result.Pools) != 1 || len(result.Restarted) != 2 {
+		t.Fatalf("wrong reload reply %s", reply[0])
+	}
+	if a.ConsumersStatus()[1].State != gorabbit.ConsumerStateIdle {
+		t.Fatal("idle consumer must not be started")
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.parking") == 1 && b.Consumers("rmq.fanout1") == 1 })
+	if e := a.Publish(amqp.Publishing{}, "rmq.fanout1", "local"); e != nil {
+		t.Fatal(e)
+	}
+
+	a.SetConfigLoader(nil)
+	reply = runCommand(t, a, "config reload", 1)
+	if !strings.Contains(reply[0], "Config loader is not defined") {
+		t.Fatalf("wrong reply without loader %s", reply[0])
+	}
+	for _, name := range []string{"parking", "fanout"} {
+		if e := a.StopConsumer(name); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+func TestApplication_ReloadUnsupervised(t *testing.T) {
+	b := fakebroker.New()
+	a := testInitApp(gorabbit.Registry{
+		"fanout": {Queue: "rmq.fanout1", Server: "local", Count: 1, Callback: func(d amqp.Delivery) {}},
+	}).SetDialer(b.Dial)
+	consumed := make(chan error, 1)
+	go func() {
+		consumed <- a.Consume("fanout")
+	}()
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+
+	// Concurrent reloads of the same config restart consumer once
+	config := copyConfig()
+	fanout := config.Queues["rmq.fanout1"]
+	fanout.Prefetch = gorabbit.Prefetch{Count: 5}
+	config.Queues["rmq.fanout1"] = fanout
+	var wg sync.WaitGroup
+	var restarted int32
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, e := a.ReloadConfig(config)
+			if e != nil {
+				t.Error(e)
+			}
+			atomic.AddInt32(&restarted, int32(len(result.Restarted)))
+		}()
+	}
+	wg.Wait()
+	if restarted != 1 {
+		t.Fatalf("consumer must be restarted once, restarted %d", restarted)
+	}
+	if e := <-consumed; e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.fanout1") == 1 })
+	if e := a.StopConsumer("fanout"); e != nil {
+		t.Fatal(e)
+	}
+}
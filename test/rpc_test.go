@@ -0,0 +1,79 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_Call(t *testing.T) {
+	for _, mode := range []gorabbit.ReplyMode{gorabbit.ReplyModeDirect, gorabbit.ReplyModeQueue} {
+		b := fakebroker.New()
+		handler := func(ctx context.Context, d amqp.Delivery) (amqp.Publishing, porterr.IError) {
+			if string(d.Body) == "fail" {
+				return amqp.Publishing{}, gorabbit.RejectError("failed")
+			}
+			return amqp.Publishing{Body: []byte(strings.ToUpper(string(d.Body)))}, nil
+		}
+		a := testInitApp(gorabbit.Registry{
+			"rpc": {Queue: "rmq.test", Server: "local", Count: 1, ReplyHandler: handler},
+		}).SetDialer(b.Dial).SetReplyMode(mode)
+		if e := a.StartConsumer("rpc"); e != nil {
+			t.Fatal(e)
+		}
+		eventually(t, func() bool { return b.Consumers("rmq.test") == 1 })
+
+		for _, body := range []string{"ping", "pong"} {
+			d, e := a.Call(context.Background(), "rmq.test", "local", amqp.Publishing{Body: []byte(body), CorrelationId: body})
+			if e != nil {
+				t.Fatal(e)
+			}
+			if string(d.Body) != strings.ToUpper(body) || d.CorrelationId != body {
+				t.Fatalf("wrong reply %v %s", d.CorrelationId, d.Body)
+			}
+		}
+
+		// Failed request is not replied
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		_, e := a.Call(ctx, "rmq.test", "local", amqp.Publishing{Body: []byte("fail")})
+		cancel()
+		if e == nil || e.GetCode() != gorabbit.CallErrorTimeout {
+			t.Fatalf("call must time out, got %v", e)
+		}
+
+		// Canceled call
+		ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*50, cancel)
+		if _, e = a.Call(ctx, "rmq.fanout2", "local", amqp.Publishing{}); e == nil || e.GetCode() != gorabbit.CallErrorCanceled {
+			t.Fatalf("call must be canceled, got %v", e)
+		}
+
+		// Unroutable mandatory request is returned
+		if _, e = a.Call(context.Background(), "rmq.mandatory", "local", amqp.Publishing{}); e == nil || e.GetCode() != gorabbit.PublishErrorReturned {
+			t.Fatalf("call must be returned, got %v", e)
+		}
+
+		// Waiting call fails on connection close. Next call uses new client
+		go func() {
+			time.Sleep(time.Millisecond * 50)
+			b.CloseConnections("test")
+		}()
+		if _, e = a.Call(context.Background(), "rmq.fanout2", "local", amqp.Publishing{}); e == nil || e.GetCode() != gorabbit.CallErrorClosed {
+			t.Fatalf("call must fail on close, got %v", e)
+		}
+		// Supervised consumer reconnects
+		eventually(t, func() bool { return b.Consumers("rmq.test") == 1 })
+		if d, e := a.Call(context.Background(), "rmq.test", "local", amqp.Publishing{Body: []byte("again")}); e != nil || string(d.Body) != "AGAIN" {
+			t.Fatalf("call must use new client %v", e)
+		}
+		if e = a.StopConsumer("rpc"); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
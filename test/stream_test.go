@@ -0,0 +1,148 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonrus/gorabbit"
+	"github.com/dimonrus/gorabbit/fakebroker"
+	"github.com/dimonrus/gorabbit/gorabbittest"
+	"github.com/dimonrus/porterr"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestApplication_StreamConsumer(t *testing.T) {
+	b := fakebroker.New()
+	var m sync.Mutex
+	var offsets []int64
+	handler := func(ctx context.Context, d amqp.Delivery) porterr.IError {
+		offset, _ := gorabbit.DeliveryOffset(d)
+		m.Lock()
+		defer m.Unlock()
+		offsets = append(offsets, offset)
+		return nil
+	}
+	processed := func() []int64 {
+		m.Lock()
+		defer m.Unlock()
+		return append([]int64(nil), offsets...)
+	}
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := b.Publish("amq.direct", "stream", amqp.Publishing{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a := testInitApp(gorabbit.Registry{}).SetDialer(b.Dial)
+	if e := a.RegisterConsumer("classic", &gorabbit.Consumer{Queue: "rmq.fanout1", Server: "local", Count: 1,
+		StreamOffset: gorabbit.StreamFirst, Handler: handler}, false); e == nil {
+		t.Fatal("stream offset of classic queue must fail")
+	}
+	if e := a.RegisterConsumer("prefetch", &gorabbit.Consumer{Queue: "rmq.stream", Server: "local", Count: 1,
+		Prefetch: gorabbit.Prefetch{Size: 1024}, Handler: handler}, false); e == nil {
+		t.Fatal("stream consumer without prefetch count must fail")
+	}
+	store := gorabbit.NewMemoryOffsetStore()
+	if e := a.RegisterConsumer("stream", &gorabbit.Consumer{Queue: "rmq.stream", Server: "local", Count: 2,
+		OffsetStore: store, Handler: handler}, false); e == nil {
+		t.Fatal("offset store of many subscribers must fail")
+	}
+	if e := a.RegisterConsumer("stream", &gorabbit.Consumer{Queue: "rmq.stream", Server: "local", Count: 1,
+		StreamOffset: gorabbit.StreamFirst, OffsetStore: store, Handler: handler}, true); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return b.Consumers("rmq.stream") == 1 })
+	publish(3)
+	eventually(t, func() bool { return len(processed()) == 3 })
+	if offset, ok, _ := store.Load(context.Background(), "stream", "rmq.stream"); !ok || offset != 2 {
+		t.Fatalf("processed offset must be saved, got %v", offset)
+	}
+	if e := a.StopConsumer("stream"); e != nil {
+		t.Fatal(e)
+	}
+
+	// Consuming is resumed after saved offset
+	publish(2)
+	if e := a.StartConsumer("stream"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return len(processed()) == 5 })
+	time.Sleep(time.Millisecond * 50)
+	if p := processed(); len(p) != 5 || p[3] != 3 || p[4] != 4 {
+		t.Fatalf("stream must be resumed after saved offset %v", p)
+	}
+	if e := a.UnregisterConsumer("stream"); e != nil {
+		t.Fatal(e)
+	}
+
+	// Consuming from timestamp
+	since := time.Now()
+	publish(1)
+	if e := a.RegisterConsumer("since", &gorabbit.Consumer{Queue: "rmq.stream", Server: "local", Count: 1,
+		StreamOffset: gorabbit.StreamSince(since), Handler: handler}, true); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return len(processed()) == 6 })
+	if p := processed(); p[5] != 5 {
+		t.Fatalf("stream must be consumed since timestamp %v", p)
+	}
+	if e := a.UnregisterConsumer("since"); e != nil {
+		t.Fatal(e)
+	}
+
+	// Processed offset is kept in memory without offset store
+	if e := a.RegisterConsumer("memory", &gorabbit.Consumer{Queue: "rmq.stream", Server: "local", Count: 1,
+		StreamOffset: gorabbit.StreamFirst, Handler: handler}, true); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return len(processed()) == 12 })
+	if e := a.PauseConsumer("memory"); e != nil {
+		t.Fatal(e)
+	}
+	publish(1)
+	if e := a.ResumeConsumer("memory"); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return len(processed()) == 13 })
+	if e := a.RestartConsumer("memory"); e != nil {
+		t.Fatal(e)
+	}
+	publish(1)
+	eventually(t, func() bool { return len(processed()) == 14 })
+	time.Sleep(time.Millisecond * 50)
+	if p := processed(); len(p) != 14 || p[12] != 6 || p[13] != 7 {
+		t.Fatalf("stream must be resumed after processed offset %v", p)
+	}
+	if e := a.UnregisterConsumer("memory"); e != nil {
+		t.Fatal(e)
+	}
+
+	// Error of offset store is logged
+	logger := gorabbittest.NewLogger()
+	a.SetStructuredLogger(logger)
+	if e := a.RegisterConsumer("failing", &gorabbit.Consumer{Queue: "rmq.stream", Server: "local", Count: 1,
+		StreamOffset: gorabbit.StreamAt(7), OffsetStore: failingOffsetStore{}, Handler: handler}, true); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return logger.Contains(gorabbittest.LevelError, "offset save error") })
+	if e := a.UnregisterConsumer("failing"); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// Offset store failing to save offsets
+type failingOffsetStore struct{}
+
+// Load offset is not stored
+func (failingOffsetStore) Load(ctx context.Context, consumer string, queue string) (int64, bool, error) {
+	return 0, false, nil
+}
+
+// Save always fails
+func (failingOffsetStore) Save(ctx context.Context, consumer string, queue string, offset int64) error {
+	return errors.New("store is not available")
+}
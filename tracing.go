@@ -0,0 +1,199 @@
+package gorabbit
+
+import (
+	"context"
+	"encoding/hex"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"strings"
+)
+
+const (
+	// HeaderTraceParent W3C trace context header
+	HeaderTraceParent = "traceparent"
+	// HeaderTraceState W3C trace state header
+	HeaderTraceState = "tracestate"
+
+	// Supported version of trace context
+	traceParentVersion = "00"
+	// Length of traceparent value for version 00
+	traceParentLength = 55
+	// Sampled flag
+	traceFlagSampled = byte(0x01)
+)
+
+// SpanKind kind of span
+type SpanKind int
+
+const (
+	// SpanKindProducer span of message publishing
+	SpanKindProducer SpanKind = iota + 1
+	// SpanKindConsumer span of delivery processing
+	SpanKindConsumer
+)
+
+// String name of kind
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindProducer:
+		return "producer"
+	case SpanKindConsumer:
+		return "consumer"
+	}
+	return "unspecified"
+}
+
+// Span attributes
+const (
+	// AttributeMessagingSystem messaging system name
+	AttributeMessagingSystem = "messaging.system"
+	// AttributeDestination queue name from config
+	AttributeDestination = "messaging.destination.name"
+	// AttributeRoutingKey routing key of message
+	AttributeRoutingKey = "messaging.rabbitmq.destination.routing_key"
+	// AttributeMessageId message id
+	AttributeMessageId = "messaging.message.id"
+	// AttributeConsumer consumer name from registry
+	AttributeConsumer = "messaging.consumer.name"
+)
+
+// SpanContext W3C trace context of span
+type SpanContext struct {
+	// Trace identifier
+	TraceID [16]byte
+	// Span identifier
+	SpanID [8]byte
+	// Trace flags
+	Flags byte
+	// Vendor specific trace state
+	TraceState string
+}
+
+// IsValid Check trace and span ids are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// IsSampled Check sampled flag
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&traceFlagSampled != 0
+}
+
+// TraceParent Format traceparent header value
+func (sc SpanContext) TraceParent() string {
+	return traceParentVersion + "-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// ParseTraceParent Parse traceparent header value
+func ParseTraceParent(value string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return
+	}
+	// Future versions can have more fields
+	if parts[0] == traceParentVersion && (len(parts) != 4 || len(value) != traceParentLength) {
+		return
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	flags := make([]byte, 1)
+	if _, err := hex.Decode(flags, []byte(parts[3])); err != nil {
+		return
+	}
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+// InjectTraceContext Write span context to message headers
+func InjectTraceContext(headers amqp.Table, sc SpanContext) {
+	if headers == nil || !sc.IsValid() {
+		return
+	}
+	headers[HeaderTraceParent] = sc.TraceParent()
+	if sc.TraceState != "" {
+		headers[HeaderTraceState] = sc.TraceState
+	} else {
+		delete(headers, HeaderTraceState)
+	}
+}
+
+// ExtractTraceContext Read span context from message headers
+func ExtractTraceContext(headers amqp.Table) (SpanContext, bool) {
+	value, _ := headers[HeaderTraceParent].(string)
+	sc, ok := ParseTraceParent(value)
+	if !ok {
+		return SpanContext{}, false
+	}
+	sc.TraceState, _ = headers[HeaderTraceState].(string)
+	return sc, true
+}
+
+// Context key of span context
+type spanContextKey struct{}
+
+// ContextWithSpanContext Put span context to context
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext Get span context from context
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// Span started span
+type Span interface {
+	// SpanContext context of span for propagation
+	SpanContext() SpanContext
+	// SetAttribute set span attribute
+	SetAttribute(key string, value interface{})
+	// RecordError record error on span
+	RecordError(err error)
+	// End finish span
+	End()
+}
+
+// Tracer Start spans for publishing and processing
+// Parent span context is available with SpanContextFromContext
+// Adapter to OpenTelemetry or other tracing system is implemented outside of package
+type Tracer interface {
+	// Start new span as child of span in context
+	// Returned context must contain SpanContext of new span
+	Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span)
+}
+
+// NopTracer Tracer that does not record spans
+// Span context of parent is propagated as is
+type NopTracer struct{}
+
+// Start return span of parent context
+func (NopTracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	return ctx, nopSpan{sc: SpanContextFromContext(ctx)}
+}
+
+// Span that does nothing
+type nopSpan struct {
+	// Parent span context
+	sc SpanContext
+}
+
+// SpanContext parent span context
+func (s nopSpan) SpanContext() SpanContext {
+	return s.sc
+}
+
+// SetAttribute do nothing
+func (nopSpan) SetAttribute(key string, value interface{}) {}
+
+// RecordError do nothing
+func (nopSpan) RecordError(err error) {}
+
+// End do nothing
+func (nopSpan) End() {}
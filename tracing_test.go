@@ -0,0 +1,51 @@
+package gorabbit
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceParent(value)
+	if !ok || !sc.IsSampled() || sc.TraceParent() != value {
+		t.Fatalf("wrong span context %v", sc)
+	}
+	for _, wrong := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, ok = ParseTraceParent(wrong); ok {
+			t.Errorf("traceparent %q must be invalid", wrong)
+		}
+	}
+	// Future version can have additional fields
+	if _, ok = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); !ok {
+		t.Error("future version must be parsed")
+	}
+}
+
+func TestInjectExtractTraceContext(t *testing.T) {
+	sc, _ := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sc.TraceState = "vendor=value"
+	headers := amqp.Table{}
+	InjectTraceContext(headers, sc)
+	extracted, ok := ExtractTraceContext(headers)
+	if !ok || extracted != sc {
+		t.Fatalf("extracted %v, expected %v", extracted, sc)
+	}
+	if _, ok = ExtractTraceContext(amqp.Table{}); ok {
+		t.Fatal("empty headers must not contain trace context")
+	}
+	// Nop tracer propagates parent
+	_, span := NopTracer{}.Start(ContextWithSpanContext(context.Background(), sc), "test", SpanKindProducer)
+	if span.SpanContext() != sc {
+		t.Fatal("nop span must propagate parent context")
+	}
+}
@@ -0,0 +1,83 @@
+package gorabbit
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Dialer open connection to server using amqp url
+type Dialer func(url string) (Connection, error)
+
+// Connection amqp connection abstraction
+type Connection interface {
+	// Channel open a unique, concurrent server channel
+	Channel() (Channel, error)
+	// Close connection and all channels
+	Close() error
+	// IsClosed check if connection is closed
+	IsClosed() bool
+	// NotifyClose register a listener for close events
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+}
+
+// Channel amqp channel abstraction
+type Channel interface {
+	// ExchangeDeclare declare an exchange on the server
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	// QueueDeclare declare a queue on the server
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	// QueueDeclarePassive check queue exists and get its state
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	// QueuePurge remove ready messages from queue
+	QueuePurge(name string, noWait bool) (int, error)
+	// QueueBind bind queue to exchange
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	// QueueUnbind remove binding of queue to exchange
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+	// Qos set prefetch settings
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	// Consume start delivering messages from queue
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	// Get take one message from queue
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	// Cancel stop deliveries to consumer. Deliveries channel is closed
+	Cancel(consumer string, noWait bool) error
+	// Publish a message
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	// Confirm put channel into confirm mode
+	Confirm(noWait bool) error
+	// GetNextPublishSeqNo sequence number of next publishing in confirm mode
+	GetNextPublishSeqNo() uint64
+	// NotifyPublish register a listener for publish confirmations
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	// NotifyReturn register a listener for unroutable mandatory messages
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	// Close channel
+	Close() error
+	// IsClosed check if channel is closed
+	IsClosed() bool
+	// NotifyClose register a listener for close events
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+}
+
+// amqpConnection adapter of amqp.Connection to Connection interface
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+// Channel open amqp channel
+func (c amqpConnection) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// DialAMQP Default dialer. Dial to RabbitMQ server
+func DialAMQP(url string) (Connection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{Connection: conn}, nil
+}